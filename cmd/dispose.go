@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nabbar/opendmarc-reports/database"
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/tools"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const (
+	dispose_keep     = ""
+	dispose_delete   = "delete"
+	dispose_move     = "move"
+	dispose_compress = "compress"
+)
+
+// disposition is the action done on an history file once imported, or once its import failed
+type disposition struct {
+	action string
+	dir    string
+}
+
+// parseDisposition read a disposition formatted as "delete", "compress" or "move:<dir>", an empty string keep the file
+func parseDisposition(str string) (disposition, error) {
+	var p = strings.SplitN(strings.TrimSpace(str), ":", 2)
+
+	switch strings.ToLower(p[0]) {
+	case dispose_keep, "keep":
+		return disposition{action: dispose_keep}, nil
+	case dispose_delete:
+		return disposition{action: dispose_delete}, nil
+	case dispose_compress:
+		return disposition{action: dispose_compress}, nil
+	case dispose_move:
+		if len(p) < 2 || strings.TrimSpace(p[1]) == "" {
+			return disposition{}, fmt.Errorf("disposition '%s' : directory missing", str)
+		}
+
+		return disposition{action: dispose_move, dir: strings.TrimSpace(p[1])}, nil
+	}
+
+	return disposition{}, fmt.Errorf("disposition '%s' not understand, expected delete, compress or move:<dir>", str)
+}
+
+// parseErrorDisposition read the disposition of a failed file : the file is kept, or moved with "move:<dir>"
+// to be fixed and imported again, but never deleted or compressed as its jobs are not all saved
+func parseErrorDisposition(str string) (disposition, error) {
+	dsp, err := parseDisposition(str)
+
+	if err != nil {
+		return disposition{}, err
+	} else if dsp.action != dispose_keep && dsp.action != dispose_move {
+		return disposition{}, fmt.Errorf("disposition '%s' not allowed on error, expected move:<dir>", str)
+	}
+
+	return dsp, nil
+}
+
+// disposeFile apply the disposition of the import result to the file, once all its jobs are committed, and log the file status
+func disposeFile(path string, cp *database.Checkpoints, done bool, nbj int) {
+	if path == "-" {
+		return
+	}
+
+	var (
+		dsp disposition
+		sts = "imported"
+		lvl = InfoLevel
+	)
+
+	if done {
+		dsp, _ = parseDisposition(flgImportOnSuccess)
+	} else {
+		dsp, _ = parseErrorDisposition(flgImportOnError)
+		sts = "failed"
+		lvl = ErrorLevel
+	}
+
+	res, gone, err := dsp.apply(path)
+	if ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("applying disposition '%s' to file '%s'", dsp.action, path), err) {
+		res = "kept (disposition failed)"
+	} else if gone && cp != nil && cp.Id != 0 {
+		// the file is no more at this path
+		ErrorLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("deleting checkpoint of file '%s'", path), cp.Delete())
+	}
+
+	lvl.Logf("File '%s' %s (%d jobs) : %s", path, sts, nbj, res)
+}
+
+// apply do the action on the file and return a description of the result, and if the file left its path
+func (d disposition) apply(path string) (string, bool, error) {
+	switch d.action {
+	case dispose_delete:
+		if err := os.Remove(path); err != nil {
+			return "", false, err
+		}
+
+		return "deleted", true, nil
+
+	case dispose_move:
+		dst := filepath.Join(d.dir, filepath.Base(path))
+
+		if err := os.MkdirAll(d.dir, 0750); err != nil {
+			return "", false, err
+		} else if err = moveFile(path, dst); err != nil {
+			return "", false, err
+		}
+
+		return "moved to " + dst, true, nil
+
+	case dispose_compress:
+		if typ, err := compressFile(path); err != nil {
+			return "", false, err
+		} else if typ != "" {
+			return "kept, already compressed with " + typ, false, nil
+		}
+
+		return "compressed to " + path + ".gz", true, nil
+	}
+
+	return "kept", false, nil
+}
+
+// moveFile rename the file, or copy and remove it if the destination is on another filesystem
+func moveFile(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("file '%s' already exists", dst)
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(src, dst, nil); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// compressFile replace the file by a gzip file, it return the compression format of a file already compressed
+func compressFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	typ, err := tools.FileCompression(f)
+	f.Close()
+
+	if err != nil {
+		return "", err
+	} else if typ != tools.CompressionNone {
+		return typ, nil
+	}
+
+	dst := path + ".gz"
+
+	if _, err = os.Stat(dst); err == nil {
+		return "", fmt.Errorf("file '%s' already exists", dst)
+	}
+
+	if err = copyFile(path, dst, func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	}); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+
+	return "", os.Remove(path)
+}
+
+// copyFile copy the content of src into the new file dst, with the same mode and times, through the optional packer
+func copyFile(src, dst string, pack func(w io.Writer) io.WriteCloser) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	inf, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, inf.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	var w io.WriteCloser = out
+
+	if pack != nil {
+		w = pack(out)
+	}
+
+	if _, err = io.Copy(w, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if pack != nil {
+		if err = w.Close(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, inf.ModTime(), inf.ModTime())
+}
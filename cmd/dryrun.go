@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nabbar/opendmarc-reports/history"
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/tools"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const (
+	dryRunJSON = "json"
+	dryRunYAML = "yaml"
+)
+
+// dryRunJob is a job as it would be saved by the import, with the names and the results instead of the ids and codes
+type dryRunJob struct {
+	File  string    `json:"file" yaml:"file"`
+	Line  int       `json:"line" yaml:"line"`
+	JobId string    `json:"job" yaml:"job"`
+	Date  time.Time `json:"date" yaml:"date"`
+
+	Reporter     string `json:"reporter" yaml:"reporter"`
+	Ip           string `json:"ip" yaml:"ip"`
+	FromDomain   string `json:"from_domain" yaml:"from_domain"`
+	EnvDomain    string `json:"env_domain" yaml:"env_domain"`
+	ToDomain     string `json:"to_domain,omitempty" yaml:"to_domain,omitempty"`
+	PolicyDomain string `json:"policy_domain" yaml:"policy_domain"`
+
+	Policy        int    `json:"policy" yaml:"policy"`
+	Disposition   string `json:"disposition" yaml:"disposition"`
+	AlignDKIM     string `json:"align_dkim" yaml:"align_dkim"`
+	AlignSPF      string `json:"align_spf" yaml:"align_spf"`
+	SPF           string `json:"spf" yaml:"spf"`
+	SPFDomain     string `json:"spf_domain,omitempty" yaml:"spf_domain,omitempty"`
+	SPFScope      string `json:"spf_scope,omitempty" yaml:"spf_scope,omitempty"`
+	Reason        string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	ReasonComment string `json:"reason_comment,omitempty" yaml:"reason_comment,omitempty"`
+
+	ARC       string            `json:"arc,omitempty" yaml:"arc,omitempty"`
+	ARCPolicy string            `json:"arc_policy,omitempty" yaml:"arc_policy,omitempty"`
+	ARCSeals  []history.ARCSeal `json:"arc_seals,omitempty" yaml:"arc_seals,omitempty"`
+	Request   dryRunRequest     `json:"request" yaml:"request"`
+	Signature []dryRunSignature `json:"signatures" yaml:"signatures"`
+	Unknown   []history.Field   `json:"unknown,omitempty" yaml:"unknown,omitempty"`
+	Errors    []string          `json:"errors,omitempty" yaml:"errors,omitempty"`
+	Missing   []string          `json:"missing,omitempty" yaml:"missing,omitempty"`
+}
+
+// dryRunRequest is the dmarc record of the policy domain, as published when the job was received
+type dryRunRequest struct {
+	Domain  string   `json:"domain" yaml:"domain"`
+	Rua     []string `json:"rua,omitempty" yaml:"rua,omitempty"`
+	Policy  string   `json:"p" yaml:"p"`
+	SPolicy string   `json:"sp" yaml:"sp"`
+	NPolicy string   `json:"np,omitempty" yaml:"np,omitempty"`
+	Pct     int      `json:"pct" yaml:"pct"`
+	ADKIM   string   `json:"adkim" yaml:"adkim"`
+	ASPF    string   `json:"aspf" yaml:"aspf"`
+	Fo      string   `json:"fo,omitempty" yaml:"fo,omitempty"`
+	Testing bool     `json:"testing" yaml:"testing"`
+}
+
+type dryRunSignature struct {
+	Domain   string `json:"domain" yaml:"domain"`
+	Selector string `json:"selector,omitempty" yaml:"selector,omitempty"`
+	Result   string `json:"result" yaml:"result"`
+	Error    bool   `json:"error" yaml:"error"`
+}
+
+// Dump return the job with the names and the results as reported, without any database id
+func (job jobItem) Dump() dryRunJob {
+	var res = dryRunJob{
+		File:          job.path,
+		JobId:         job.JobId,
+		Date:          job.Date,
+		Policy:        job.Policy,
+		Disposition:   job.GetDisp(),
+		AlignDKIM:     job.GetAlignDKIM(),
+		AlignSPF:      job.GetAlignSPF(),
+		SPF:           job.GetSPF(),
+		SPFScope:      job.SPFScope,
+		Reason:        job.Reason,
+		ReasonComment: job.ReasonComment,
+		Signature:     make([]dryRunSignature, 0),
+	}
+
+	if job.Reporter != nil {
+		res.Reporter = job.Reporter.Name
+	}
+
+	if job.Ip != nil {
+		res.Ip = job.Ip.Name
+	}
+
+	if job.FromDomain != nil {
+		res.FromDomain = job.FromDomain.Name
+	}
+
+	if job.EnvDomain != nil {
+		res.EnvDomain = job.EnvDomain.Name
+	}
+
+	if job.ToDomain != nil {
+		res.ToDomain = job.ToDomain.Name
+	}
+
+	if job.PolicyDomain != nil {
+		res.PolicyDomain = job.PolicyDomain.Name
+	}
+
+	if job.SPFDomain != nil {
+		res.SPFDomain = job.SPFDomain.Name
+	}
+
+	if job.Request != nil {
+		res.Request = dryRunRequest{
+			Domain:  res.PolicyDomain,
+			Rua:     tools.CleanMergeSlice(nil, strings.Split(job.Request.Repuri, ",")...),
+			Policy:  job.Request.GetPolicy(),
+			SPolicy: job.Request.GetSPolicy(),
+			NPolicy: job.Request.GetNPolicy(),
+			Pct:     job.Request.Pct,
+			ADKIM:   job.Request.GetADKIM(),
+			ASPF:    job.Request.GetASPF(),
+			Fo:      job.Request.Fo,
+			Testing: job.Request.IsTesting(),
+		}
+	}
+
+	for _, s := range job.signature {
+		if s == nil || s.Domain == nil {
+			continue
+		}
+
+		res.Signature = append(res.Signature, dryRunSignature{
+			Domain:   s.Domain.Name,
+			Selector: s.Selector,
+			Result:   s.GetPass(),
+			Error:    s.Error,
+		})
+	}
+
+	if h := job.source; h != nil {
+		res.Line = h.Line
+		res.Unknown = h.Unknown
+		res.Missing = h.Missing
+
+		if h.Has(history.KeyARC) {
+			res.ARC = job.GetARC()
+		}
+
+		if len(h.ARCSeals) > 0 {
+			res.ARCPolicy = job.GetARCPolicy()
+			res.ARCSeals = h.ARCSeals
+		}
+
+		for _, e := range h.Errors {
+			res.Errors = append(res.Errors, e.Error())
+		}
+	}
+
+	return res
+}
+
+// parseDryRunFormat check the output format of the dry run mode
+func parseDryRunFormat(format string) error {
+	switch strings.ToLower(format) {
+	case dryRunJSON, dryRunYAML:
+		return nil
+	}
+
+	return fmt.Errorf("dry run format '%s' not understand, must be json or yaml", format)
+}
+
+// runDryRun print the jobs of the files as they would be imported, without any database connection
+func runDryRun(files []string, format string, out io.Writer) {
+	var enc = json.NewEncoder(out)
+
+	for _, path := range files {
+		var nbj = 0
+
+		err := dryRunFile(path, func(job *jobItem) error {
+			nbj++
+
+			if strings.ToLower(format) == dryRunJSON {
+				return enc.Encode(job.Dump())
+			}
+
+			_, err := io.WriteString(out, job.String())
+			return err
+		})
+
+		if !ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", path), err) {
+			InfoLevel.Logf("File '%s' read : %d jobs", path, nbj)
+		}
+	}
+}
+
+// dryRunFile read all the jobs of the file from its start, ignoring the checkpoint, and give them to the function
+func dryRunFile(path string, fct func(job *jobItem) error) error {
+	f, src, typ, err := openHistory(path)
+	if err != nil {
+		return err
+	} else if f != nil {
+		defer f.Close()
+	}
+
+	unz, err := tools.Decompress(src, typ)
+	if err != nil {
+		return err
+	}
+
+	defer unz.Close()
+
+	var rdr = newJobReader(unz, 0)
+
+	for {
+		h, err := rdr.Next()
+
+		if err == io.EOF {
+			return nil
+		} else if p, isParse := err.(*history.ParseError); isParse {
+			reportLineError(path, p)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !checkJob(path, h) {
+			continue
+		}
+
+		if err = fct(NewHistoryJobItem(h, path)); err != nil {
+			return fmt.Errorf("writing job '%s' : %v", h.JobId, err)
+		}
+	}
+}
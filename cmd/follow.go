@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/history"
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/tools"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const (
+	// delay between two reads of a followed file at its end
+	follow_poll = time.Second
+	// delay between two checks of the file patterns for new files
+	follow_glob = 10 * time.Second
+)
+
+// runFollow tail the files matching the patterns until an interrupt signal, like tail -F
+func runFollow(args []string, idle time.Duration) {
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+		sig  = make(chan os.Signal, 1)
+		fol  = make(map[string]bool)
+	)
+
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-sig
+		InfoLevel.Logf("Signal '%s' received, stopping follow mode...", s.String())
+		close(stop)
+	}()
+
+	for {
+		for _, a := range args {
+			lst, _ := filepath.Glob(a)
+
+			for _, f := range lst {
+				if p, err := filepath.Abs(f); err == nil {
+					f = p
+				}
+
+				if fol[f] {
+					continue
+				}
+
+				InfoLevel.Logf("Following file: %s ...", f)
+
+				fol[f] = true
+				wg.Add(1)
+				go followFile(&wg, f, idle, stop)
+			}
+		}
+
+		select {
+		case <-stop:
+			DebugLevel.Logf("Waiting all followed files are closed...")
+			wg.Wait()
+			return
+		case <-time.After(follow_glob):
+		}
+	}
+}
+
+// followFile read the file until stopped, opening it again each time it is rotated
+func followFile(wg *sync.WaitGroup, path string, idle time.Duration, stop <-chan struct{}) {
+	defer wg.Done()
+
+	var (
+		run = true
+		h   *history.Job
+	)
+
+	for run {
+		run, h = followOpen(path, idle, stop, h)
+	}
+
+	if h != nil && checkJob(path, h) {
+		// the pending job of a rotated file cannot be read again on next import
+		bat := database.NewBatch(flgImportBatch)
+
+		InfoLevel.Logf("Saving Job Id '%s' from file %s...", h.JobId, path)
+
+		if NewHistoryJobItem(h, path).SaveJob(bat) {
+			flushJobs(bat, path)
+		}
+	}
+}
+
+// errFollowEnd is returned by a followed file at its end, instead of io.EOF as new lines can be written
+var errFollowEnd = errors.New("end of followed file")
+
+// followSource is a followed file, it keep the offset read and the time of the last data read
+type followSource struct {
+	f    *os.File
+	pos  int64
+	last time.Time
+}
+
+func (s *followSource) Read(p []byte) (int, error) {
+	n, err := s.f.Read(p)
+
+	if n > 0 {
+		s.pos += int64(n)
+		s.last = time.Now()
+	}
+
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil
+		}
+
+		return 0, errFollowEnd
+	}
+
+	return n, err
+}
+
+// followOpen read the file and wait for new lines, a job is only saved once the next job line
+// is read or the file stay idle for the timeout. It return false once stopped, true if the file
+// was rotated or cannot be read and so must be opened again. The pending job of a rotated file
+// is given back and kept pending into the new file, as its next lines could follow.
+func followOpen(path string, idle time.Duration, stop <-chan struct{}, h *history.Job) (bool, *history.Job) {
+	f, e := os.Open(path)
+
+	if e != nil {
+		DebugLevel.Logf("Cannot open followed file '%s' : %v", path, e)
+
+		select {
+		case <-stop:
+			return false, h
+		case <-time.After(follow_poll):
+			return true, h
+		}
+	}
+
+	defer f.Close()
+
+	inf, e := f.Stat()
+	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking file '%s'", path), e) {
+		return false, h
+	}
+
+	if typ, e := tools.FileCompression(f); e == nil && typ != tools.CompressionNone {
+		WarnLevel.Logf("File '%s' is %s compressed and cannot be followed, import it without the follow flag", path, typ)
+		return false, h
+	}
+
+	cp, off := loadCheckpoint(f, path, false)
+
+	// the lines before the checkpoint are counted, so the line numbers are the ones of the file
+	nbl, e := countLines(f, off)
+	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("reading file '%s' to offset %d", path, off), e) {
+		return false, h
+	}
+
+	if _, e = f.Seek(off, io.SeekStart); ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("seeking file '%s' to offset %d", path, off), e) {
+		return false, h
+	}
+
+	var (
+		ino = tools.FileInode(inf)
+		src = &followSource{f: f, pos: off, last: time.Now()}
+		rdr = history.NewReaderLine(src, off, nbl)
+		// ok is false once a batch is rolled back, the checkpoint is not moved after its jobs
+		ok  = true
+		bat = database.NewBatch(flgImportBatch)
+		// car is the job of the rotated file while it is pending, rot is true once a rotation is found
+		car = h
+		rot = false
+	)
+
+	if car != nil {
+		rdr.Continue(car)
+	}
+
+	// save add the job to the batch and move the checkpoint once the batch is written,
+	// force write the batch even if not full
+	save := func(j *history.Job, force bool) {
+		if j != nil && j == car {
+			car = nil
+		}
+
+		if j != nil && checkJob(path, j) {
+			InfoLevel.Logf("Saving Job Id '%s' from file %s...", j.JobId, path)
+			ok = NewHistoryJobItem(j, path).SaveJob(bat) && ok
+		}
+
+		if force {
+			ok = flushJobs(bat, path) && ok
+		} else if bat.Len() > 0 {
+			return
+		}
+
+		if ok {
+			saveCheckpoint(f, cp, rdr.Offset(), false)
+		}
+	}
+
+	for {
+		j, err := rdr.Next()
+
+		if err == nil {
+			save(j, false)
+			continue
+		} else if p, isParse := err.(*history.ParseError); isParse {
+			reportLineError(path, p)
+			continue
+		} else if err != errFollowEnd {
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", path), err)
+			return true, car
+		}
+
+		// end of file : no line is partially written since the idle timeout, the pending job is complete
+		if time.Since(src.last) > idle {
+			if j = rdr.Flush(); j != nil || bat.Len() > 0 {
+				save(j, true)
+			}
+		}
+
+		select {
+		case <-stop:
+			// the pending job will be read again on next import, except the one of the rotated file
+			// saved with its lines of this file
+			if car != nil {
+				rdr.Drop()
+				save(rdr.Flush(), false)
+			}
+
+			if flushJobs(bat, path) && ok {
+				saveCheckpoint(f, cp, rdr.Offset(), false)
+			}
+
+			return false, nil
+		case <-time.After(follow_poll):
+		}
+
+		st, err := os.Stat(path)
+
+		if (err != nil || tools.FileInode(st) != ino) && !rot {
+			// read to the end the lines written into the old file before its rotation
+			rot = true
+			continue
+		} else if err != nil || tools.FileInode(st) != ino {
+			InfoLevel.Logf("File '%s' was rotated, opening the new file...", path)
+
+			if txt := rdr.Drop(); txt != "" {
+				WarnLevel.Logf("Partial line at the end of rotated file '%s' is ignored : %s", path, txt)
+			}
+
+			// the complete jobs are written, the pending job is kept for the new file
+			if flushJobs(bat, path) && ok {
+				saveCheckpoint(f, cp, rdr.Offset(), false)
+			}
+
+			return true, rdr.Flush()
+		}
+
+		if st.Size() < src.pos {
+			WarnLevel.Logf("File '%s' was truncated (size %d, offset %d), reading it from start", path, st.Size(), src.pos)
+
+			if _, err = f.Seek(0, io.SeekStart); ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("seeking file '%s' to offset 0", path), err) {
+				return true, car
+			}
+
+			// the pending job is saved as it will not be completed
+			rdr.Drop()
+			j = rdr.Flush()
+
+			src.pos = 0
+			rdr = history.NewReaderLine(src, 0, 0)
+
+			save(j, true)
+		}
+	}
+}
+
+// countLines return the number of lines of the file before the offset
+func countLines(f *os.File, off int64) (int, error) {
+	var (
+		nbl int
+		buf = make([]byte, 32*1024)
+		rdr = io.LimitReader(f, off)
+	)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	for {
+		n, err := rdr.Read(buf)
+		nbl += bytes.Count(buf[:n], []byte{'\n'})
+
+		if err == io.EOF {
+			return nbl, nil
+		} else if err != nil {
+			return nbl, err
+		}
+	}
+}
@@ -6,18 +6,21 @@ import (
 	"fmt"
 	"path/filepath"
 
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
-	"strconv"
-
-	"sync"
+	"runtime"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/nabbar/opendmarc-reports/config"
 	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/history"
 	. "github.com/nabbar/opendmarc-reports/logger"
 	"github.com/nabbar/opendmarc-reports/tools"
 	"gopkg.in/yaml.v2"
@@ -39,9 +42,32 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// size of the file start hashed into the checkpoint
+const checkpoint_head = 1024
+
+var (
+	flgImportReset   bool
+	flgImportFollow  bool
+	flgImportIdle    string
+	flgImportBatch   int
+	flgImportWorkers int
+	// disposition of the files once imported or once their import failed
+	flgImportOnSuccess string
+	flgImportOnError   string
+	// strict mode reject the jobs with bad lines, the bad lines are written as JSON Lines into errors out
+	flgImportStrict    bool
+	flgImportErrorsOut string
+	// dry run mode print the jobs read instead of saving them
+	flgImportDryRun bool
+	flgImportFormat string
+	// syslog mode rebuild the jobs from the syslog lines of opendmarc, completed by the dmarc record with lookup
+	flgImportSyslog bool
+	flgImportLookup bool
+)
+
 // configCmd represents the config command
 var importCmd = &cobra.Command{
-	Use:     "import <dat file pattern> [<dat file pattern>, ...]",
+	Use:     "import <dat file pattern | -> [<dat file pattern>, ...]",
 	Example: "import /var/tmp/dmarc.dat /var/tmp/opendmarc.*",
 	Short:   "Import dat history file",
 	Long: `Import OpenDMARC history file
@@ -51,32 +77,75 @@ the record else update it.
 	Run: func(cmd *cobra.Command, args []string) {
 		DebugLevel.LogData("Viper Settings : ", viper.AllSettings())
 
+		err := openErrorsOut(flgImportErrorsOut)
+		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("opening errors output file '%s'", flgImportErrorsOut), err)
+
+		defer closeErrorsOut()
+
+		if flgImportDryRun {
+			database.SetDryRun()
+			runDryRun(listImportFiles(args), flgImportFormat, os.Stdout)
+			return
+		}
+
 		config.GetConfig().Connect()
 		database.CheckTables()
 
-		var wg sync.WaitGroup
+		if flgImportFollow {
+			idle, err := time.ParseDuration(flgImportIdle)
+			FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing duration format for idle '%s'", flgImportIdle), err)
 
-		for k, a := range args {
-			wg.Add(1)
-			lst, _ := filepath.Glob(a)
-			go parseFileList(&wg, k, lst)
+			runFollow(args, idle)
+			return
 		}
 
-		DebugLevel.Logf("Waiting all threads finish...")
-		wg.Wait()
-		DebugLevel.Logf("All threads has finished")
+		runImport(listImportFiles(args), flgImportWorkers)
 	},
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
 			return errors.New("arguments missing : requires at least one file path pattern")
 		}
 
+		var stdin = 0
+
 		for _, a := range args {
-			if _, err := filepath.Glob(a); err != nil {
+			if a == "-" {
+				stdin++
+			} else if _, err := filepath.Glob(a); err != nil {
 				return fmt.Errorf("Argument '%s' error: %v", a, err)
 			}
 		}
 
+		if _, err := parseDisposition(flgImportOnSuccess); err != nil {
+			return err
+		} else if _, err = parseErrorDisposition(flgImportOnError); err != nil {
+			return err
+		} else if flgImportFollow && (flgImportOnSuccess != "" || flgImportOnError != "") {
+			return errors.New("the files cannot be moved, deleted or compressed while followed")
+		}
+
+		if err := parseDryRunFormat(flgImportFormat); err != nil {
+			return err
+		} else if flgImportSyslog && flgImportFollow {
+			return errors.New("the syslog files cannot be followed")
+		} else if flgImportLookup && !flgImportSyslog {
+			return errors.New("the dmarc records are only looked up in syslog mode")
+		} else if flgImportDryRun && flgImportFollow {
+			return errors.New("the files cannot be followed in dry run mode")
+		} else if flgImportDryRun && (flgImportOnSuccess != "" || flgImportOnError != "") {
+			return errors.New("the files cannot be moved, deleted or compressed in dry run mode")
+		}
+
+		if flgImportBatch < 1 {
+			flgImportBatch = 1
+		}
+
+		if stdin > 1 {
+			return errors.New("the standard input '-' can only be given once")
+		} else if stdin > 0 && flgImportFollow {
+			return errors.New("the standard input '-' cannot be followed")
+		}
+
 		return nil
 	},
 }
@@ -84,6 +153,10 @@ the record else update it.
 type jobItem struct {
 	database.Messages
 	signature []*database.Signatures
+
+	// path and source are the history file and job read, if any
+	path   string
+	source *history.Job
 }
 
 func NewJobItem(jobId string) *jobItem {
@@ -105,6 +178,20 @@ func NewJobItem(jobId string) *jobItem {
 func init() {
 	rootCmd.AddCommand(importCmd)
 
+	importCmd.Flags().BoolVar(&flgImportReset, "reset", false, "Ignore the import checkpoints and read again the whole files")
+	importCmd.Flags().BoolVarP(&flgImportFollow, "follow", "f", false, "Follow the files and the patterns for new files, like tail -F, until interrupted")
+	importCmd.Flags().StringVar(&flgImportIdle, "idle", "30s", "In follow mode, save the last job of a file once idle for this duration")
+	importCmd.Flags().StringVar(&flgImportOnSuccess, "on-success", "", "Action on each file once all its jobs are saved : delete, compress (gzip) or move:<dir>")
+	importCmd.Flags().StringVar(&flgImportOnError, "on-error", "", "Action on each file that cannot be read or with jobs not saved : move:<dir>")
+	importCmd.Flags().BoolVar(&flgImportDryRun, "dry-run", false, "Print the jobs read from the files instead of saving them, without any database connection")
+	importCmd.Flags().StringVar(&flgImportFormat, "format", "yaml", "In dry run mode, output format of the jobs : json (one job per line) or yaml")
+	importCmd.Flags().BoolVar(&flgImportSyslog, "syslog", false, "Read the OpenDMARC and Authentication-Results syslog lines instead of history files, the keys not recovered are marked as missing")
+	importCmd.Flags().BoolVar(&flgImportLookup, "lookup", false, "In syslog mode, read the rua and the policy not logged from the current DMARC record of the domain (DNS)")
+	importCmd.Flags().BoolVar(&flgImportStrict, "strict", false, "Reject the jobs with a bad line (missing or bad value, unknown key), the file is then disposed as on error")
+	importCmd.Flags().StringVar(&flgImportErrorsOut, "errors-out", "", "Append a JSON Lines record of each bad line to this file, '-' for the standard output")
+	importCmd.Flags().IntVar(&flgImportBatch, "batch", 100, "Number of jobs written into one database transaction, 1 to write each job alone")
+	importCmd.Flags().IntVar(&flgImportWorkers, "workers", runtime.NumCPU(), "Number of files read at once, and of database transactions written at once")
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -116,255 +203,403 @@ func init() {
 	// configCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
-func parseFileList(wg *sync.WaitGroup, nbr int, fileList []string) {
-	DebugLevel.Logf("Starting thread #%d for filelist", nbr)
+// parseFile read the jobs of the file and send them by chunks to the saving stage
+func parseFile(file *importFile, out chan<- *importChunk) {
+	var (
+		path = file.path
+		src  io.Reader
+		off  int64
+		typ  string
+		e    error
+	)
 
-	var swg sync.WaitGroup
+	defer func() {
+		file.err = e
+	}()
 
-	for k, f := range fileList {
-		swg.Add(1)
-		go parseFile(&swg, nbr, k, f)
-	}
+	InfoLevel.Logf("Parsing file: %s ...", path)
 
-	swg.Wait()
-	wg.Done()
-}
+	// the file is closed once all its jobs are saved, no checkpoint for the standard input
+	if file.f, src, typ, e = openHistory(path); ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("opening file '%s'", path), e) {
+		return
+	}
 
-func parseFile(wg *sync.WaitGroup, nbr, sub int, filepath string) {
-	DebugLevel.Logf("Starting parsing thread #%d-#%d for file: %s", nbr, sub, filepath)
-	InfoLevel.Logf("Parsing file: %s ...", filepath)
+	// the jobs of a syslog file are mixed, so it has no checkpoint
+	if file.f != nil && !flgImportSyslog {
+		file.pck = typ != tools.CompressionNone
+		file.cp, off = loadCheckpoint(file.f, path, file.pck)
 
-	_, e := os.Stat(filepath)
-	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking file '%s'", filepath), e) {
-		return
+		if !file.pck {
+			if _, e = file.f.Seek(off, io.SeekStart); ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("seeking file '%s' to offset %d", path, off), e) {
+				return
+			}
+		}
 	}
 
-	f, e := os.Open(filepath)
-	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("opening file '%s'", filepath), e) {
+	unz, e := tools.Decompress(src, typ)
+	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("opening %s content of file '%s'", typ, path), e) {
 		return
 	}
 
-	defer f.Close()
+	defer unz.Close()
 
-	s := bufio.NewScanner(f)
-	if ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", filepath), s.Err()) {
-		return
+	// a compressed file cannot be seeked, so its content before the checkpoint is skipped
+	if file.pck && off > 0 {
+		if _, e = io.CopyN(ioutil.Discard, unz, off); ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("skipping file '%s' to offset %d", path, off), e) {
+			return
+		}
 	}
 
-	var j = NewJobItem("")
-	InfoLevel.Logf("Parsing file '%s'...", filepath)
+	var (
+		rdr = newJobReader(unz, off)
+		lst = make([]*history.Job, 0, flgImportBatch)
+	)
+
+	file.job = off
+	InfoLevel.Logf("Parsing file '%s' from offset %d...", path, off)
+
+	for {
+		h, err := rdr.Next()
 
-	for s.Scan() {
-		if ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", filepath), s.Err()) {
+		if err == io.EOF {
+			break
+		} else if p, isParse := err.(*history.ParseError); isParse {
+			reportLineError(path, p)
 			continue
+		} else if ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", path), err) {
+			e = err
+			break
 		}
 
-		p := strings.SplitN(s.Text(), " ", 2)
+		// all jobs before this one are into the chunk
+		if len(lst) >= flgImportBatch {
+			file.send(out, lst, h.Offset)
+			lst = make([]*history.Job, 0, flgImportBatch)
+		}
 
-		if len(p) != 2 {
-			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", filepath), errors.New("line not well formatted !"))
-			continue
+		file.job = h.Offset
+
+		if checkJob(path, h) {
+			lst = append(lst, h)
+		} else {
+			file.bad++
 		}
+	}
 
-		var (
-			val int64
-			err error
-		)
+	// the last job could be still written, so it will be read again on next import
+	file.send(out, lst, file.job)
+}
 
-		switch strings.ToLower(p[0]) {
-		case "job":
-			if j.JobId != "" {
-				InfoLevel.Logf("Saving Job Id '%s' from file %s...", j.JobId, filepath)
-				j.SaveJob()
-			}
+// newJobReader return the reader of the history lines, or of the syslog lines in syslog mode
+func newJobReader(r io.Reader, offset int64) history.JobReader {
+	if flgImportSyslog && flgImportLookup {
+		return newSyslogLookup(history.NewSyslogReader(r))
+	} else if flgImportSyslog {
+		return history.NewSyslogReader(r)
+	}
 
-			InfoLevel.Logf("New Job '%s' found in file '%s'...", p[1], filepath)
+	return history.NewReaderAt(r, offset)
+}
 
-			j = NewJobItem(p[1])
-			err = j.Load()
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading data for job '%s'", j.JobId), err)
+// openHistory open the file, or the standard input for "-", and detect its compression
+func openHistory(path string) (*os.File, io.Reader, string, error) {
+	if path == "-" {
+		src, typ, err := tools.PeekCompression(os.Stdin)
+		return nil, src, typ, err
+	}
 
-		case "action":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'action' for job '%s'", j.JobId), err)
-				j.Disp = 0
-			} else {
-				j.Disp = int(val)
-			}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
 
-		case "adkim":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'adkim' for job '%s'", j.JobId), err)
-				j.Request.ADKIM = 0
-			} else {
-				j.Request.ADKIM = int(val)
-			}
+	typ, err := tools.FileCompression(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, "", err
+	}
 
-		case "align_dkim":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'align_dkim' for job '%s'", j.JobId), err)
-				j.AlignDKIM = 0
-			} else {
-				j.AlignDKIM = int(val)
-			}
+	return f, f, typ, nil
+}
 
-		case "align_spf":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'align_spf' for job '%s'", j.JobId), err)
-				j.AlignSPF = 0
-			} else {
-				j.AlignSPF = int(val)
-			}
+// NewHistoryJobItem return the job to save from a job read into an history file
+func NewHistoryJobItem(h *history.Job, filepath string) *jobItem {
+	var (
+		j   = NewJobItem(h.JobId)
+		err error
+	)
+
+	// a job already saved is found by its job id when its batch is written
+	j.path = filepath
+	j.source = h
+	j.Missing = strings.Join(h.Missing, ",")
+
+	if len(h.Missing) > 0 {
+		DebugLevel.Logf("Job '%s' rebuilt from syslog, keys not recovered : %s", j.JobId, j.Missing)
+		warnSyslogRua(h)
+	}
 
-		case "aspf":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'aspf' for job '%s'", j.JobId), err)
-				j.Request.ASPF = 0
-			} else {
-				j.Request.ASPF = int(val)
-			}
+	if h.Has(history.KeyReporter) {
+		err = j.SetReporter(h.Reporter)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading reporter '%s' for job '%s'", h.Reporter, j.JobId), err)
+	}
 
-		case "dkim":
-			sig := database.NewSignatures(nil)
-			d := strings.SplitN(p[1], " ", 2)
-			sig.Domain = database.NewDomain(d[0])
-			err = sig.Domain.Load()
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading value 'dkim domain' for job '%s'", j.JobId), err)
-
-			if val, err = strconv.ParseInt(d[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'dkim result' for job '%s'", j.JobId), err)
-				sig.Pass = 5
-			} else {
-				sig.Pass = int(val)
-			}
+	if h.Has(history.KeyReceived) {
+		j.Date = h.Received
+		err = j.Request.SetDateTime(h.Received)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("setting Request Date '%s' for job '%s'", h.Received, j.JobId), err)
+	}
 
-			if sig.Pass == 4 || sig.Pass == 5 {
-				sig.Error = true
-			} else {
-				sig.Error = false
-			}
+	if h.Has(history.KeyIpAddr) {
+		err = j.SetIpAddr(h.IpAddr)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading ipaddr '%s' for job '%s'", h.IpAddr, j.JobId), err)
+	}
 
-			j.signature = append(j.signature, sig)
-			j.SigCount++
-			DebugLevel.Logf("Find new signature for job id '%s', total sign : %d(%d)", j.JobId, len(j.signature), j.SigCount)
+	if h.Has(history.KeyFrom) {
+		err = j.SetFromDomain(h.From)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain from '%s' for job '%s'", h.From, j.JobId), err)
+	}
 
-		case "from":
-			err = j.SetFromDomain(p[1])
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain from '%s' for job '%s'", p[1], j.JobId), err)
+	if h.Has(history.KeyMFrom) {
+		err = j.SetEnvDomain(h.MFrom)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain env '%s' for job '%s'", h.MFrom, j.JobId), err)
+	}
 
-		case "ipaddr":
-			err = j.SetIpAddr(p[1])
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading ipaddr '%s' for job '%s'", p[1], j.JobId), err)
+	if h.Has(history.KeyEnvelopeTo) {
+		err = j.SetToDomain(h.EnvelopeTo)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain envelope to '%s' for job '%s'", h.EnvelopeTo, j.JobId), err)
+	}
 
-		case "mfrom":
-			err = j.SetEnvDomain(p[1])
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain env '%s' for job '%s'", p[1], j.JobId), err)
+	if h.Has(history.KeyPDomain) {
+		err = j.SetPolicyDomain(h.PDomain)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain policy '%s' for job '%s'", h.PDomain, j.JobId), err)
+	}
 
-		case "p":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'p' for job '%s'", j.JobId), err)
-				j.Request.Policy = 0
-			} else {
-				j.Request.Policy = int(val)
-			}
+	for _, r := range h.Rua {
+		if !j.Request.IsLocked() {
+			j.Request.Repuri = tools.CleanJoin(tools.UnicSliceString(tools.CleanMergeSlice(strings.Split(j.Request.Repuri, ","), r)), ",")
+		}
+	}
 
-		case "pct":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'pct' for job '%s'", j.JobId), err)
-				j.Request.Pct = 0
-			} else {
-				j.Request.Pct = int(val)
-			}
+	if h.Has(history.KeyP) {
+		j.Request.Policy = h.P
+	}
 
-		case "pdomain":
-			err = j.SetPolicyDomain(p[1])
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain policy '%s' for job '%s'", p[1], j.JobId), err)
+	if h.Has(history.KeySP) {
+		j.Request.Spolicy = h.SP
+	}
 
-		case "policy":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'policy' for job '%s'", j.JobId), err)
-				j.Policy = 0
-			} else {
-				j.Policy = int(val)
-			}
+	if h.Has(history.KeyNP) {
+		j.Request.Npolicy = h.NP
+	}
 
-		case "received":
-			err = j.SetDate(p[1])
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("setting Date '%s' for job '%s'", p[1], j.JobId), err)
+	if h.Has(history.KeyPct) {
+		j.Request.Pct = h.Pct
+	}
 
-			err = j.Request.SetDate(p[1])
-			WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("setting Request Date '%s' for job '%s'", p[1], j.JobId), err)
+	if h.Has(history.KeyADKIM) {
+		j.Request.ADKIM = h.ADKIM
+	}
 
-		case "reporter":
-			err = j.SetReporter(p[1])
+	if h.Has(history.KeyASPF) {
+		j.Request.ASPF = h.ASPF
+	}
 
-		case "rua":
-			if !j.Request.IsLocked() {
-				j.Request.Repuri = tools.CleanJoin(tools.UnicSliceString(tools.CleanMergeSlice(strings.Split(j.Request.Repuri, ","), p[1])), ",")
-			}
+	if h.Has(history.KeyFo) {
+		j.Request.Fo = h.Fo
+	}
 
-		case "sp":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'policy' for job '%s'", j.JobId), err)
-				j.Request.Spolicy = 0
-			} else {
-				j.Request.Spolicy = int(val)
-			}
+	if h.Has(history.KeyT) {
+		j.Request.Testing = h.T
+	}
 
-		case "spf":
-			if val, err = strconv.ParseInt(p[1], 10, 64); err != nil {
-				WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("converting value 'policy' for job '%s'", j.JobId), err)
-				j.SPF = 0
-			} else {
-				j.SPF = int(val)
-			}
+	for _, d := range h.DKIM {
+		sig := database.NewSignatures(nil)
+		sig.Domain = database.NewDomain(d.Domain)
+		err = sig.Domain.Resolve()
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading value 'dkim domain' for job '%s'", j.JobId), err)
 
-		default:
-			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading file '%s'", filepath), fmt.Errorf("key '%s' not understand", p[0]))
-		}
+		sig.Selector = d.Selector
+		sig.Pass = d.Result
+		sig.Error = d.Result == history.DKIMTempError || d.Result == history.DKIMPermError
+
+		j.signature = append(j.signature, sig)
+		j.SigCount++
+		DebugLevel.Logf("Find new signature for job id '%s', total sign : %d(%d)", j.JobId, len(j.signature), j.SigCount)
+	}
+
+	if h.Has(history.KeySPF) {
+		j.SPF = h.SPF
+	} else if h.HasError(history.KeySPF) {
+		// a bad value must not be saved as 0, which is pass
+		j.SPF = database.CodeUnknown
+	}
+
+	if h.SPFDomain != "" {
+		err = j.SetSPFDomain(h.SPFDomain)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("loading domain spf '%s' for job '%s'", h.SPFDomain, j.JobId), err)
+	}
+
+	if h.Has(history.KeySPFScope) {
+		err = j.SetSPFScope(h.SPFScope)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("setting spf scope '%s' for job '%s'", h.SPFScope, j.JobId), err)
+	}
+
+	if h.Has(history.KeyAlignDKIM) {
+		j.AlignDKIM = h.AlignDKIM
+	}
+
+	if h.Has(history.KeyAlignSPF) {
+		j.AlignSPF = h.AlignSPF
+	}
+
+	if h.Has(history.KeyAction) {
+		j.Disp = h.Action
+	} else if h.HasError(history.KeyAction) {
+		// a bad value must not be saved as 0, which is reject
+		j.Disp = database.CodeUnknown
+	}
+
+	if h.Has(history.KeyPolicy) {
+		j.Policy = h.Policy
+	}
+
+	if h.Has(history.KeyReason) {
+		err = j.SetReason(h.Reason)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("setting policy override reason '%s' for job '%s'", h.Reason, j.JobId), err)
+	}
+
+	if h.Has(history.KeyARC) {
+		j.ARC = h.ARC
+	}
+
+	if len(h.ARCSeals) > 0 {
+		err = j.SetARCPolicy(h.ARCPolicy, h.ARCSeals)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("setting arc policy for job '%s'", j.JobId), err)
+	}
+
+	return j
+}
+
+// loadCheckpoint return the checkpoint of the file and the offset to start reading,
+// a file truncated or rewritten since the checkpoint is read again from the start.
+// The offset of a packed (compressed) file is an offset into its uncompressed content.
+func loadCheckpoint(f *os.File, path string, packed bool) (*database.Checkpoints, int64) {
+	inf, err := f.Stat()
+	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking file '%s'", path), err) {
+		return nil, 0
+	}
+
+	cp, err := database.GetCheckpoints(path, tools.FileInode(inf))
+	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("loading checkpoint of file '%s'", path), err) {
+		return nil, 0
+	}
+
+	if cp.Offset < 1 || flgImportReset {
+		return cp, 0
+	}
+
+	if !packed && inf.Size() < cp.Offset {
+		WarnLevel.Logf("File '%s' was truncated (size %d, checkpoint %d), importing it from start", path, inf.Size(), cp.Offset)
+		return cp, 0
+	} else if packed && inf.Size() != cp.Size {
+		WarnLevel.Logf("File '%s' was rewritten since last import (size %d, checkpoint size %d), importing it from start", path, inf.Size(), cp.Size)
+		return cp, 0
+	}
+
+	if h, err := fileHead(f, headSize(inf, cp.Offset, packed)); err != nil || h != cp.Head {
+		WarnLevel.Logf("File '%s' was rewritten since last import, importing it from start", path)
+		return cp, 0
+	}
+
+	InfoLevel.Logf("Resuming import of file '%s' at offset %d", path, cp.Offset)
+
+	return cp, cp.Offset
+}
+
+func saveCheckpoint(f *os.File, cp *database.Checkpoints, off int64, packed bool) {
+	if cp == nil {
+		return
 	}
 
-	if j.JobId != "" {
-		InfoLevel.Logf("Saving Job Id '%s' from file %s...", j.JobId, filepath)
-		j.SaveJob()
+	inf, err := f.Stat()
+	if ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking file '%s'", cp.Path), err) {
+		return
+	}
+
+	if cp.Head, err = fileHead(f, headSize(inf, off, packed)); ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("reading start of file '%s'", cp.Path), err) {
+		return
+	}
+
+	cp.Offset = off
+	cp.Size = inf.Size()
+
+	ErrorLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("saving checkpoint of file '%s' at offset %d", cp.Path, off), cp.Save())
+}
+
+// headSize return the size of the file start hashed into a checkpoint, the whole packed file
+// is used as the offset is not a position into the file
+func headSize(inf os.FileInfo, off int64, packed bool) int64 {
+	if packed {
+		return inf.Size()
 	}
 
-	wg.Done()
+	return off
+}
+
+// fileHead return the hash of the file start, up to the offset
+func fileHead(f *os.File, off int64) (string, error) {
+	if off > checkpoint_head {
+		off = checkpoint_head
+	}
+
+	var buf = make([]byte, off)
+
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf)
+
+	return hex.EncodeToString(sum[:]), nil
 }
 
 func (job jobItem) String() string {
-	str, err := yaml.Marshal(job)
+	str, err := yaml.Marshal(job.Dump())
 	ErrorLevel.LogErrorCtx(NilLevel, "yaml encoding job", err)
 
 	return fmt.Sprintf("---\n%s\n", string(str))
 
 }
 
-func (job *jobItem) SaveJob() {
+func (job *jobItem) SaveJob(bat *database.Batch) bool {
 	if job == nil {
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving job '%s'", job), errors.New("invalid job reference - segment fault"))
 	}
 
-	if err := job.Save(); err != nil {
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving job '%s'", job), err)
-		return
-	}
-
-	var ids = make([]int, 0)
-	for k, _ := range job.signature {
-		if job.signature[k] == nil {
-			continue
+	var sig = make([]*database.Signatures, 0)
+	for k := range job.signature {
+		if job.signature[k] != nil {
+			sig = append(sig, job.signature[k])
 		}
+	}
 
-		job.signature[k].Message = &job.Messages
+	// the batch is written once full
+	if err := bat.Add(&job.Messages, sig); err != nil {
+		ErrorLevel.LogErrorCtx(NilLevel, "saving import batch", err)
+		return false
+	}
 
-		if err := job.signature[k].Save(); err != nil {
-			FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving sign's job '%s'", job), err)
-			return
-		}
+	DebugLevel.Logf("Job Id '%s' added to import batch (%d pending jobs)", job.JobId, bat.Len())
+	return true
+}
 
-		ids = append(ids, job.signature[k].Id)
+// flushJobs write the pending jobs of the batch, it return false if the batch was rolled back
+func flushJobs(bat *database.Batch, path string) bool {
+	if bat.Len() < 1 {
+		return true
 	}
 
-	InfoLevel.Logf("Job Id '%s' saved (Msg %d, Req %d, Sig %v", job.JobId, job.Id, job.Request.Id, ids)
+	InfoLevel.Logf("Saving %d jobs from file %s...", bat.Len(), path)
+	return !ErrorLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("saving import batch of file '%s'", path), bat.Flush())
 }
@@ -0,0 +1,456 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/nabbar/opendmarc-reports/config"
+	"github.com/nabbar/opendmarc-reports/config/certificates"
+	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/history"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// max duration of the tls handshake of a client
+const ingest_handshake = 10 * time.Second
+
+var (
+	flgIngestListen   string
+	flgIngestSocket   string
+	flgIngestCert     string
+	flgIngestKey      string
+	flgIngestClientCA string
+	flgIngestIdle     string
+	flgIngestTimeout  string
+	flgIngestWorkers  int
+)
+
+var ingestCmd = &cobra.Command{
+	Use:     "serve-ingest",
+	Example: "serve-ingest --listen :6514 --socket /var/run/opendmarc-ingest.sock",
+	Short:   "Receive history from the MTAs over the network",
+	Long: `Listen on TLS with client certificate authentication
+and on an unix socket, read the history streamed by each client
+(OpenDMARC history lines or JSON jobs) and import it
+into mysql database, until interrupted.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		DebugLevel.LogData("Viper Settings : ", viper.AllSettings())
+
+		err := openErrorsOut(flgImportErrorsOut)
+		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("opening errors output file '%s'", flgImportErrorsOut), err)
+
+		defer closeErrorsOut()
+
+		idle, err := time.ParseDuration(flgIngestIdle)
+		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing duration format for idle '%s'", flgIngestIdle), err)
+
+		tmo, err := time.ParseDuration(flgIngestTimeout)
+		if err == nil && tmo <= 0 {
+			err = errors.New("duration must be positive")
+		}
+		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing duration format for timeout '%s'", flgIngestTimeout), err)
+
+		lst, err := ingestListeners()
+		FatalLevel.LogErrorCtx(NilLevel, "opening ingest listeners", err)
+
+		config.GetConfig().Connect()
+		database.CheckTables()
+
+		runIngest(lst, flgIngestWorkers, idle, tmo)
+	},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.New("no argument expected, the history is received from the network")
+		} else if flgIngestListen == "" && flgIngestSocket == "" {
+			return errors.New("flag missing : requires a tls listen address or an unix socket path")
+		}
+
+		if flgImportBatch < 1 {
+			flgImportBatch = 1
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ingestCmd)
+
+	ingestCmd.Flags().StringVar(&flgIngestListen, "listen", "", "TLS listen address (ex: :6514), the clients must send a certificate signed by the client CA")
+	ingestCmd.Flags().StringVar(&flgIngestSocket, "socket", "", "Unix socket path, writable by the owner and the group of the process")
+	ingestCmd.Flags().StringVar(&flgIngestCert, "cert", "", "TLS server certificate file, added to the included certificate")
+	ingestCmd.Flags().StringVar(&flgIngestKey, "key", "", "TLS server private key file of the certificate")
+	ingestCmd.Flags().StringVar(&flgIngestClientCA, "client-ca", "", "CA file of the client certificates, added to the included client CA")
+	ingestCmd.Flags().StringVar(&flgIngestIdle, "idle", "30s", "Save the pending jobs of a client at least at this interval")
+	ingestCmd.Flags().StringVar(&flgIngestTimeout, "timeout", "5m", "Close a client that sent nothing during this duration")
+	ingestCmd.Flags().IntVar(&flgImportBatch, "batch", 100, "Number of jobs written into one database transaction, 1 to write each job alone")
+	ingestCmd.Flags().IntVar(&flgIngestWorkers, "workers", runtime.NumCPU(), "Number of database transactions written at once")
+	ingestCmd.Flags().BoolVar(&flgImportStrict, "strict", false, "Reject the jobs with a bad line (missing or bad value, unknown key)")
+	ingestCmd.Flags().StringVar(&flgImportErrorsOut, "errors-out", "", "Append a JSON Lines record of each bad line to this file, '-' for the standard output")
+}
+
+// ingestListeners open the tls and the unix socket listeners
+func ingestListeners() ([]net.Listener, error) {
+	var res = make([]net.Listener, 0)
+
+	if flgIngestListen != "" {
+		cnf, err := certificates.GetServerTLSConfig(flgIngestKey, flgIngestCert, flgIngestClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		lis, err := tls.Listen("tcp", flgIngestListen, cnf)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, lis)
+	}
+
+	if flgIngestSocket != "" {
+		// a socket left by a previous run is removed
+		if inf, err := os.Lstat(flgIngestSocket); err == nil && inf.Mode()&os.ModeSocket != 0 {
+			os.Remove(flgIngestSocket)
+		}
+
+		lis, err := net.Listen("unix", flgIngestSocket)
+		if err != nil {
+			closeListeners(res)
+			return nil, err
+		} else if err = os.Chmod(flgIngestSocket, 0660); err != nil {
+			closeListeners(append(res, lis))
+			return nil, err
+		}
+
+		res = append(res, lis)
+	}
+
+	return res, nil
+}
+
+func closeListeners(lst []net.Listener) {
+	for _, l := range lst {
+		ErrorLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("closing listener '%s'", l.Addr().String()), l.Close())
+	}
+}
+
+// runIngest accept the clients until an interrupt signal, their jobs are saved by the saving stage of the import pipeline
+func runIngest(lst []net.Listener, workers int, idle, timeout time.Duration) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		prg  = &importProgress{}
+		out  = make(chan *importChunk, workers)
+		stop = make(chan struct{})
+		sig  = make(chan os.Signal, 1)
+		cwg  sync.WaitGroup
+		lwg  sync.WaitGroup
+		wwg  sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wwg.Add(1)
+		go saveChunks(&wwg, i, out, prg)
+	}
+
+	for _, l := range lst {
+		InfoLevel.Logf("Listening for history on %s '%s'...", l.Addr().Network(), l.Addr().String())
+
+		lwg.Add(1)
+		go func(lis net.Listener) {
+			defer lwg.Done()
+
+			for {
+				con, err := lis.Accept()
+
+				select {
+				case <-stop:
+					if err == nil {
+						con.Close()
+					}
+					return
+				default:
+				}
+
+				if ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("accepting client on '%s'", lis.Addr().String()), err) {
+					time.Sleep(follow_poll)
+					continue
+				}
+
+				cwg.Add(1)
+				go ingestConn(&cwg, con, out, prg, idle, timeout, stop)
+			}
+		}(l)
+	}
+
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	s := <-sig
+	InfoLevel.Logf("Signal '%s' received, stopping ingest...", s.String())
+
+	close(stop)
+	closeListeners(lst)
+	lwg.Wait()
+
+	DebugLevel.Logf("Waiting all clients are closed...")
+	cwg.Wait()
+	close(out)
+	wwg.Wait()
+
+	InfoLevel.Logf("Ingest finished : %d streams imported, %d streams failed, %d jobs saved", prg.files-prg.failed, prg.failed, prg.jobs)
+}
+
+// ingestConn read the jobs of a client and send them by chunks to the saving stage, once full or idle.
+// The client get a status line once all its jobs are saved, it should so close its writing side at end.
+func ingestConn(wg *sync.WaitGroup, con net.Conn, out chan<- *importChunk, prg *importProgress, idle, timeout time.Duration, stop <-chan struct{}) {
+	defer wg.Done()
+	defer con.Close()
+
+	var (
+		nxt  = make(chan *history.Job)
+		tck  = time.NewTicker(idle)
+		lst  = make([]*history.Job, 0, flgImportBatch)
+		file *importFile
+		e    error
+	)
+
+	defer tck.Stop()
+
+	name, err := ingestName(con)
+	if ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("accepting client '%s'", con.RemoteAddr().String()), err) {
+		return
+	}
+
+	file = newImportFile(name)
+	atomic.AddInt64(&prg.total, 1)
+	InfoLevel.Logf("Receiving history from '%s'...", name)
+
+	go func() {
+		e = readIngest(file, newIngestStream(con, idle, timeout, stop), nxt)
+		close(nxt)
+	}()
+
+	for run := true; run; {
+		select {
+		case h, ok := <-nxt:
+			if !ok {
+				run = false
+				break
+			}
+
+			// all jobs before this one are into the chunk
+			if len(lst) >= flgImportBatch {
+				file.send(out, lst, 0)
+				lst = make([]*history.Job, 0, flgImportBatch)
+			}
+
+			lst = append(lst, h)
+		case <-tck.C:
+			file.send(out, lst, 0)
+			lst = make([]*history.Job, 0, flgImportBatch)
+		case <-stop:
+			// the job being received is lost, the client will not get its status and so should send it again
+			con.SetReadDeadline(time.Now())
+			stop = nil
+		}
+	}
+
+	file.send(out, lst, 0)
+	file.err = e
+	ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("receiving history from '%s'", name), e)
+
+	file.wg.Wait()
+
+	var sts = fmt.Sprintf("ok %d jobs saved\n", file.nbj)
+
+	if !file.finish(prg) {
+		sts = fmt.Sprintf("error %d jobs saved, %d jobs rejected, some jobs not saved\n", file.nbj, file.bad)
+	}
+
+	_, err = io.WriteString(con, sts)
+	DebugLevel.LogErrorCtx(NilLevel, fmt.Sprintf("sending status to '%s'", name), err)
+}
+
+// ingestName return the name of the client stream used into the logs, with the common name of its certificate
+func ingestName(con net.Conn) (string, error) {
+	var adr = con.RemoteAddr().String()
+
+	if adr == "" || adr == "@" {
+		adr = con.LocalAddr().String()
+	}
+
+	c, ok := con.(*tls.Conn)
+	if !ok {
+		return fmt.Sprintf("%s://%s", con.LocalAddr().Network(), adr), nil
+	}
+
+	c.SetDeadline(time.Now().Add(ingest_handshake))
+	defer c.SetDeadline(time.Time{})
+
+	if err := c.Handshake(); err != nil {
+		return "", err
+	} else if crt := c.ConnectionState().PeerCertificates; len(crt) > 0 {
+		return fmt.Sprintf("tls://%s@%s", crt[0].Subject.CommonName, adr), nil
+	}
+
+	return "tls://" + adr, nil
+}
+
+// errIngestPause is returned by the stream of a client of history lines that sent nothing during the idle duration
+var errIngestPause = errors.New("client paused")
+
+// ingestStream is the connection of a client, with a read deadline set before each read : a client that sent
+// nothing during the timeout get an error, a client of history lines get a pause error at each idle duration before.
+type ingestStream struct {
+	con   net.Conn
+	stop  <-chan struct{}
+	idle  time.Duration
+	wait  time.Duration
+	last  time.Time
+	pause bool
+}
+
+func newIngestStream(con net.Conn, idle, timeout time.Duration, stop <-chan struct{}) *ingestStream {
+	if idle <= 0 || idle > timeout {
+		idle = timeout
+	}
+
+	return &ingestStream{
+		con:  con,
+		stop: stop,
+		idle: idle,
+		wait: timeout,
+		last: time.Now(),
+	}
+}
+
+func (s *ingestStream) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-s.stop:
+			return 0, errors.New("ingest stopped")
+		default:
+		}
+
+		s.con.SetReadDeadline(time.Now().Add(s.idle))
+		n, err := s.con.Read(p)
+
+		if n > 0 {
+			s.last = time.Now()
+		}
+
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return n, err
+		} else if n > 0 {
+			return n, nil
+		} else if time.Since(s.last) >= s.wait {
+			return 0, fmt.Errorf("nothing received during %s", s.wait)
+		} else if s.pause {
+			return 0, errIngestPause
+		}
+	}
+}
+
+// readIngest read the jobs of a client : a stream starting with '{' is read as JSON jobs, one object after
+// the other, else as history lines. The last job is complete once the stream is closed or paused.
+// A JSON job is checked as a job of history lines, its line is its number into the stream.
+func readIngest(file *importFile, src *ingestStream, nxt chan<- *history.Job) error {
+	var (
+		buf = bufio.NewReader(src)
+		nbj = 0
+	)
+
+	if b, err := buf.Peek(1); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	} else if b[0] == '{' {
+		dec := json.NewDecoder(buf)
+
+		for {
+			var raw json.RawMessage
+
+			if err = dec.Decode(&raw); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("decoding json job #%d : %v", nbj+1, err)
+			}
+
+			nbj++
+			h, e := history.ParseJSON(nbj, raw)
+
+			if e != nil {
+				reportLineError(file.path, &history.ParseError{Line: nbj, Err: fmt.Errorf("json job is not an object : %v", e)})
+				file.bad++
+			} else if h.JobId == "" {
+				reportLineError(file.path, &history.ParseError{Line: nbj, Key: history.KeyJob, Err: errors.New("json job without job id")})
+				file.bad++
+			} else if checkJob(file.path, h) {
+				nxt <- h
+			} else {
+				file.bad++
+			}
+		}
+	}
+
+	var rdr = history.NewReader(buf)
+
+	// a pause of the client complete its last job
+	src.pause = true
+
+	for {
+		h, err := rdr.Next()
+
+		if err == errIngestPause {
+			if h = rdr.Flush(); h == nil {
+				continue
+			}
+		} else if err == io.EOF {
+			return nil
+		} else if p, isParse := err.(*history.ParseError); isParse {
+			reportLineError(file.path, p)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if checkJob(file.path, h) {
+			nxt <- h
+		} else {
+			file.bad++
+		}
+	}
+}
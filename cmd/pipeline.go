@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/history"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// importFile is an history file into the import pipeline. Its chunks of jobs could be saved
+// in any order, so the checkpoint is only moved once all previous chunks are saved.
+type importFile struct {
+	path string
+	f    *os.File
+	cp   *database.Checkpoints
+	pck  bool
+
+	m  sync.Mutex
+	wg sync.WaitGroup
+	// nxt is the sequence of the next chunk sent, seq the sequence of the next chunk to commit
+	nxt int
+	seq int
+	end map[int]int64
+	// ok is false once a chunk is rolled back, err is the read error of the file
+	ok  bool
+	err error
+	nbj int
+	// bad is the number of jobs rejected by the strict mode
+	bad int
+	// job is the offset of the last job read
+	job int64
+}
+
+// importChunk is a list of jobs of a file saved into one transaction, end is the offset of the
+// next job of the file
+type importChunk struct {
+	file *importFile
+	seq  int
+	jobs []*history.Job
+	end  int64
+}
+
+// importProgress count the files and the jobs done by the pipeline
+type importProgress struct {
+	total  int64
+	files  int64
+	failed int64
+	jobs   int64
+}
+
+func newImportFile(path string) *importFile {
+	return &importFile{
+		path: path,
+		end:  make(map[int]int64),
+		ok:   true,
+	}
+}
+
+// listImportFiles return the files matching the patterns, each file only once
+func listImportFiles(args []string) []string {
+	var (
+		res = make([]string, 0)
+		fnd = make(map[string]bool)
+	)
+
+	for _, a := range args {
+		lst, _ := filepath.Glob(a)
+
+		// read the history from the standard input
+		if a == "-" {
+			lst = []string{a}
+		}
+
+		for _, f := range lst {
+			if f == "-" {
+				// keep the standard input name
+			} else if p, err := filepath.Abs(f); err == nil {
+				f = p
+			}
+
+			if !fnd[f] {
+				fnd[f] = true
+				res = append(res, f)
+			}
+		}
+	}
+
+	return res
+}
+
+// runImport import the files with a pipeline of two stages : the workers reading the files
+// and the workers saving the chunks of jobs into the database
+func runImport(files []string, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		prg = &importProgress{total: int64(len(files))}
+		que = make(chan string)
+		out = make(chan *importChunk, workers)
+		fin sync.WaitGroup
+		rwg sync.WaitGroup
+		wwg sync.WaitGroup
+	)
+
+	InfoLevel.Logf("Importing %d files with %d workers...", len(files), workers)
+
+	for i := 0; i < workers; i++ {
+		rwg.Add(1)
+		go func(nbr int) {
+			defer rwg.Done()
+
+			for p := range que {
+				DebugLevel.Logf("Reading thread #%d starting file: %s", nbr, p)
+				file := newImportFile(p)
+				parseFile(file, out)
+
+				// the file is closed and disposed once all its chunks are saved
+				fin.Add(1)
+				go func() {
+					defer fin.Done()
+					file.wg.Wait()
+					file.finish(prg)
+				}()
+			}
+		}(i)
+
+		wwg.Add(1)
+		go saveChunks(&wwg, i, out, prg)
+	}
+
+	for _, f := range files {
+		que <- f
+	}
+
+	close(que)
+	rwg.Wait()
+	close(out)
+	wwg.Wait()
+	fin.Wait()
+
+	InfoLevel.Logf("Import finished : %d files imported, %d files failed, %d jobs saved", prg.files-prg.failed, prg.failed, prg.jobs)
+}
+
+// saveChunks is a worker of the saving stage, until the chunks channel is closed
+func saveChunks(wg *sync.WaitGroup, nbr int, out <-chan *importChunk, prg *importProgress) {
+	defer wg.Done()
+
+	for c := range out {
+		DebugLevel.Logf("Saving thread #%d starting %d jobs of file: %s", nbr, len(c.jobs), c.file.path)
+		c.file.commit(c, writeChunk(c), prg)
+		c.file.wg.Done()
+	}
+}
+
+// send add a chunk of jobs of the file to the saving stage
+func (file *importFile) send(out chan<- *importChunk, jobs []*history.Job, end int64) {
+	if len(jobs) < 1 {
+		return
+	}
+
+	file.wg.Add(1)
+	out <- &importChunk{
+		file: file,
+		seq:  file.nxt,
+		jobs: jobs,
+		end:  end,
+	}
+
+	file.nxt++
+}
+
+// writeChunk save the jobs of the chunk into one transaction, it return false if the transaction is rolled back
+func writeChunk(c *importChunk) bool {
+	var (
+		ok  = true
+		bat = database.NewBatch(len(c.jobs))
+	)
+
+	for _, h := range c.jobs {
+		InfoLevel.Logf("Saving Job Id '%s' from file %s...", h.JobId, c.file.path)
+		ok = NewHistoryJobItem(h, c.file.path).SaveJob(bat) && ok
+	}
+
+	return flushJobs(bat, c.file.path) && ok
+}
+
+// commit record the result of a chunk, and move the checkpoint after all chunks saved in sequence
+func (file *importFile) commit(c *importChunk, ok bool, prg *importProgress) {
+	file.m.Lock()
+	defer file.m.Unlock()
+
+	if ok {
+		file.nbj += len(c.jobs)
+		atomic.AddInt64(&prg.jobs, int64(len(c.jobs)))
+	} else {
+		file.ok = false
+	}
+
+	file.end[c.seq] = c.end
+
+	for {
+		end, has := file.end[file.seq]
+		if !has {
+			break
+		}
+
+		delete(file.end, file.seq)
+		file.seq++
+
+		// all jobs before this offset are saved
+		if file.ok {
+			saveCheckpoint(file.f, file.cp, end, file.pck)
+		}
+	}
+
+	InfoLevel.Logf("Import progress : %d/%d files done, %d jobs saved", atomic.LoadInt64(&prg.files), atomic.LoadInt64(&prg.total), atomic.LoadInt64(&prg.jobs))
+}
+
+// finish save the last checkpoint once all chunks are saved, close and dispose the file.
+// It return true if all the jobs of the file are saved.
+func (file *importFile) finish(prg *importProgress) bool {
+	var done = false
+
+	// the last job could be still written, so it will be read again on next import
+	if file.ok {
+		saveCheckpoint(file.f, file.cp, file.job, file.pck)
+		done = file.err == nil && file.bad == 0
+	} else {
+		WarnLevel.Logf("Some jobs of file '%s' were not saved, they will be read again on next import", file.path)
+	}
+
+	if file.bad > 0 {
+		WarnLevel.Logf("%d jobs of file '%s' were rejected by strict mode", file.bad, file.path)
+	}
+
+	// the standard input and the network streams are not disposed
+	if file.f != nil {
+		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("closing file '%s'", file.path), file.f.Close())
+		disposeFile(file.path, file.cp, done, file.nbj)
+	}
+
+	if !done {
+		atomic.AddInt64(&prg.failed, 1)
+	}
+
+	InfoLevel.Logf("Import progress : %d/%d files done, %d jobs saved", atomic.AddInt64(&prg.files, 1), atomic.LoadInt64(&prg.total), atomic.LoadInt64(&prg.jobs))
+
+	return done
+}
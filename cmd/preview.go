@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/nabbar/opendmarc-reports/config"
+	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/report"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var (
+	flgPreviewRequest int
+	flgPreviewOutput  string
+	flgPreviewArchive bool
+)
+
+var previewCmd = &cobra.Command{
+	Use:     "preview",
+	Example: "preview --domain example.com [--output /tmp/reports] [--archive]",
+	Short:   "Generate a report without sending it",
+	Long: `Load OpenDMARC history data from mysql database,
+generate report for selected request, domains or all domains,
+and write it to stdout or into a folder, as the xml file
+or as the file sent to the first destination of the request.
+The requests are not locked and the messages are not updated.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		DebugLevel.LogData("Viper Settings : ", viper.AllSettings())
+		FatalLevel.LogErrorCtx(NilLevel, "checking report config", report.CheckConfig())
+
+		config.GetConfig().Connect()
+		database.CheckTables()
+
+		var lst = make([]int, 0)
+
+		if flgPreviewRequest != 0 {
+			lst = append(lst, flgPreviewRequest)
+		} else if len(config.GetConfig().GetDomainOnly()) > 0 {
+			for _, name := range config.GetConfig().GetDomainOnly() {
+				dom, err := database.FindDomain(name)
+				FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve domain '%s' to preview report", name), err)
+
+				req, err := database.GetRequestList(dom, false, config.GetConfig().IsDayMode(), config.GetConfig().GetInterval())
+				FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve request list for domain '%s' (Id : %d) to preview report", dom.Name, dom.Id), err)
+
+				lst = append(lst, req...)
+			}
+		} else {
+			dom, err := database.GetDomainList(false, config.GetConfig().IsDayMode(), config.GetConfig().GetInterval())
+			FatalLevel.LogErrorCtx(NilLevel, "retrieve domain list to preview report", err)
+
+			for _, id := range dom {
+				d, err := database.GetDomain(id)
+				FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve domain ID '%d' to preview report", id), err)
+
+				req, err := database.GetRequestList(d, false, config.GetConfig().IsDayMode(), config.GetConfig().GetInterval())
+				FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve request list for domain '%s' (Id : %d) to preview report", d.Name, d.Id), err)
+
+				lst = append(lst, req...)
+			}
+		}
+
+		if flgPreviewOutput == "" && flgPreviewArchive && len(lst) > 1 {
+			FatalLevel.LogErrorCtx(NilLevel, "checking preview output", errors.New("cannot write several archives to stdout, use --output folder"))
+		}
+
+		InfoLevel.Logf("Found %d requests to preview", len(lst))
+
+		for _, id := range lst {
+			RunPreviewRequest(id)
+		}
+	},
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(previewCmd)
+
+	previewCmd.Flags().IntVar(&flgPreviewRequest, "request", 0, "Preview only the report of this request id")
+	previewCmd.Flags().StringVarP(&flgPreviewOutput, "output", "o", "", "Folder to write the report files (default stdout)")
+	previewCmd.Flags().BoolVar(&flgPreviewArchive, "archive", false, "Write the compressed file sent instead of the xml file")
+}
+
+func RunPreviewRequest(id int) {
+	defer func() {
+		if r := recover(); r != nil {
+			InfoLevel.Logf("Recover Panic Value : %v", r)
+			return
+		}
+	}()
+
+	req, err := database.GetRequests(id)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve request ID '%d' to preview report", id), err)
+
+	cmp, err := report.ParseCompression(config.GetConfig().GetReportCompression())
+	PanicLevel.LogErrorCtx(NilLevel, "parsing report compression", err)
+
+	rep, err := req.PreviewReport(
+		config.GetConfig().GetOrg(),
+		config.GetConfig().GetEmail().String(),
+		config.GetConfig().GetContact(),
+		cmp,
+		false,
+		config.GetConfig().IsDayMode(),
+		config.GetConfig().GetInterval(),
+	)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("generating report for request '%s' (id : %d)", req.Repuri, req.Id), err)
+
+	defer func() {
+		err := rep.Close()
+		ErrorLevel.LogErrorCtxf(NilLevel, "removing temporary report file for request '%s' (ID: %d)", err, req.Repuri, req.Id)
+	}()
+
+	// preview the file of the first destination, or the default format if the request has no destination
+	dst := report.ParseDestination("", rep.GetCompression())
+
+	if l := rep.GetDestinations(); len(l) > 0 {
+		dst = l[0]
+	}
+
+	var (
+		out io.Writer = os.Stdout
+		fil           = rep.GetFileName()
+	)
+
+	if flgPreviewArchive {
+		fil = rep.GetArchiveName(dst)
+	}
+
+	if flgPreviewOutput != "" {
+		f, err := os.Create(filepath.Join(flgPreviewOutput, fil))
+		PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("creating preview file '%s'", fil), err)
+
+		defer func() {
+			err := f.Close()
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("closing preview file '%s'", fil), err)
+		}()
+
+		out = f
+	}
+
+	if !flgPreviewArchive {
+		err = rep.WriteXml(out, dst.Format, true)
+		PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("writing xml report '%s'", fil), err)
+	} else {
+		err = rep.Archive(dst)
+		PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("generating report file '%s'", fil), err)
+
+		src, err := rep.Open(dst)
+		PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("opening report file '%s'", fil), err)
+
+		defer src.Close()
+
+		_, err = io.Copy(out, src)
+		PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("writing report file '%s'", fil), err)
+	}
+
+	InfoLevel.Logf("Preview request '%s' (id : %d) : %d messages into %d records", req.Repuri, req.Id, rep.GetMessageCount(), rep.GetRecordCount())
+}
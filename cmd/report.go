@@ -3,11 +3,13 @@ package cmd
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/nabbar/opendmarc-reports/config"
 	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/report"
 	. "github.com/nabbar/opendmarc-reports/logger"
 )
 
@@ -27,6 +29,14 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// run summary of the report command
+var (
+	sumReport  int32
+	sumInvalid int32
+	sumFailed  int32
+	sumDropped int32
+)
+
 var reportCmd = &cobra.Command{
 	Use:     "report",
 	Example: "report",
@@ -37,6 +47,7 @@ and sent it by mail through SMTP server.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		DebugLevel.LogData("Viper Settings : ", viper.AllSettings())
+		FatalLevel.LogErrorCtx(NilLevel, "checking report config", report.CheckConfig())
 
 		config.GetConfig().Connect()
 		database.CheckTables()
@@ -54,6 +65,12 @@ and sent it by mail through SMTP server.
 		DebugLevel.Logf("Waiting all threads finish...")
 		wg.Wait()
 		DebugLevel.Logf("All threads has finished")
+
+		if sumInvalid > 0 || sumFailed > 0 || sumDropped > 0 {
+			WarnLevel.Logf("Reports generated : %d, invalid reports refused : %d, failed : %d, records dropped : %d", sumReport, sumInvalid, sumFailed, sumDropped)
+		} else {
+			InfoLevel.Logf("Reports generated : %d, invalid reports refused : %d, failed : %d, records dropped : %d", sumReport, sumInvalid, sumFailed, sumDropped)
+		}
 	},
 	Args: cobra.NoArgs,
 }
@@ -110,11 +127,29 @@ func GoRunRequest(wg *sync.WaitGroup, id int) {
 
 	req, err := database.GetRequests(id)
 	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve request ID '%d' to generate report", id), err)
-	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("generating report for request '%s' (id : %d)", req.Repuri, req.Id), req.SendReport(
+
+	cmp, err := report.ParseCompression(config.GetConfig().GetReportCompression())
+	PanicLevel.LogErrorCtx(NilLevel, "parsing report compression", err)
+
+	drp, err := req.SendReport(
 		config.GetConfig().GetOrg(),
 		config.GetConfig().GetEmail().String(),
+		config.GetConfig().GetContact(),
+		cmp,
 		config.GetConfig().IsUpdate(), false,
 		config.GetConfig().IsDayMode(),
 		config.GetConfig().GetInterval(),
-	))
+	)
+
+	atomic.AddInt32(&sumDropped, int32(drp))
+
+	if err == nil {
+		atomic.AddInt32(&sumReport, 1)
+	} else if report.IsInvalidReport(err) {
+		atomic.AddInt32(&sumInvalid, 1)
+	} else {
+		atomic.AddInt32(&sumFailed, 1)
+	}
+
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("generating report for request '%s' (id : %d)", req.Repuri, req.Id), err)
 }
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/nabbar/opendmarc-reports/config"
+	"github.com/nabbar/opendmarc-reports/database"
+	"github.com/nabbar/opendmarc-reports/report"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var (
+	flgResendFrom string
+	flgResendTo   string
+	flgResendDest string
+)
+
+var resendCmd = &cobra.Command{
+	Use:     "resend",
+	Example: "resend --domain example.com --from 2018-07-10 --to 2018-07-10 [--destination mailto:dmarc@example.net]",
+	Short:   "Generate again a past report and send it",
+	Long: `Load OpenDMARC history data already reported from mysql database,
+for the given domains and date range, generate again the report
+and sent it to the request destinations or the given destination.
+Only the report history is recorded, the messages are not updated.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		DebugLevel.LogData("Viper Settings : ", viper.AllSettings())
+		FatalLevel.LogErrorCtx(NilLevel, "checking report config", report.CheckConfig())
+
+		if len(config.GetConfig().GetDomainOnly()) < 1 {
+			FatalLevel.LogErrorCtx(NilLevel, "checking domain to resend report", errors.New("missing --domain flag"))
+		}
+
+		frm, err := parseResendDate(flgResendFrom, false)
+		FatalLevel.LogErrorCtx(NilLevel, "parsing --from date", err)
+
+		end, err := parseResendDate(flgResendTo, true)
+		FatalLevel.LogErrorCtx(NilLevel, "parsing --to date", err)
+
+		if !end.After(frm) {
+			FatalLevel.LogErrorCtx(NilLevel, "checking date range to resend report", fmt.Errorf("--to date '%s' is before --from date '%s'", flgResendTo, flgResendFrom))
+		}
+
+		config.GetConfig().Connect()
+		database.CheckTables()
+
+		win := database.NewRangeWindow(frm, end)
+
+		for _, name := range config.GetConfig().GetDomainOnly() {
+			RunResendDomain(name, win)
+		}
+	},
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(resendCmd)
+
+	resendCmd.Flags().StringVar(&flgResendFrom, "from", "", "First day (or date time) of the report, formatted as YYYY-MM-DD[ HH:MM:SS]")
+	resendCmd.Flags().StringVar(&flgResendTo, "to", "", "Last day (or excluded date time) of the report, formatted as YYYY-MM-DD[ HH:MM:SS]")
+	resendCmd.Flags().StringVar(&flgResendDest, "destination", "", "Send the report to this rua uri instead of the request destinations")
+
+	resendCmd.MarkFlagRequired("from")
+	resendCmd.MarkFlagRequired("to")
+}
+
+// parseResendDate parse a date as the database time zone, a day as end bound include the whole day
+func parseResendDate(str string, end bool) (time.Time, error) {
+	str = strings.TrimSpace(str)
+
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", str, time.UTC); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", str, time.UTC)
+
+	if err != nil {
+		return t, err
+	} else if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+func RunResendDomain(name string, win database.Window) {
+	defer func() {
+		if r := recover(); r != nil {
+			InfoLevel.Logf("Recover Panic Value : %v", r)
+			return
+		}
+	}()
+
+	dom, err := database.FindDomain(name)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve domain '%s' to resend report", name), err)
+
+	lst, err := database.GetWindowRequestList(dom, win)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve request list for domain '%s' (Id : %d) to resend report", dom.Name, dom.Id), err)
+
+	if len(lst) < 1 {
+		InfoLevel.Logf("No sent messages found for domain '%s' between %s and %s", dom.Name, win.From.String(), win.Until.String())
+	}
+
+	for _, id := range lst {
+		RunResendRequest(id, win)
+	}
+}
+
+func RunResendRequest(id int, win database.Window) {
+	defer func() {
+		if r := recover(); r != nil {
+			InfoLevel.Logf("Recover Panic Value : %v", r)
+			return
+		}
+	}()
+
+	req, err := database.GetRequests(id)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve request ID '%d' to resend report", id), err)
+
+	cmp, err := report.ParseCompression(config.GetConfig().GetReportCompression())
+	PanicLevel.LogErrorCtx(NilLevel, "parsing report compression", err)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("resending report for request '%s' (id : %d)", req.Repuri, req.Id), req.ResendReport(
+		config.GetConfig().GetOrg(),
+		config.GetConfig().GetEmail().String(),
+		config.GetConfig().GetContact(),
+		flgResendDest,
+		cmp,
+		win,
+	))
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/nabbar/opendmarc-reports/config"
+	"github.com/nabbar/opendmarc-reports/database"
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var (
+	flgRetryInterval string
+	flgRetryMaxAge   string
+)
+
+var retryCmd = &cobra.Command{
+	Use:     "retry",
+	Example: "retry",
+	Short:   "Send again the failed deliveries",
+	Long: `Load the queued deliveries with a next attempt due,
+send again the stored report file to its destination,
+and delay the next attempt on failure until the max age.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		DebugLevel.LogData("Viper Settings : ", viper.AllSettings())
+		FatalLevel.LogErrorCtx(NilLevel, "checking report config", report.CheckConfig())
+
+		config.GetConfig().Connect()
+		database.CheckTables()
+
+		lst, err := database.GetRetryList()
+		FatalLevel.LogErrorCtx(NilLevel, "retrieve retry queue", err)
+
+		InfoLevel.Logf("Found %d queued deliveries to send", len(lst))
+
+		for _, id := range lst {
+			RunRetry(id)
+		}
+	},
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(retryCmd)
+
+	retryCmd.Flags().StringVar(&flgRetryInterval, "retry-interval", config.DEFAULT_RETRY_INTERVAL, "Delay before the second attempt, doubled for each next attempt")
+	retryCmd.Flags().StringVar(&flgRetryMaxAge, "retry-maxage", config.DEFAULT_RETRY_MAXAGE, "Max age of a queued delivery before giving up")
+
+	viper.BindPFlag("retry.interval", retryCmd.Flags().Lookup("retry-interval"))
+	viper.BindPFlag("retry.maxage", retryCmd.Flags().Lookup("retry-maxage"))
+}
+
+func RunRetry(id int) {
+	defer func() {
+		if r := recover(); r != nil {
+			InfoLevel.Logf("Recover Panic Value : %v", r)
+			return
+		}
+	}()
+
+	obj, err := database.GetRetryQueue(id)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("retrieve queued delivery ID '%d'", id), err)
+	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("sending queued delivery '%s' of report '%s' (id : %d)", obj.Uri, obj.ReportId, obj.Id), obj.Retry(
+		config.GetConfig().GetOrg(),
+		config.GetConfig().GetEmail().String(),
+		config.GetConfig().GetContact(),
+		config.GetConfig().GetRetryInterval(),
+		config.GetConfig().GetRetryMaxAge(),
+	))
+}
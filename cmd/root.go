@@ -44,9 +44,12 @@ var (
 	flgDBDSN string
 	flgSMTP  string
 
-	flgReportEmail string
-	flgReportOrg   string
-	flgReportCopy  string
+	flgReportEmail  string
+	flgReportOrg    string
+	flgReportCopy   string
+	flgReportInfo   string
+	flgReportFormat string
+	flgReportComp   string
 
 	flgDATPath []string
 )
@@ -98,6 +101,9 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&flgReportEmail, "report-email", "", "Report email sender")
 	rootCmd.PersistentFlags().StringVar(&flgReportOrg, "report-org", "", "Report organisation sender")
 	rootCmd.PersistentFlags().StringVar(&flgReportCopy, "report-copy", "", "Report bcc email list (comma separated)")
+	rootCmd.PersistentFlags().StringVar(&flgReportInfo, "report-contact", "", "Report extra contact information (uri or text)")
+	rootCmd.PersistentFlags().StringVar(&flgReportFormat, "report-format", "rfc7489", "Report default format (rfc7489, dmarcbis)")
+	rootCmd.PersistentFlags().StringVar(&flgReportComp, "report-compression", "zip", "Report default compression (zip, gzip, none)")
 
 	viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose"))
 	viper.BindPFlag("testing", rootCmd.PersistentFlags().Lookup("test"))
@@ -112,6 +118,9 @@ func init() {
 	viper.BindPFlag("report.email", rootCmd.PersistentFlags().Lookup("report-email"))
 	viper.BindPFlag("report.org", rootCmd.PersistentFlags().Lookup("report-org"))
 	viper.BindPFlag("report.copy", rootCmd.PersistentFlags().Lookup("report-copy"))
+	viper.BindPFlag("report.contact", rootCmd.PersistentFlags().Lookup("report-contact"))
+	viper.BindPFlag("report.format", rootCmd.PersistentFlags().Lookup("report-format"))
+	viper.BindPFlag("report.compression", rootCmd.PersistentFlags().Lookup("report-compression"))
 
 	viper.BindPFlag("domain.only", rootCmd.PersistentFlags().Lookup("domain"))
 	viper.BindPFlag("domain.exclude", rootCmd.PersistentFlags().Lookup("no-domain"))
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/nabbar/opendmarc-reports/history"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// importError is the JSON Lines record of a bad line of an history file
+type importError struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	JobId  string `json:"job,omitempty"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+var errorsOut struct {
+	m sync.Mutex
+	w io.WriteCloser
+	e *json.Encoder
+}
+
+// openErrorsOut open the JSON Lines file of the bad lines, appended if exists, or the standard output for "-"
+func openErrorsOut(path string) error {
+	var w io.WriteCloser = os.Stdout
+
+	if path == "" {
+		return nil
+	} else if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+
+		w = f
+	}
+
+	errorsOut.w = w
+	errorsOut.e = json.NewEncoder(w)
+
+	return nil
+}
+
+func closeErrorsOut() {
+	errorsOut.m.Lock()
+	defer errorsOut.m.Unlock()
+
+	if errorsOut.w != nil && errorsOut.w != os.Stdout {
+		ErrorLevel.LogErrorCtx(NilLevel, "closing errors output file", errorsOut.w.Close())
+	}
+
+	errorsOut.w = nil
+	errorsOut.e = nil
+}
+
+// reportLineError log a bad line and write its record to the errors output
+func reportLineError(path string, e *history.ParseError) {
+	ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("reading job '%s' into file '%s'", e.JobId, path), e)
+
+	errorsOut.m.Lock()
+	defer errorsOut.m.Unlock()
+
+	if errorsOut.e == nil {
+		return
+	}
+
+	ErrorLevel.LogErrorCtx(NilLevel, "writing errors output file", errorsOut.e.Encode(importError{
+		File:   path,
+		Line:   e.Line,
+		JobId:  e.JobId,
+		Key:    e.Key,
+		Value:  e.Value,
+		Reason: e.Err.Error(),
+	}))
+}
+
+// checkJob report the bad lines of the job, it return false if the job must not be saved (strict mode)
+func checkJob(path string, h *history.Job) bool {
+	var bad = len(h.Errors)
+
+	for _, e := range h.Errors {
+		reportLineError(path, e)
+	}
+
+	for _, u := range h.Unknown {
+		reportLineError(path, &history.ParseError{
+			Line:  u.Line,
+			JobId: h.JobId,
+			Key:   u.Key,
+			Value: u.Value,
+			Err:   fmt.Errorf("key '%s' not understand", u.Key),
+		})
+		bad++
+	}
+
+	if bad > 0 && flgImportStrict {
+		ErrorLevel.Logf("Job '%s' of file '%s' rejected by strict mode : %d bad lines", h.JobId, path, bad)
+		return false
+	}
+
+	return true
+}
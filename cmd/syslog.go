@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/nabbar/opendmarc-reports/history"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// syslogNoRua is the set of policy domains already warned for jobs rebuilt from syslog without rua
+var syslogNoRua sync.Map
+
+// syslogLookup complete the jobs rebuilt from syslog with the dmarc record of their policy domain, looked up once per domain
+type syslogLookup struct {
+	r   history.JobReader
+	rec map[string]string
+}
+
+func newSyslogLookup(r history.JobReader) *syslogLookup {
+	return &syslogLookup{
+		r:   r,
+		rec: make(map[string]string),
+	}
+}
+
+func (l *syslogLookup) Next() (*history.Job, error) {
+	h, err := l.r.Next()
+
+	if err != nil || h.PDomain == "" {
+		return h, err
+	}
+
+	rec, ok := l.rec[h.PDomain]
+
+	if !ok {
+		rec, err = lookupDMARC(h.PDomain)
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("looking up dmarc record of domain '%s'", h.PDomain), err)
+		l.rec[h.PDomain] = rec
+	}
+
+	if rec != "" {
+		WarnLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("reading dmarc record of domain '%s' for job '%s'", h.PDomain, h.JobId), h.SetRecord(rec))
+	}
+
+	return h, nil
+}
+
+// lookupDMARC return the dmarc record of the domain, or of its nearest parent domain, or an empty string if none is published
+func lookupDMARC(domain string) (string, error) {
+	for d := domain; strings.Contains(d, "."); d = d[strings.Index(d, ".")+1:] {
+		lst, err := net.LookupTXT("_dmarc." + d)
+
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		for _, t := range lst {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(t)), "v=dmarc1") {
+				return t, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// warnSyslogRua warn once per policy domain about a job rebuilt from syslog without rua
+func warnSyslogRua(h *history.Job) {
+	if len(h.Rua) > 0 || len(h.Missing) == 0 {
+		return
+	} else if _, ok := syslogNoRua.LoadOrStore(h.PDomain, true); ok {
+		return
+	}
+
+	WarnLevel.Logf("Job '%s' rebuilt from syslog without rua : the jobs of domain '%s' are saved and reported only if the domain has already a report address, see the --lookup flag", h.JobId, h.PDomain)
+}
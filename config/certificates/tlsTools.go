@@ -19,6 +19,8 @@ limitations under the License.
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"io/ioutil"
 	"strings"
 
 	. "github.com/nabbar/opendmarc-reports/logger"
@@ -96,3 +98,37 @@ func GetTLSConfig(serverName string, skipVerify bool) *tls.Config {
 		InsecureSkipVerify: skipVerify,
 	}
 }
+
+// GetServerTLSConfig return the config of a server requiring a client certificate signed by a client CA.
+// The certificate pair and the client CA files are added to the included ones, if given.
+func GetServerTLSConfig(CertKey, CertCrt, ClientCA string) (*tls.Config, error) {
+	cnf := &tls.Config{
+		Certificates: AddCertPair(AppendCertificates(make([]tls.Certificate, 0)), CertKey, CertCrt),
+		ClientCAs:    GetClientCA(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if ClientCA != "" {
+		pem, err := ioutil.ReadFile(ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		if cnf.ClientCAs == nil {
+			cnf.ClientCAs = x509.NewCertPool()
+		}
+
+		if !cnf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found into client CA file " + ClientCA)
+		}
+	}
+
+	if len(cnf.Certificates) < 1 {
+		return nil, errors.New("no server certificate included or given")
+	} else if cnf.ClientCAs == nil {
+		return nil, errors.New("no client CA included or given to check the client certificates")
+	}
+
+	return cnf, nil
+}
@@ -51,6 +51,9 @@ const (
 
 	DEFAULT_INTERVAL = "24h"
 
+	DEFAULT_RETRY_INTERVAL = "15m"
+	DEFAULT_RETRY_MAXAGE   = "72h"
+
 	DEFAULT_DAT_PATH = "/var/tmp/"
 )
 
@@ -75,6 +78,7 @@ type configModel struct {
 
 	Domain configDomain `json:"domain" yaml:"domain" toml:"domain"`
 	Report configReport `json:"report" yaml:"report" toml:"report"`
+	Retry  configRetry  `json:"retry" yaml:"retry" toml:"retry"`
 
 	SMTP SMTP `json:"-" yaml:"-" toml:"-"`
 }
@@ -88,14 +92,23 @@ type Config interface {
 
 	GetInterval() time.Duration
 	IsDayMode() bool
+	GetDomainOnly() []string
 
 	IsTesting() bool
 	IsUpdate() bool
 
 	GetOrg() string
 	GetEmail() *tools.MailAddress
+	GetContact() string
+	GetReportFormat(receiver string) string
+	GetReportCompression() string
+	GetDestinationCompression(receiver string) string
+	GetDestinationMatches() []string
 	GetMakeRecipient(to tools.ListMailAddress) tools.ListMailAddress
 
+	GetRetryInterval() time.Duration
+	GetRetryMaxAge() time.Duration
+
 	GetDatabase() *sql.DB
 	GetSMTP() SMTP
 	GetHTTP(url string) HTTP
@@ -108,9 +121,27 @@ type configDomain struct {
 }
 
 type configReport struct {
-	Email string `json:"email" yaml:"email" toml:"email"`
-	Org   string `json:"org" yaml:"org" toml:"org"`
-	Copy  string `json:"copy" yaml:"copy" toml:"copy"`
+	Email       string `json:"email" yaml:"email" toml:"email"`
+	Org         string `json:"org" yaml:"org" toml:"org"`
+	Copy        string `json:"copy" yaml:"copy" toml:"copy"`
+	Contact     string `json:"contact" yaml:"contact" toml:"contact"`
+	Format      string `json:"format" yaml:"format" toml:"format"`
+	Compression string `json:"compression" yaml:"compression" toml:"compression"`
+
+	Destinations []configDestination `json:"destinations" yaml:"destinations" toml:"destinations"`
+}
+
+// configDestination override the report options for a receiver domain and its sub domains
+type configDestination struct {
+	Match       string `json:"match" yaml:"match" toml:"match"`
+	Format      string `json:"format" yaml:"format" toml:"format"`
+	Compression string `json:"compression" yaml:"compression" toml:"compression"`
+}
+
+// configRetry define the backoff of the failed deliveries queue : first delay doubled at each attempt, until max age
+type configRetry struct {
+	Interval string `json:"interval" yaml:"interval" toml:"interval"`
+	MaxAge   string `json:"maxage" yaml:"maxage" toml:"maxage"`
 }
 
 var (
@@ -145,14 +176,25 @@ func loadConfig() {
 		},
 
 		Report: configReport{
-			Email: viper.GetString("report.email"),
-			Org:   viper.GetString("report.org"),
-			Copy:  viper.GetString("report.copy"),
+			Email:       viper.GetString("report.email"),
+			Org:         viper.GetString("report.org"),
+			Copy:        viper.GetString("report.copy"),
+			Contact:     viper.GetString("report.contact"),
+			Format:      viper.GetString("report.format"),
+			Compression: viper.GetString("report.compression"),
+		},
+
+		Retry: configRetry{
+			Interval: formatInterval(defaultString(viper.GetString("retry.interval"), DEFAULT_RETRY_INTERVAL)),
+			MaxAge:   formatInterval(defaultString(viper.GetString("retry.maxage"), DEFAULT_RETRY_MAXAGE)),
 		},
 
 		SMTP: nil,
 	}
 
+	err := viper.UnmarshalKey("report.destinations", &config.Report.Destinations)
+	FatalLevel.LogErrorCtx(NilLevel, "parsing report destinations config", err)
+
 	DebugLevel.Logf("Loaded Config: %s", string(config.YAML()))
 }
 
@@ -163,6 +205,14 @@ func formatInterval(str string) string {
 	return fmt.Sprintf("%s", interval.Truncate(time.Second).String())
 }
 
+func defaultString(str, def string) string {
+	if strings.TrimSpace(str) == "" {
+		return def
+	}
+
+	return str
+}
+
 func (cnf *configModel) Connect() {
 	db := cnf.GetDatabase()
 	defer func() {
@@ -208,6 +258,10 @@ func (cnf configModel) IsDayMode() bool {
 	return cnf.Day
 }
 
+func (cnf configModel) GetDomainOnly() []string {
+	return cnf.Domain.Only
+}
+
 func (cnf configModel) GetOrg() string {
 	return cnf.Report.Org
 }
@@ -216,6 +270,61 @@ func (cnf configModel) GetEmail() *tools.MailAddress {
 	return tools.MailAddressParser(cnf.Report.Email)
 }
 
+func (cnf configModel) GetContact() string {
+	return cnf.Report.Contact
+}
+
+// GetReportFormat return the report format for the receiver domain, or the global format if no destination match
+func (cnf configModel) GetReportFormat(receiver string) string {
+	if d := cnf.getDestination(receiver); d != nil && d.Format != "" {
+		return d.Format
+	}
+
+	return cnf.Report.Format
+}
+
+func (cnf configModel) GetReportCompression() string {
+	return cnf.Report.Compression
+}
+
+// GetDestinationCompression return the compression configured for the receiver domain, or an empty string
+func (cnf configModel) GetDestinationCompression(receiver string) string {
+	if d := cnf.getDestination(receiver); d != nil {
+		return d.Compression
+	}
+
+	return ""
+}
+
+// GetDestinationMatches return the receiver domain of each report destination of config
+func (cnf configModel) GetDestinationMatches() []string {
+	var res = make([]string, 0)
+
+	for _, d := range cnf.Report.Destinations {
+		res = append(res, d.Match)
+	}
+
+	return res
+}
+
+func (cnf configModel) getDestination(receiver string) *configDestination {
+	receiver = strings.ToLower(strings.Trim(receiver, ". "))
+
+	if receiver == "" {
+		return nil
+	}
+
+	for i, d := range cnf.Report.Destinations {
+		m := strings.ToLower(strings.Trim(d.Match, ". "))
+
+		if m != "" && (receiver == m || strings.HasSuffix(receiver, "."+m)) {
+			return &cnf.Report.Destinations[i]
+		}
+	}
+
+	return nil
+}
+
 func (cnf configModel) GetMakeRecipient(to tools.ListMailAddress) tools.ListMailAddress {
 	var lst = tools.NewListMailAddress()
 	lst.Merge(to)
@@ -227,6 +336,20 @@ func (cnf configModel) GetMakeRecipient(to tools.ListMailAddress) tools.ListMail
 	return lst
 }
 
+func (cnf configModel) GetRetryInterval() time.Duration {
+	interval, err := time.ParseDuration(cnf.Retry.Interval)
+	FatalLevel.LogErrorCtx(NilLevel, "parsing duration format for retry interval", err)
+
+	return interval
+}
+
+func (cnf configModel) GetRetryMaxAge() time.Duration {
+	interval, err := time.ParseDuration(cnf.Retry.MaxAge)
+	FatalLevel.LogErrorCtx(NilLevel, "parsing duration format for retry max age", err)
+
+	return interval
+}
+
 func (cnf configModel) IsTesting() bool {
 	return cnf.Testing
 }
@@ -235,6 +358,9 @@ func (cnf configModel) IsUpdate() bool {
 	return !cnf.NoUpdate
 }
 
+// max length of the signatures list of a message concatenated by the records query, set on each connection
+const mysql_groupconcat = "1048576"
+
 func (cnf configModel) GetDatabase() *sql.DB {
 	if !strings.Contains(cnf.MysqlDSN, "parseTime=true") {
 		if strings.Contains(cnf.MysqlDSN, "?") {
@@ -244,6 +370,11 @@ func (cnf configModel) GetDatabase() *sql.DB {
 		}
 	}
 
+	// a system variable of the dsn is set on each new connection of the pool
+	if !strings.Contains(cnf.MysqlDSN, "group_concat_max_len=") {
+		cnf.MysqlDSN = cnf.MysqlDSN + "&group_concat_max_len=" + mysql_groupconcat
+	}
+
 	db, err := sql.Open("mysql", cnf.MysqlDSN)
 	FatalLevel.LogErrorCtx(InfoLevel, "Connect to mysql database", err)
 
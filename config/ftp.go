@@ -1,8 +1,8 @@
 package config
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"net/url"
 	"time"
 
@@ -40,7 +40,7 @@ type ftpClient struct {
 type FTP interface {
 	Connect()
 	Close()
-	Store(zipName string, zipFile *bytes.Buffer)
+	Store(fileName string, file io.Reader)
 }
 
 func newFTPClient(uri string) FTP {
@@ -85,7 +85,7 @@ func (obj *ftpClient) Close() {
 	}
 }
 
-func (obj *ftpClient) Store(zipName string, zipFile *bytes.Buffer) {
+func (obj *ftpClient) Store(fileName string, file io.Reader) {
 	if obj.cli == nil {
 		obj.Connect()
 	}
@@ -98,8 +98,8 @@ func (obj *ftpClient) Store(zipName string, zipFile *bytes.Buffer) {
 	}
 
 	dir := strings.Replace(obj.url.Path, "/", string(os.PathSeparator), -1)
-	ful := strings.Replace(path.Join(dir, zipName), string(os.PathSeparator), "/", -1)
-	err := obj.cli.Store(ful, bytes.NewReader(zipFile.Bytes()))
+	ful := strings.Replace(path.Join(dir, fileName), string(os.PathSeparator), "/", -1)
+	err := obj.cli.Store(ful, file)
 
-	PanicLevel.LogErrorCtxf(InfoLevel, "storing FTP Zip File '%s' to Host '%s'", err, ful, obj.url.Host)
+	PanicLevel.LogErrorCtxf(InfoLevel, "storing FTP Report File '%s' to Host '%s'", err, ful, obj.url.Host)
 }
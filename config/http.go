@@ -3,6 +3,7 @@ package config
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -37,7 +38,7 @@ type httpClient struct {
 
 type HTTP interface {
 	Check() bool
-	Call(zipFile *bytes.Buffer) (bool, *bytes.Buffer)
+	Call(contentType string, file io.Reader) (bool, *bytes.Buffer)
 }
 
 func newHTTPClient(Url string) HTTP {
@@ -80,22 +81,15 @@ func (obj *httpClient) Check() bool {
 	return true
 }
 
-func (obj *httpClient) Call(zipFile *bytes.Buffer) (bool, *bytes.Buffer) {
-	return obj.checkResponse(
-		obj.doRequest(
-			obj.newRequest(http.MethodPost, zipFile),
-		),
-	)
-}
-
-func (obj *httpClient) newRequest(method string, body *bytes.Buffer) *http.Request {
-	var reader *bytes.Reader
+func (obj *httpClient) Call(contentType string, file io.Reader) (bool, *bytes.Buffer) {
+	req := obj.newRequest(http.MethodPost, file)
+	req.Header.Set("Content-Type", contentType)
 
-	if body != nil && body.Len() > 0 {
-		reader = bytes.NewReader(body.Bytes())
-	}
+	return obj.checkResponse(obj.doRequest(req))
+}
 
-	req, err := http.NewRequest(method, obj.url.String(), reader)
+func (obj *httpClient) newRequest(method string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, obj.url.String(), body)
 	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("creating '%s' request to '%s'", method, obj.url.Host), err)
 
 	return req
@@ -109,11 +103,13 @@ func (obj *httpClient) doRequest(req *http.Request) *http.Response {
 }
 
 func (obj *httpClient) checkResponse(res *http.Response) (bool, *bytes.Buffer) {
-	var buf *bytes.Buffer
+	var buf = bytes.NewBuffer(make([]byte, 0))
 
 	if res.Body != nil {
+		defer res.Body.Close()
+
 		bdy, err := ioutil.ReadAll(res.Body)
-		if err != nil {
+		if err == nil {
 			buf.Write(bdy)
 		}
 	}
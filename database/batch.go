@@ -0,0 +1,349 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// max rows of one multi-row insert statement
+const batch_max_rows = 500
+
+// dbExec is the common interface of the database connection and of a transaction
+type dbExec interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type batchJob struct {
+	msg *Messages
+	sig []*Signatures
+}
+
+// Batch save a list of imported jobs (message, request and signatures) into one transaction,
+// with multi-row inserts for the new messages and the signatures.
+type Batch struct {
+	size int
+	jobs []batchJob
+}
+
+// BatchError is returned when a batch is rolled back, with the job ids of the batch
+type BatchError struct {
+	JobIds []string
+	Err    error
+}
+
+func (e BatchError) Error() string {
+	return fmt.Sprintf("batch of %d jobs rolled back (%s) : %v", len(e.JobIds), strings.Join(e.JobIds, ", "), e.Err)
+}
+
+// NewBatch return a batch written each size jobs, a size of 1 or less write each job into its own transaction
+func NewBatch(size int) *Batch {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Batch{
+		size: size,
+		jobs: make([]batchJob, 0, size),
+	}
+}
+
+func (b *Batch) Len() int {
+	return len(b.jobs)
+}
+
+// Add append a job to the batch and write the batch once full, a job already into the batch is replaced
+func (b *Batch) Add(msg *Messages, sig []*Signatures) error {
+	for i, j := range b.jobs {
+		if j.msg.JobId == msg.JobId {
+			b.jobs[i] = batchJob{msg: msg, sig: sig}
+			return nil
+		}
+	}
+
+	b.jobs = append(b.jobs, batchJob{msg: msg, sig: sig})
+
+	if len(b.jobs) >= b.size {
+		return b.Flush()
+	}
+
+	return nil
+}
+
+// Flush write all jobs of the batch into one transaction, rolled back on any error
+func (b *Batch) Flush() error {
+	var (
+		lst = b.jobs
+		ids = make([]string, 0, len(lst))
+	)
+
+	b.jobs = make([]batchJob, 0, b.size)
+
+	if len(lst) < 1 {
+		return nil
+	}
+
+	for _, j := range lst {
+		ids = append(ids, j.msg.JobId)
+	}
+
+	tx, err := GetDbCli().Begin()
+	if err != nil {
+		return BatchError{JobIds: ids, Err: err}
+	}
+
+	if err = saveBatch(tx, lst); err != nil {
+		ErrorLevel.LogErrorCtx(NilLevel, "rolling back import batch", tx.Rollback())
+		return BatchError{JobIds: ids, Err: err}
+	} else if err = tx.Commit(); err != nil {
+		return BatchError{JobIds: ids, Err: err}
+	}
+
+	DebugLevel.Logf("Batch of %d jobs saved into table %s", len(lst), table_messages)
+
+	return nil
+}
+
+func saveBatch(tx *sql.Tx, lst []batchJob) error {
+	var (
+		add = make([]*Messages, 0)
+		old = make([]interface{}, 0)
+	)
+
+	if err := resolveMessages(tx, lst); err != nil {
+		return err
+	}
+
+	for _, j := range lst {
+		if err := j.msg.prepare(tx); err != nil {
+			return err
+		}
+
+		if j.msg.Date.IsZero() {
+			j.msg.Date = time.Now()
+		}
+
+		if j.msg.Id == 0 {
+			add = append(add, j.msg)
+			continue
+		}
+
+		if err := j.msg.update(tx); err != nil {
+			return err
+		}
+
+		// signatures of a job imported again are replaced
+		old = append(old, j.msg.Id)
+	}
+
+	if len(old) > 0 {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE `message` IN (%s)", table_signatures, placeholders(len(old))), old...); err != nil {
+			return err
+		}
+	}
+
+	if err := insertMessages(tx, add); err != nil {
+		return err
+	}
+
+	return insertSignatures(tx, lst)
+}
+
+// resolveMessages set the id and the sent flag of the jobs already saved, found by their job id
+func resolveMessages(tx *sql.Tx, lst []batchJob) error {
+	var (
+		ids = make(map[string]*Messages)
+		job = make([]interface{}, 0)
+	)
+
+	for _, j := range lst {
+		if j.msg.Id == 0 && j.msg.JobId != "" {
+			ids[j.msg.JobId] = j.msg
+			job = append(job, j.msg.JobId)
+		}
+	}
+
+	for len(job) > 0 {
+		var cur = job
+
+		if len(cur) > batch_max_rows {
+			cur = cur[:batch_max_rows]
+		}
+
+		job = job[len(cur):]
+
+		rows, err := tx.Query(fmt.Sprintf("SELECT `id`, `jobid`, `sent` FROM `%s` WHERE `jobid` IN (%s)", table_messages, placeholders(len(cur))), cur...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var (
+				id  int
+				jid string
+				snt bool
+			)
+
+			if err = rows.Scan(&id, &jid, &snt); err != nil {
+				rows.Close()
+				return err
+			}
+
+			// the sent flag is written back by the update, so a job imported again is not reported twice
+			if m, ok := ids[jid]; ok && m.Id < id {
+				m.Id = id
+				m.Sent = snt
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+
+		rows.Close()
+	}
+
+	return nil
+}
+
+// insertMessages add the new messages with multi-row inserts and set their id from their job id
+func insertMessages(tx *sql.Tx, lst []*Messages) error {
+	var (
+		fld = strings.TrimSpace(strings.SplitN(field_messages, ",", 2)[1])
+		nbr = len(strings.Split(fld, ","))
+		ids = make(map[string]*Messages)
+	)
+
+	for len(lst) > 0 {
+		var (
+			cur = lst
+			val = make([]string, 0)
+			arg = make([]interface{}, 0)
+			job = make([]interface{}, 0)
+		)
+
+		if len(cur) > batch_max_rows {
+			cur = cur[:batch_max_rows]
+		}
+
+		lst = lst[len(cur):]
+
+		for _, m := range cur {
+			val = append(val, "("+placeholders(nbr)+")")
+			arg = append(arg, m.values()...)
+			job = append(job, m.JobId)
+			ids[m.JobId] = m
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO `%s`(%s) VALUES%s", table_messages, fld, strings.Join(val, ", ")), arg...); err != nil {
+			return err
+		}
+
+		// the ids of a multi-row insert are not always consecutive, so they are read back
+		rows, err := tx.Query(fmt.Sprintf("SELECT `id`, `jobid` FROM `%s` WHERE `jobid` IN (%s)", table_messages, placeholders(len(job))), job...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var (
+				id  int
+				jid string
+			)
+
+			if err = rows.Scan(&id, &jid); err != nil {
+				rows.Close()
+				return err
+			}
+
+			if m, ok := ids[jid]; ok && m.Id < id {
+				m.Id = id
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+
+		rows.Close()
+	}
+
+	for k, m := range ids {
+		if m.Id == 0 {
+			return fmt.Errorf("cannot find id of job '%s' added into table %s", k, table_messages)
+		}
+	}
+
+	return nil
+}
+
+// insertSignatures add the signatures of all jobs with multi-row inserts
+func insertSignatures(tx *sql.Tx, lst []batchJob) error {
+	var (
+		val = make([]string, 0)
+		arg = make([]interface{}, 0)
+	)
+
+	flush := func() error {
+		if len(val) < 1 {
+			return nil
+		}
+
+		_, err := tx.Exec(fmt.Sprintf("INSERT INTO `%s`(`message`,`domain`,`pass`,`error`,`selector`,`human_result`) VALUES%s", table_signatures, strings.Join(val, ", ")), arg...)
+
+		val = make([]string, 0)
+		arg = make([]interface{}, 0)
+
+		return err
+	}
+
+	for _, j := range lst {
+		for _, s := range j.sig {
+			if s == nil {
+				continue
+			}
+
+			if s.Domain == nil {
+				s.Domain = NewDomain("")
+			} else if s.Domain.Id == 0 && s.Domain.Name != "" {
+				if err := s.Domain.Resolve(); err != nil {
+					return fmt.Errorf("while saving signature domain for job '%s' : %v", j.msg.JobId, err)
+				}
+			}
+
+			s.Message = j.msg
+			val = append(val, "("+placeholders(6)+")")
+			arg = append(arg, j.msg.Id, s.Domain.Id, s.Pass, s.Error, s.Selector, s.HumanResult)
+
+			if len(val) >= batch_max_rows {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return flush()
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const table_checkpoints = "import_checkpoints"
+const field_checkpoints = "`id`, `date`, `path`, `inode`, `offset`, `size`, `head`"
+
+// Checkpoints is the position into an history file of the last fully imported job.
+// The head is the hash of the file start, to detect a file rewritten with the same inode.
+type Checkpoints struct {
+	Generic
+
+	Path   string
+	Inode  uint64
+	Offset int64
+	Size   int64
+	Head   string
+}
+
+func NewCheckpoints(path string, inode uint64) *Checkpoints {
+	return &Checkpoints{
+		Generic: Generic{
+			table: table_checkpoints,
+			fctField: func() FieldList {
+				return FieldList{
+					"id":     "int(11) NOT NULL AUTO_INCREMENT",
+					"date":   "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
+					"path":   "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"inode":  "bigint(20) unsigned NOT NULL DEFAULT '0'",
+					"offset": "bigint(20) unsigned NOT NULL DEFAULT '0'",
+					"size":   "bigint(20) unsigned NOT NULL DEFAULT '0'",
+					"head":   "char(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+				}
+			},
+			fctIndex: func() IndexList {
+				return IndexList{
+					"PRIMARY": {"type": "PRIMARY", "fields": "id"},
+					"path":    {"type": "UNIQUE", "fields": "path,inode"},
+				}
+			},
+		},
+		Path:  path,
+		Inode: inode,
+	}
+}
+
+// GetCheckpoints return the checkpoint of the file, with a zero offset if the file was never imported
+func GetCheckpoints(path string, inode uint64) (*Checkpoints, error) {
+	obj := NewCheckpoints(path, inode)
+	return obj, obj.Load()
+}
+
+func (obj *Checkpoints) Load() error {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	if obj.Path == "" {
+		return fmt.Errorf("cannot load null row into table %s", obj.table)
+	}
+
+	if rows, err = GetDbCli().Query(fmt.Sprintf("SELECT %s FROM `%s` WHERE `path`=? AND `inode`=? LIMIT 1", field_checkpoints, obj.table), obj.Path, obj.Inode); err != nil {
+		return err
+	} else if err = rows.Err(); err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = rows.Scan(&obj.Id, &obj.Date, &obj.Path, &obj.Inode, &obj.Offset, &obj.Size, &obj.Head); err != nil {
+			return err
+		}
+
+		DebugLevel.Logf("Find row into table %s : %s (inode: %d, offset: %d)", obj.table, obj.Path, obj.Inode, obj.Offset)
+		break
+	}
+
+	return rows.Err()
+}
+
+// Save insert or update the checkpoint of the file
+func (obj *Checkpoints) Save() error {
+	var (
+		res sql.Result
+		row int64
+		nbr int64
+		err error
+	)
+
+	if obj.Path == "" {
+		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
+	}
+
+	obj.Date = time.Now()
+
+	fld := strings.SplitN(field_checkpoints, ",", 2)
+	lst := strings.TrimSpace(fld[1])
+
+	res, err = GetDbCli().Exec(
+		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(%s)", obj.table, lst, placeholders(6))+
+			" ON DUPLICATE KEY UPDATE `id`=LAST_INSERT_ID(`id`), `date`=VALUES(`date`), `offset`=VALUES(`offset`), `size`=VALUES(`size`), `head`=VALUES(`head`)",
+		obj.Date,
+		obj.Path,
+		obj.Inode,
+		obj.Offset,
+		obj.Size,
+		obj.Head,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	if row != 0 {
+		if nbr, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		obj.Id = int(nbr)
+		DebugLevel.Logf("Saved row into table %s : %s (inode: %d, offset: %d)", obj.table, obj.Path, obj.Inode, obj.Offset)
+	}
+
+	return nil
+}
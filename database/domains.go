@@ -1,5 +1,10 @@
 package database
 
+import (
+	"database/sql"
+	"fmt"
+)
+
 /*
 Copyright 2018 Nicolas JUHEL
 
@@ -61,3 +66,36 @@ func GetDomain(Id int) (*Domain, error) {
 
 	return obj, err
 }
+
+// FindDomain load an existing domain by its name, without adding it if not found
+func FindDomain(Name string) (*Domain, error) {
+	var (
+		rows *sql.Rows
+		err  error
+		obj  = NewDomain("")
+	)
+
+	if rows, err = GetDbCli().Query(fmt.Sprintf("SELECT `id`, `name`, `date` FROM `%s` WHERE `name`=? LIMIT 1", table_domains), Name); err != nil {
+		return obj, err
+	} else if err = rows.Err(); err != nil {
+		return obj, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = rows.Scan(&obj.Id, &obj.Name, &obj.Date); err != nil {
+			return obj, err
+		}
+
+		break
+	}
+
+	if err = rows.Err(); err != nil {
+		return obj, err
+	} else if obj.Id == 0 {
+		return obj, fmt.Errorf("cannot find domain '%s' into table %s", Name, table_domains)
+	}
+
+	return obj, nil
+}
@@ -73,6 +73,8 @@ func (fld IndexList) Join() string {
 
 		if t == "PRIMARY" {
 			res = append(res, fmt.Sprintf("%s KEY (%s)", t, strings.Join(fl, ",")))
+		} else if t == "INDEX" {
+			res = append(res, fmt.Sprintf("KEY `%s` (%s)", k, strings.Join(fl, ",")))
 		} else {
 			res = append(res, fmt.Sprintf("%s KEY `%s` (%s)", t, k, strings.Join(fl, ",")))
 		}
@@ -94,9 +96,20 @@ type Generic struct {
 var (
 	useUTC = false
 	dbcli  *sql.DB
+	// dryRun forbid any database connection, the names are then kept without id
+	dryRun = false
 )
 
+// SetDryRun forbid any database connection : the names are not resolved and the messages not loaded
+func SetDryRun() {
+	dryRun = true
+}
+
 func GetDbCli() *sql.DB {
+	if dryRun {
+		FatalLevel.Log("database connection not allowed in dry run mode")
+	}
+
 	if dbcli == nil {
 		dbcli = config.GetConfig().GetDatabase()
 		InfoLevel.Logf("Database connection is opened")
@@ -137,6 +150,22 @@ func CheckTables() {
 	if err := NewRequests(nil).CheckTable(); err != nil {
 		FatalLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking table '%s' exists", table_requests), err)
 	}
+
+	if err := NewReports(nil).CheckTable(); err != nil {
+		FatalLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking table '%s' exists", table_reports), err)
+	}
+
+	if err := NewReportDestinations(nil).CheckTable(); err != nil {
+		FatalLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking table '%s' exists", table_report_destinations), err)
+	}
+
+	if err := NewRetryQueue(nil).CheckTable(); err != nil {
+		FatalLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking table '%s' exists", table_retries), err)
+	}
+
+	if err := NewCheckpoints("", 0).CheckTable(); err != nil {
+		FatalLevel.LogErrorCtx(InfoLevel, fmt.Sprintf("checking table '%s' exists", table_checkpoints), err)
+	}
 }
 
 func (gen Generic) CheckTable() error {
@@ -156,7 +185,7 @@ func (gen Generic) CheckTable() error {
 			}
 
 			if tbl == gen.table {
-				return nil
+				return gen.checkColumns()
 			}
 		}
 	}
@@ -180,6 +209,65 @@ func (gen Generic) CheckTable() error {
 	return nil
 }
 
+// checkColumns add the missing columns of an existing table
+func (gen Generic) checkColumns() error {
+	var (
+		rows *sql.Rows
+		cols []string
+		lst  = make(map[string]bool)
+		err  error
+	)
+
+	if rows, err = GetDbCli().Query(fmt.Sprintf("SHOW COLUMNS FROM `%s`", gen.table)); err != nil {
+		return err
+	} else if err = rows.Err(); err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	if cols, err = rows.Columns(); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var (
+			val = make([]sql.RawBytes, len(cols))
+			ptr = make([]interface{}, len(cols))
+		)
+
+		for i := range val {
+			ptr[i] = &val[i]
+		}
+
+		if err = rows.Scan(ptr...); err != nil {
+			return err
+		} else if err = rows.Err(); err != nil {
+			return err
+		}
+
+		lst[string(val[0])] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for k, d := range gen.fctField() {
+		if k == "" || d == "" || lst[k] {
+			continue
+		}
+
+		if _, err = GetDbCli().Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", gen.table, k, d)); err != nil {
+			return err
+		}
+
+		DebugLevel.Logf("Table %s : Added column '%s'", gen.table, k)
+	}
+
+	return nil
+}
+
 func (gen *Generic) Load() error {
 	var (
 		rows *sql.Rows
@@ -337,3 +425,12 @@ func (gen *Generic) Delete() error {
 
 	return nil
 }
+
+// placeholders return a list of nbr sql placeholders separated by comma
+func placeholders(nbr int) string {
+	if nbr < 1 {
+		return ""
+	}
+
+	return strings.TrimSuffix(strings.Repeat("?, ", nbr), ", ")
+}
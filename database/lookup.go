@@ -0,0 +1,138 @@
+package database
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// max number of names kept into the lookup cache of each table
+const lookup_cache_size = 10000
+
+type lookupItem struct {
+	name string
+	id   int
+}
+
+// lookupCache is a concurrency-safe, least recently used cache of name to id for one table
+type lookupCache struct {
+	m sync.Mutex
+	l *list.List
+	i map[string]*list.Element
+}
+
+var (
+	lookupLock   sync.Mutex
+	lookupCaches = make(map[string]*lookupCache)
+)
+
+func getLookupCache(table string) *lookupCache {
+	lookupLock.Lock()
+	defer lookupLock.Unlock()
+
+	if c, ok := lookupCaches[table]; ok {
+		return c
+	}
+
+	c := &lookupCache{
+		l: list.New(),
+		i: make(map[string]*list.Element),
+	}
+
+	lookupCaches[table] = c
+	return c
+}
+
+func (c *lookupCache) get(name string) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.i[name]; ok {
+		c.l.MoveToFront(e)
+		return e.Value.(lookupItem).id
+	}
+
+	return 0
+}
+
+func (c *lookupCache) set(name string, id int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.i[name]; ok {
+		e.Value = lookupItem{name: name, id: id}
+		c.l.MoveToFront(e)
+		return
+	}
+
+	c.i[name] = c.l.PushFront(lookupItem{name: name, id: id})
+
+	for c.l.Len() > lookup_cache_size {
+		e := c.l.Back()
+		c.l.Remove(e)
+		delete(c.i, e.Value.(lookupItem).name)
+	}
+}
+
+// Resolve set the id of a lookup row (domain, ip, reporter) from its name, adding the row if not exist.
+// The ids are cached, and the insert is safe with concurrent imports thanks to the unique name index.
+// In dry run mode, the id is left to 0.
+func (gen *Generic) Resolve() error {
+	if gen.Id != 0 || dryRun {
+		return nil
+	}
+
+	if gen.Name == "" {
+		return fmt.Errorf("cannot add an empty row into table %s", gen.table)
+	}
+
+	var c = getLookupCache(gen.table)
+
+	if id := c.get(gen.Name); id != 0 {
+		gen.Id = id
+		return nil
+	}
+
+	if gen.Date.IsZero() {
+		gen.Date = time.Now()
+	}
+
+	// on duplicate, the id of the existing row is returned as last insert id
+	res, err := GetDbCli().Exec(fmt.Sprintf("INSERT INTO `%s`(`name`, `date`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `id`=LAST_INSERT_ID(`id`)", gen.table), gen.Name, gen.Date)
+	if err != nil {
+		return err
+	}
+
+	nbr, err := res.LastInsertId()
+	if err != nil {
+		return err
+	} else if nbr == 0 {
+		return fmt.Errorf("cannot find id of '%s' into table %s", gen.Name, gen.table)
+	}
+
+	gen.Id = int(nbr)
+	c.set(gen.Name, gen.Id)
+
+	DebugLevel.Logf("Resolved row into table %s : %s (id: %d)", gen.table, gen.Name, gen.Id)
+
+	return nil
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"sort"
 	"time"
 
 	"fmt"
@@ -10,9 +12,9 @@ import (
 
 	"strconv"
 
+	"github.com/nabbar/opendmarc-reports/history"
 	. "github.com/nabbar/opendmarc-reports/logger"
 	"github.com/nabbar/opendmarc-reports/report"
-	"github.com/nabbar/opendmarc-reports/tools"
 )
 
 /*
@@ -32,7 +34,7 @@ limitations under the License.
 */
 
 const table_messages = "messages"
-const field_messages = "`id`, `date`, `jobid`, `reporter`, `ip`, `policy`, `disp`, `from_domain`, `env_domain`, `policy_domain`, `sigcount`, `spf`, `align_spf`, `align_dkim`, `request_id`, `sent`"
+const field_messages = "`id`, `date`, `jobid`, `reporter`, `ip`, `policy`, `disp`, `from_domain`, `env_domain`, `policy_domain`, `sigcount`, `spf`, `align_spf`, `align_dkim`, `request_id`, `sent`, `to_domain`, `reason`, `reason_comment`, `spf_scope`, `spf_domain`, `arc`, `arc_policy`, `arc_seals`, `missing`"
 
 type Messages struct {
 	Generic
@@ -53,6 +55,19 @@ type Messages struct {
 	AlignDKIM    int
 	Request      *Requests
 	Sent         bool
+
+	ToDomain      *Domain
+	Reason        string
+	ReasonComment string
+	SPFScope      string
+
+	SPFDomain *Domain
+	ARC       int
+	ARCPolicy int
+	ARCSeals  string
+
+	// Missing is the comma separated list of history keys not recovered, for a message imported from syslog
+	Missing string
 }
 
 func NewMessages(JobId string) *Messages {
@@ -61,22 +76,32 @@ func NewMessages(JobId string) *Messages {
 			table: table_messages,
 			fctField: func() FieldList {
 				return FieldList{
-					"id":            "int(11) NOT NULL AUTO_INCREMENT",
-					"date":          "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
-					"jobid":         "varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
-					"reporter":      "int(10) unsigned NOT NULL DEFAULT '0'",
-					"ip":            "int(10) unsigned NOT NULL DEFAULT '0'",
-					"policy":        "tinyint(3) unsigned NOT NULL DEFAULT '0'",
-					"disp":          "tinyint(3) unsigned NOT NULL DEFAULT '0'",
-					"from_domain":   "int(10) unsigned NOT NULL DEFAULT '0'",
-					"env_domain":    "int(10) unsigned NOT NULL DEFAULT '0'",
-					"policy_domain": "int(10) unsigned NOT NULL DEFAULT '0'",
-					"sigcount":      "tinyint(3) unsigned NOT NULL DEFAULT '0'",
-					"spf":           "tinyint(3) unsigned NOT NULL DEFAULT '0'",
-					"align_spf":     "tinyint(3) unsigned NOT NULL DEFAULT '0'",
-					"align_dkim":    "tinyint(3) unsigned NOT NULL DEFAULT '0'",
-					"request_id":    "int(10) unsigned NOT NULL DEFAULT '0'",
-					"sent":          "tinyint(1) unsigned NOT NULL DEFAULT '0'",
+					"id":             "int(11) NOT NULL AUTO_INCREMENT",
+					"date":           "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
+					"jobid":          "varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"reporter":       "int(10) unsigned NOT NULL DEFAULT '0'",
+					"ip":             "int(10) unsigned NOT NULL DEFAULT '0'",
+					"policy":         "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"disp":           "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"from_domain":    "int(10) unsigned NOT NULL DEFAULT '0'",
+					"env_domain":     "int(10) unsigned NOT NULL DEFAULT '0'",
+					"policy_domain":  "int(10) unsigned NOT NULL DEFAULT '0'",
+					"sigcount":       "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"spf":            "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"align_spf":      "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"align_dkim":     "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"request_id":     "int(10) unsigned NOT NULL DEFAULT '0'",
+					"sent":           "tinyint(1) unsigned NOT NULL DEFAULT '0'",
+					"to_domain":      "int(10) unsigned NOT NULL DEFAULT '0'",
+					"reason":         "varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"reason_comment": "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"spf_scope":      "varchar(8) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"queued":         "tinyint(1) unsigned NOT NULL DEFAULT '0'",
+					"spf_domain":     "int(10) unsigned NOT NULL DEFAULT '0'",
+					"arc":            "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"arc_policy":     "tinyint(3) unsigned NOT NULL DEFAULT '0'",
+					"arc_seals":      "varchar(1024) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"missing":        "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
 				}
 			},
 			fctIndex: func() IndexList {
@@ -116,14 +141,9 @@ func GetAllMessages(request *Requests, sent, dateMode bool, dateInterval time.Du
 	lst = make([]*Messages, 0)
 
 	qry := fmt.Sprintf("SELECT %s FROM `%s`", field_messages, table_messages)
-	arg := []interface{}{request.Id, sent}
-
-	if dateMode {
-		qry = qry + " WHERE `request_id`=? AND `sent`=? AND DATE(`date`) < DATE(DATE_SUB(CURRENT_DATE(), INTERVAL 1 DAY))"
-	} else {
-		qry = qry + " WHERE `request_id`=? AND `sent`=? AND `date` < DATE_SUB(NOW(), INTERVAL ? SECOND)"
-		arg = append(arg, dateInterval.Seconds())
-	}
+	whr, arg := NewWindow(sent, dateMode, dateInterval).where("")
+	qry = qry + " WHERE `request_id`=? AND " + whr
+	arg = append([]interface{}{request.Id}, arg...)
 
 	if rows, err = GetDbCli().Query(qry, arg...); err != nil {
 		return
@@ -155,17 +175,16 @@ func GetAllMessages(request *Requests, sent, dateMode bool, dateInterval time.Du
 }
 
 func GetRangeDate(request *Requests, sent, dateMode bool, dateInterval time.Duration) (dateMin, dateMax int, err error) {
-	var rows *sql.Rows
+	return GetWindowRangeDate(request, NewWindow(sent, dateMode, dateInterval))
+}
 
-	qry := fmt.Sprintf("SELECT UNIX_TIMESTAMP(MIN(`date`)), UNIX_TIMESTAMP(MAX(`date`)) FROM `%s`", table_messages)
-	arg := []interface{}{request.Id, sent}
+func GetWindowRangeDate(request *Requests, window Window) (dateMin, dateMax int, err error) {
+	var rows *sql.Rows
 
-	if dateMode {
-		qry = qry + " WHERE `request_id`=? AND `sent`=? AND DATE(`date`) < DATE(DATE_SUB(CURRENT_DATE(), INTERVAL 1 DAY))"
-	} else {
-		qry = qry + " WHERE `request_id`=? AND `sent`=? AND `date` < DATE_SUB(NOW(), INTERVAL ? SECOND)"
-		arg = append(arg, dateInterval.Seconds())
-	}
+	qry := fmt.Sprintf("SELECT IFNULL(UNIX_TIMESTAMP(MIN(`date`)), 0), IFNULL(UNIX_TIMESTAMP(MAX(`date`)), 0) FROM `%s`", table_messages)
+	whr, arg := window.where("")
+	qry = qry + " WHERE `request_id`=? AND " + whr
+	arg = append([]interface{}{request.Id}, arg...)
 
 	if rows, err = GetDbCli().Query(qry, arg...); err != nil {
 		return
@@ -198,14 +217,8 @@ func GetDomainList(sent, dateMode bool, dateInterval time.Duration) (domainIds [
 	domainIds = make([]int, 0)
 
 	qry := fmt.Sprintf("SELECT DISTINCT `from_domain` FROM `%s`", table_messages)
-	arg := []interface{}{sent}
-
-	if dateMode {
-		qry = qry + " WHERE `sent`=? AND DATE(`date`) < DATE(DATE_SUB(CURRENT_DATE(), INTERVAL 1 DAY))"
-	} else {
-		qry = qry + " WHERE `sent`=? AND `date` < DATE_SUB(NOW(), INTERVAL ? SECOND)"
-		arg = append(arg, dateInterval.Seconds())
-	}
+	whr, arg := NewWindow(sent, dateMode, dateInterval).where("")
+	qry = qry + " WHERE " + whr
 
 	if rows, err = GetDbCli().Query(qry, arg...); err != nil {
 		return
@@ -235,18 +248,17 @@ func GetDomainList(sent, dateMode bool, dateInterval time.Duration) (domainIds [
 }
 
 func GetRequestList(domain *Domain, sent, dateMode bool, dateInterval time.Duration) (requestIds []int, err error) {
+	return GetWindowRequestList(domain, NewWindow(sent, dateMode, dateInterval))
+}
+
+func GetWindowRequestList(domain *Domain, window Window) (requestIds []int, err error) {
 	var rows *sql.Rows
 	requestIds = make([]int, 0)
 
 	qry := fmt.Sprintf("SELECT DISTINCT `request_id` FROM `%s`", table_messages)
-	arg := []interface{}{domain.Id, sent}
-
-	if dateMode {
-		qry = qry + " WHERE `from_domain`=? AND `sent`=? AND DATE(`date`) < DATE(DATE_SUB(CURRENT_DATE(), INTERVAL 1 DAY))"
-	} else {
-		qry = qry + " WHERE `from_domain`=? AND `sent`=? AND `date` < DATE_SUB(NOW(), INTERVAL ? SECOND)"
-		arg = append(arg, dateInterval.Seconds())
-	}
+	whr, arg := window.where("")
+	qry = qry + " WHERE `from_domain`=? AND " + whr
+	arg = append([]interface{}{domain.Id}, arg...)
 
 	if rows, err = GetDbCli().Query(qry, arg...); err != nil {
 		return
@@ -283,6 +295,8 @@ func (obj *Messages) parseRow(row *sql.Rows) error {
 		env int
 		pol int
 		req int
+		tod int
+		spd int
 	)
 
 	err := row.Scan(
@@ -302,6 +316,15 @@ func (obj *Messages) parseRow(row *sql.Rows) error {
 		&obj.AlignDKIM,
 		&req,
 		&obj.Sent,
+		&tod,
+		&obj.Reason,
+		&obj.ReasonComment,
+		&obj.SPFScope,
+		&spd,
+		&obj.ARC,
+		&obj.ARCPolicy,
+		&obj.ARCSeals,
+		&obj.Missing,
 	)
 
 	if err != nil {
@@ -355,6 +378,24 @@ func (obj *Messages) parseRow(row *sql.Rows) error {
 		obj.PolicyDomain = NewDomain("")
 	}
 
+	if tod > 0 {
+		obj.ToDomain, _ = GetDomain(tod)
+	}
+	if obj.ToDomain == nil {
+		obj.ToDomain = NewDomain("")
+	}
+
+	if spd > 0 {
+		if spd == obj.EnvDomain.Id {
+			obj.SPFDomain = obj.EnvDomain
+		} else {
+			obj.SPFDomain, _ = GetDomain(spd)
+		}
+	}
+	if obj.SPFDomain == nil {
+		obj.SPFDomain = NewDomain("")
+	}
+
 	DebugLevel.Logf("Find row into table %s : %s (id: %d)", obj.table, obj.JobId, obj.Id)
 	return nil
 }
@@ -367,6 +408,10 @@ func (obj *Messages) Load() error {
 		arg  = make([]interface{}, 0)
 	)
 
+	if dryRun {
+		return nil
+	}
+
 	if obj.Id != 0 {
 		qry = qry + " WHERE `id`=? LIMIT 1"
 		arg = []interface{}{obj.Id}
@@ -437,6 +482,10 @@ func (obj *Messages) SetSent(Sent bool) error {
 }
 
 func (obj *Messages) Save() error {
+	return obj.save(GetDbCli())
+}
+
+func (obj *Messages) save(db dbExec) error {
 	var (
 		res sql.Result
 		row int64
@@ -444,100 +493,143 @@ func (obj *Messages) Save() error {
 		err error
 	)
 
+	if err = obj.prepare(db); err != nil {
+		return err
+	}
+
+	if obj.Id != 0 {
+		return obj.update(db)
+	}
+
+	if obj.JobId == "" {
+		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
+	}
+
+	if obj.Date.IsZero() {
+		obj.Date = time.Now()
+	}
+
+	fld := strings.SplitN(field_messages, ",", 2)
+	lst := strings.TrimSpace(fld[1])
+
+	res, err = db.Exec(
+		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(%s)", obj.table, lst, placeholders(len(strings.Split(lst, ",")))),
+		obj.values()...,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	row, err = res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if row != 0 {
+
+		nbr, err = res.LastInsertId()
+
+		if err != nil {
+			return err
+		}
+
+		obj.Id = int(nbr)
+		DebugLevel.Logf("Added %d row into table %s : %s (id: %d)", row, obj.table, obj.JobId, obj.Id)
+	}
+
+	return nil
+}
+
+// prepare save the reporter, ip and domains of the message and merge its request into the request of its domain
+func (obj *Messages) prepare(db dbExec) error {
+	var err error
+
 	if obj.Reporter != nil {
-		err = obj.Reporter.Save()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Reporter for job '%s'", obj.JobId), err)
+		if err = obj.Reporter.Resolve(); err != nil {
+			return fmt.Errorf("while saving Reporter for job '%s' : %v", obj.JobId, err)
+		}
 	} else {
 		obj.Reporter = NewReporters("")
 	}
 
 	if obj.Ip != nil {
-		err = obj.Ip.Save()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Ip for job '%s'", obj.JobId), err)
+		if err = obj.Ip.Resolve(); err != nil {
+			return fmt.Errorf("while saving Ip for job '%s' : %v", obj.JobId, err)
+		}
 	} else {
 		obj.Ip = NewIpAddr("")
 	}
 
 	if obj.FromDomain != nil {
-		err = obj.FromDomain.Save()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving From Domain for job '%s'", obj.JobId), err)
+		if err = obj.FromDomain.Resolve(); err != nil {
+			return fmt.Errorf("while saving From Domain for job '%s' : %v", obj.JobId, err)
+		}
 	} else {
 		obj.FromDomain = NewDomain("")
 	}
 
 	if obj.EnvDomain != nil {
-		err = obj.EnvDomain.Save()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Env Domain for job '%s'", obj.JobId), err)
+		if err = obj.EnvDomain.Resolve(); err != nil {
+			return fmt.Errorf("while saving Env Domain for job '%s' : %v", obj.JobId, err)
+		}
 	} else {
 		obj.EnvDomain = NewDomain("")
 	}
 
 	if obj.PolicyDomain != nil {
-		err = obj.PolicyDomain.Save()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Policy Domain for job '%s'", obj.JobId), err)
+		if err = obj.PolicyDomain.Resolve(); err != nil {
+			return fmt.Errorf("while saving Policy Domain for job '%s' : %v", obj.JobId, err)
+		}
 	} else {
 		obj.PolicyDomain = NewDomain("")
 	}
 
-	if obj.Request != nil {
-		req := NewRequests(obj.FromDomain)
-		err = req.Load()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving request for job '%s'", obj.JobId), err)
-
-		if req.IsLocked() {
-			return fmt.Errorf("request id '%d' for domain '%s' (id: %d) is locked", req.Id, req.Domain.Name, req.Domain.Id)
-		}
-
-		req.Repuri = tools.CleanJoin(tools.UnicSliceString(tools.CleanMergeSlice(strings.Split(req.Repuri, ","), strings.Split(obj.Request.Repuri, ",")...)), ",")
-		if !obj.Request.Date.IsZero() {
-			req.SetDateTime(obj.Request.Date)
-		}
-
-		if obj.Request.Pct != 0 {
-			req.Pct = obj.Request.Pct
-		}
-
-		if obj.Request.Policy != 0 {
-			req.Policy = obj.Request.Policy
-		}
-
-		if obj.Request.Spolicy != 0 {
-			req.Spolicy = obj.Request.Spolicy
-		}
-
-		if obj.Request.ADKIM != 0 {
-			req.ADKIM = obj.Request.ADKIM
+	if obj.ToDomain != nil && obj.ToDomain.Name != "" {
+		if err = obj.ToDomain.Resolve(); err != nil {
+			return fmt.Errorf("while saving Envelope To Domain for job '%s' : %v", obj.JobId, err)
 		}
+	} else if obj.ToDomain == nil {
+		obj.ToDomain = NewDomain("")
+	}
 
-		if obj.Request.ASPF != 0 {
-			req.ASPF = obj.Request.ASPF
+	if obj.SPFDomain != nil && obj.SPFDomain.Name != "" {
+		if err = obj.SPFDomain.Resolve(); err != nil {
+			return fmt.Errorf("while saving SPF Domain for job '%s' : %v", obj.JobId, err)
 		}
+	} else if obj.SPFDomain == nil {
+		obj.SPFDomain = NewDomain("")
+	}
 
-		obj.Request = req
-		err = obj.Request.Save()
-		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Request for job '%s'", obj.JobId), err)
-	} else {
+	if obj.Request == nil {
 		obj.Request = NewRequests(obj.FromDomain)
 		obj.Load()
-	}
 
-	if obj.Id != 0 {
-		return obj.Update()
+		return nil
 	}
 
-	if obj.JobId == "" {
-		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
+	req := NewRequests(obj.FromDomain)
+
+	if err = req.load(db); err != nil {
+		return fmt.Errorf("while loading request for job '%s' : %v", obj.JobId, err)
+	} else if req.IsLocked() {
+		return fmt.Errorf("request id '%d' for domain '%s' (id: %d) is locked", req.Id, req.Domain.Name, req.Domain.Id)
 	}
 
-	if obj.Date.IsZero() {
-		obj.Date = time.Now()
+	req.merge(obj.Request)
+	obj.Request = req
+
+	if err = obj.Request.save(db); err != nil {
+		return fmt.Errorf("while saving Request for job '%s' : %v", obj.JobId, err)
 	}
 
-	fld := strings.SplitN(field_messages, ",", 2)
-	lst := strings.TrimSpace(fld[1])
+	return nil
+}
 
-	res, err = GetDbCli().Exec(
-		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", obj.table, lst),
+// values return the values of the message row, in the order of the fields without the id
+func (obj *Messages) values() []interface{} {
+	return []interface{}{
 		obj.Date,
 		obj.JobId,
 		obj.Reporter.Id,
@@ -553,87 +645,74 @@ func (obj *Messages) Save() error {
 		obj.AlignDKIM,
 		obj.Request.Id,
 		obj.Sent,
-	)
-
-	if err != nil {
-		return err
-	}
-
-	row, err = res.RowsAffected()
-
-	if err != nil {
-		return err
-	}
-
-	if row != 0 {
-
-		nbr, err = res.LastInsertId()
-
-		if err != nil {
-			return err
-		}
-
-		obj.Id = int(nbr)
-		DebugLevel.Logf("Added %d row into table %s : %s (id: %d)", row, obj.table, obj.JobId, obj.Id)
+		obj.ToDomain.Id,
+		obj.Reason,
+		obj.ReasonComment,
+		obj.SPFScope,
+		obj.SPFDomain.Id,
+		obj.ARC,
+		obj.ARCPolicy,
+		obj.ARCSeals,
+		obj.Missing,
 	}
-
-	return nil
 }
 
 func (obj *Messages) Update() error {
-	var (
-		res sql.Result
-		row int64
-		err error
-	)
+	var err error
 
 	if obj.Id == 0 {
 		return obj.Save()
 	}
 
-	if obj.JobId == "" {
-		return fmt.Errorf("cannot update an empty row into table %s", obj.table)
-	}
-
-	if obj.Date.IsZero() {
-		obj.Date = time.Now()
-	}
-
 	if obj.Reporter != nil && obj.Reporter.Id == 0 {
-		err = obj.Reporter.Save()
+		err = obj.Reporter.Resolve()
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Reporter for job '%s'", obj.JobId), err)
 	} else if obj.Reporter == nil {
 		obj.Reporter = NewReporters("")
 	}
 
 	if obj.Ip != nil && obj.Ip.Id == 0 {
-		err = obj.Ip.Save()
+		err = obj.Ip.Resolve()
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Ip for job '%s'", obj.JobId), err)
 	} else if obj.Ip == nil {
 		obj.Ip = NewIpAddr("")
 	}
 
 	if obj.FromDomain != nil && obj.FromDomain.Id == 0 {
-		err = obj.FromDomain.Save()
+		err = obj.FromDomain.Resolve()
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving From Domain for job '%s'", obj.JobId), err)
 	} else if obj.FromDomain == nil {
 		obj.FromDomain = NewDomain("")
 	}
 
 	if obj.EnvDomain != nil && obj.EnvDomain.Id == 0 {
-		err = obj.EnvDomain.Save()
+		err = obj.EnvDomain.Resolve()
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Env Domain for job '%s'", obj.JobId), err)
 	} else if obj.EnvDomain == nil {
 		obj.EnvDomain = NewDomain("")
 	}
 
 	if obj.PolicyDomain != nil && obj.PolicyDomain.Id == 0 {
-		err = obj.PolicyDomain.Save()
+		err = obj.PolicyDomain.Resolve()
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Policy Domain for job '%s'", obj.JobId), err)
 	} else if obj.PolicyDomain == nil {
 		obj.PolicyDomain = NewDomain("")
 	}
 
+	if obj.ToDomain != nil && obj.ToDomain.Id == 0 && obj.ToDomain.Name != "" {
+		err = obj.ToDomain.Resolve()
+		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Envelope To Domain for job '%s'", obj.JobId), err)
+	} else if obj.ToDomain == nil {
+		obj.ToDomain = NewDomain("")
+	}
+
+	if obj.SPFDomain != nil && obj.SPFDomain.Id == 0 && obj.SPFDomain.Name != "" {
+		err = obj.SPFDomain.Resolve()
+		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving SPF Domain for job '%s'", obj.JobId), err)
+	} else if obj.SPFDomain == nil {
+		obj.SPFDomain = NewDomain("")
+	}
+
 	if obj.Request != nil && obj.Request.Id == 0 {
 		req := NewRequests(obj.FromDomain)
 		err = req.Load()
@@ -643,31 +722,7 @@ func (obj *Messages) Update() error {
 			return fmt.Errorf("request id '%d' for domain '%s' (id: %d) is locked", req.Id, req.Domain.Name, req.Domain.Id)
 		}
 
-		req.Repuri = tools.CleanJoin(tools.UnicSliceString(tools.CleanMergeSlice(strings.Split(req.Repuri, ","), strings.Split(obj.Request.Repuri, ",")...)), ",")
-		if !obj.Request.Date.IsZero() {
-			req.SetDateTime(obj.Request.Date)
-		}
-
-		if obj.Request.Pct != 0 {
-			req.Pct = obj.Request.Pct
-		}
-
-		if obj.Request.Policy != 0 {
-			req.Policy = obj.Request.Policy
-		}
-
-		if obj.Request.Spolicy != 0 {
-			req.Spolicy = obj.Request.Spolicy
-		}
-
-		if obj.Request.ADKIM != 0 {
-			req.ADKIM = obj.Request.ADKIM
-		}
-
-		if obj.Request.ASPF != 0 {
-			req.ASPF = obj.Request.ASPF
-		}
-
+		req.merge(obj.Request)
 		obj.Request = req
 		err = obj.Request.Save()
 		FatalLevel.LogErrorCtx(NilLevel, fmt.Sprintf("while saving Request for job '%s'", obj.JobId), err)
@@ -676,6 +731,24 @@ func (obj *Messages) Update() error {
 		obj.Load()
 	}
 
+	return obj.update(GetDbCli())
+}
+
+func (obj *Messages) update(db dbExec) error {
+	var (
+		res sql.Result
+		row int64
+		err error
+	)
+
+	if obj.JobId == "" {
+		return fmt.Errorf("cannot update an empty row into table %s", obj.table)
+	}
+
+	if obj.Date.IsZero() {
+		obj.Date = time.Now()
+	}
+
 	sql := fmt.Sprintf("UPDATE `%s` SET `date` = ?, `jobid` = ?", obj.table)
 	arg := []interface{}{obj.Date, obj.JobId}
 
@@ -739,11 +812,42 @@ func (obj *Messages) Update() error {
 		arg = append(arg, obj.Request.Id)
 	}
 
-	sql = sql + ", `sent` = ? "
-	arg = append(arg, obj.Sent)
+	if obj.ToDomain.Id != 0 {
+		sql = sql + ", `to_domain` = ? "
+		arg = append(arg, obj.ToDomain.Id)
+	}
+
+	if obj.Reason != "" {
+		sql = sql + ", `reason` = ?, `reason_comment` = ? "
+		arg = append(arg, obj.Reason, obj.ReasonComment)
+	}
+
+	if obj.SPFScope != "" {
+		sql = sql + ", `spf_scope` = ? "
+		arg = append(arg, obj.SPFScope)
+	}
+
+	if obj.SPFDomain.Id != 0 {
+		sql = sql + ", `spf_domain` = ? "
+		arg = append(arg, obj.SPFDomain.Id)
+	}
+
+	if obj.ARC != 0 {
+		sql = sql + ", `arc` = ? "
+		arg = append(arg, obj.ARC)
+	}
+
+	if obj.ARCSeals != "" {
+		sql = sql + ", `arc_policy` = ?, `arc_seals` = ? "
+		arg = append(arg, obj.ARCPolicy, obj.ARCSeals)
+	}
+
+	// a message imported again from its history file has no more missing values
+	sql = sql + ", `sent` = ?, `missing` = ? "
+	arg = append(arg, obj.Sent, obj.Missing)
 
 	arg = append(arg, obj.Id)
-	res, err = GetDbCli().Exec(sql+" WHERE `id`=? LIMIT 1", arg...)
+	res, err = db.Exec(sql+" WHERE `id`=? LIMIT 1", arg...)
 
 	if err != nil {
 		return err
@@ -790,11 +894,7 @@ func (obj *Messages) SetReporter(reporter string) error {
 
 	sub = NewReporters(reporter)
 
-	if err = sub.Load(); err != nil {
-		return err
-	}
-
-	if err = sub.Save(); err != nil {
+	if err = sub.Resolve(); err != nil {
 		return err
 	}
 
@@ -810,11 +910,7 @@ func (obj *Messages) SetIpAddr(ipaddr string) error {
 
 	sub = NewIpAddr(ipaddr)
 
-	if err = sub.Load(); err != nil {
-		return err
-	}
-
-	if err = sub.Save(); err != nil {
+	if err = sub.Resolve(); err != nil {
 		return err
 	}
 
@@ -830,11 +926,7 @@ func (obj *Messages) SetFromDomain(fromDomain string) error {
 
 	sub = NewDomain(fromDomain)
 
-	if err = sub.Load(); err != nil {
-		return err
-	}
-
-	if err = sub.Save(); err != nil {
+	if err = sub.Resolve(); err != nil {
 		return err
 	}
 
@@ -850,11 +942,7 @@ func (obj *Messages) SetEnvDomain(envDomain string) error {
 
 	sub = NewDomain(envDomain)
 
-	if err = sub.Load(); err != nil {
-		return err
-	}
-
-	if err = sub.Save(); err != nil {
+	if err = sub.Resolve(); err != nil {
 		return err
 	}
 
@@ -870,15 +958,76 @@ func (obj *Messages) SetPolicyDomain(polDomain string) error {
 
 	sub = NewDomain(polDomain)
 
-	if err = sub.Load(); err != nil {
+	if err = sub.Resolve(); err != nil {
 		return err
 	}
 
-	if err = sub.Save(); err != nil {
+	obj.PolicyDomain = sub
+	return nil
+}
+
+func (obj *Messages) SetToDomain(toDomain string) error {
+	var (
+		sub *Domain
+		err error
+	)
+
+	sub = NewDomain(toDomain)
+
+	if err = sub.Resolve(); err != nil {
 		return err
 	}
 
-	obj.PolicyDomain = sub
+	obj.ToDomain = sub
+	return nil
+}
+
+func (obj *Messages) SetSPFDomain(spfDomain string) error {
+	var (
+		sub *Domain
+		err error
+	)
+
+	sub = NewDomain(spfDomain)
+
+	if err = sub.Resolve(); err != nil {
+		return err
+	}
+
+	obj.SPFDomain = sub
+	return nil
+}
+
+// SetReason set the policy override reason from a string formatted as "<type> [<comment>]"
+func (obj *Messages) SetReason(reason string) error {
+	var p = strings.SplitN(strings.TrimSpace(reason), " ", 2)
+
+	switch strings.ToLower(p[0]) {
+	case "forwarded", "sampled_out", "trusted_forwarder", "mailing_list", "local_policy", "other":
+		obj.Reason = strings.ToLower(p[0])
+	default:
+		return fmt.Errorf("policy override reason '%s' not understand", p[0])
+	}
+
+	if len(p) > 1 {
+		obj.ReasonComment = strings.TrimSpace(p[1])
+	} else {
+		obj.ReasonComment = ""
+	}
+
+	return nil
+}
+
+func (obj *Messages) SetSPFScope(scope string) error {
+	switch strings.ToLower(strings.TrimSpace(scope)) {
+	case "helo":
+		obj.SPFScope = "helo"
+	case "mfrom":
+		obj.SPFScope = "mfrom"
+	default:
+		return fmt.Errorf("spf scope '%s' not understand", scope)
+	}
+
 	return nil
 }
 
@@ -910,11 +1059,84 @@ func (obj Messages) GetReport() (report.ReportRecord, error) {
 		return report.ReportRecord{}, err
 	}
 
-	return report.GetReportRecord(obj.Ip.Name, obj.GetDisp(), obj.GetAlignDKIM(), obj.GetAlignSPF(), obj.FromDomain.Name, obj.EnvDomain.Name, obj.GetSPF(), 1, lst), nil
+	rec := report.GetReportRecord(obj.Ip.Name, obj.GetDisp(), obj.GetAlignDKIM(), obj.GetAlignSPF(), obj.FromDomain.Name, obj.EnvDomain.Name, obj.GetSPF(), 1, lst)
+
+	if obj.ToDomain != nil {
+		rec.SetEnvelopeTo(obj.ToDomain.Name)
+	}
+
+	if obj.SPFDomain != nil {
+		rec.SetSPFDomain(obj.SPFDomain.Name)
+	}
+
+	rec.SetSPFScope(obj.SPFScope)
+	rec.AddReason(obj.Reason, obj.ReasonComment)
+	obj.addARCReason(&rec)
+
+	return rec, nil
+}
+
+// addARCReason add the local_policy reason of a message accepted by the arc policy,
+// with the result of the chain and the domain and selector of each seal
+func (obj *Messages) addARCReason(rec *report.ReportRecord) {
+	if obj.ARCSeals == "" || obj.ARCPolicy != 0 {
+		return
+	}
+
+	lst, err := history.ParseARCSeals(obj.ARCSeals)
+	if WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("decoding arc seals of job '%s'", obj.JobId), err) {
+		return
+	}
+
+	sort.Slice(lst, func(i, j int) bool {
+		return lst[i].Instance > lst[j].Instance
+	})
+
+	var cmt = []string{"arc=" + getResult(obj.ARC)}
+
+	for _, s := range lst {
+		cmt = append(cmt, fmt.Sprintf("as[%d].d=%s", s.Instance, s.Domain), fmt.Sprintf("as[%d].s=%s", s.Instance, s.Selector))
+
+		if s.Ip != "" {
+			cmt = append(cmt, fmt.Sprintf("as[%d].ip=%s", s.Instance, s.Ip))
+		}
+	}
+
+	rec.AddReason("local_policy", strings.Join(cmt, " "))
 }
 
+// SetARCPolicy set the arc policy result and the json list of evaluated seals
+func (obj *Messages) SetARCPolicy(result int, seals []history.ARCSeal) error {
+	js, err := json.Marshal(seals)
+	if err != nil {
+		return err
+	} else if len(js) > 1024 {
+		return fmt.Errorf("arc seals of job '%s' too long (%d bytes)", obj.JobId, len(js))
+	}
+
+	obj.ARCPolicy = result
+	obj.ARCSeals = string(js)
+
+	return nil
+}
+
+// CodeUnknown is the result or disposition code stored for a value that cannot be read, reported as "unknown"
+const CodeUnknown = 255
+
+// codes of the names of the getters, as written by opendmarc
+var (
+	codesDisposition = []int{0, 1, 2, 4}
+	codesResult      = []int{0, 2, 3, 4, 5, 6, 7, 8, 9, 10, 12}
+	codesAlignment   = []int{4, 5}
+)
+
 func (obj *Messages) GetDisp() string {
-	switch obj.Disp {
+	return getDisposition(obj.Disp)
+}
+
+// getDisposition return the name of a disposition code
+func getDisposition(code int) string {
+	switch code {
 	case 0:
 		return "reject"
 	case 1:
@@ -930,7 +1152,20 @@ func (obj *Messages) GetDisp() string {
 }
 
 func (obj *Messages) GetSPF() string {
-	switch obj.SPF {
+	return getResult(obj.SPF)
+}
+
+func (obj *Messages) GetARC() string {
+	return getResult(obj.ARC)
+}
+
+func (obj *Messages) GetARCPolicy() string {
+	return getResult(obj.ARCPolicy)
+}
+
+// getResult return the name of an authentication result code
+func getResult(code int) string {
+	switch code {
 	case 0:
 		return "pass"
 	case 2:
@@ -960,25 +1195,21 @@ func (obj *Messages) GetSPF() string {
 }
 
 func (obj *Messages) GetAlignDKIM() string {
-	switch obj.AlignDKIM {
-	case 4:
-		return "pass"
-	case 5:
-		return "fail"
-	default:
-		return "unknown"
-
-	}
+	return getAlignment(obj.AlignDKIM)
 }
 
 func (obj *Messages) GetAlignSPF() string {
-	switch obj.AlignSPF {
+	return getAlignment(obj.AlignSPF)
+}
+
+// getAlignment return the name of an alignment result code
+func getAlignment(code int) string {
+	switch code {
 	case 4:
 		return "pass"
 	case 5:
 		return "fail"
 	default:
 		return "unknown"
-
 	}
 }
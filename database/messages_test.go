@@ -0,0 +1,95 @@
+package database
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nabbar/opendmarc-reports/history"
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestMessagesCodeUnknown(t *testing.T) {
+	msg := Messages{SPF: CodeUnknown, Disp: CodeUnknown}
+
+	if res := msg.GetSPF(); res != "unknown" {
+		t.Errorf("got spf '%s', want 'unknown'", res)
+	}
+
+	if res := msg.GetDisp(); res != "unknown" {
+		t.Errorf("got disposition '%s', want 'unknown'", res)
+	}
+
+	// the zero values are valid results, a bad value must not be stored with them
+	if msg = (Messages{}); msg.GetSPF() != "pass" || msg.GetDisp() != "reject" {
+		t.Errorf("got spf '%s' and disposition '%s' for the zero values", msg.GetSPF(), msg.GetDisp())
+	}
+}
+
+// OpenDMARC logs only its result and the spf result, the alignments of the jobs rebuilt from syslog
+// must be reported with values of the schema, as the import save them
+func TestMessagesSyslogRecord(t *testing.T) {
+	const txt = `2026-10-17T06:10:02+02:00 mx2 opendmarc[811]: 5C2A81E0F3: SPF(mailfrom): bounce@example.com pass
+2026-10-17T06:10:02+02:00 mx2 opendmarc[811]: 5C2A81E0F3: example.com pass
+2026-10-17T06:10:03+02:00 mx2 opendmarc[811]: 6D3B92F1A4: SPF(mailfrom): bounce@mailer.example pass
+2026-10-17T06:10:03+02:00 mx2 opendmarc[811]: 6D3B92F1A4: example.com pass
+2026-10-17T06:10:04+02:00 mx2 opendmarc[811]: 7E4CA302B5: example.com pass
+2026-10-17T06:10:05+02:00 mx2 opendmarc[811]: 8F5DB413C6: SPF(mailfrom): bounce@bad.example fail
+2026-10-17T06:10:05+02:00 mx2 opendmarc[811]: 8F5DB413C6: example.com reject
+`
+
+	var (
+		rdr = history.NewSyslogReader(strings.NewReader(txt))
+		lst = make([]report.ReportRecord, 0)
+		// dkim and spf alignment reported for each job
+		exp = [][2]string{{"fail", "pass"}, {"pass", "fail"}, {"pass", "fail"}, {"fail", "fail"}}
+	)
+
+	for {
+		h, err := rdr.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		msg := Messages{SPF: h.SPF, Disp: h.Action, AlignDKIM: h.AlignDKIM, AlignSPF: h.AlignSPF}
+
+		if i := len(lst); i < len(exp) && (msg.GetAlignDKIM() != exp[i][0] || msg.GetAlignSPF() != exp[i][1]) {
+			t.Errorf("job '%s': got dkim '%s' spf '%s', want %v", h.JobId, msg.GetAlignDKIM(), msg.GetAlignSPF(), exp[i])
+		}
+
+		lst = append(lst, report.GetReportRecord("192.0.2.1", msg.GetDisp(), msg.GetAlignDKIM(), msg.GetAlignSPF(), h.From, h.MFrom, msg.GetSPF(), 1, nil))
+	}
+
+	if len(lst) != len(exp) {
+		t.Fatalf("got %d jobs, want %d", len(lst), len(exp))
+	}
+
+	rep := report.GetReport("mailto:dmarc@example.com", report.GetReportMetadata("Example", "dmarc@example.org", "", "example.com-1", 0, 1), report.GetReportPolicy("example.com", "r", "r", "reject", "", 100, ""), report.CompressNone, lst)
+	defer rep.Close()
+
+	if err := rep.WriteXml(bytes.NewBuffer(nil), report.RFC7489, true); err != nil {
+		t.Fatal(err)
+	} else if rep.GetRecordCount() != len(lst) {
+		t.Errorf("got %d records into the report, want %d", rep.GetRecordCount(), len(lst))
+	}
+}
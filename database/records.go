@@ -0,0 +1,317 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+type recordCursor struct {
+	rows *sql.Rows
+	rec  report.ReportRecord
+	err  error
+}
+
+// recordColumn is a grouped column of the records query, a column without name is grouped by its expression
+type recordColumn struct {
+	expr string
+	name string
+}
+
+// recordKey is the value of each grouped column of a record, in the order of recordColumns
+type recordKey []interface{}
+
+// recordColumns return the grouped columns of the records query, in the scan order of the cursor.
+// The codes are grouped by their name (ex: disp 0 & 1 are reject), so each group is only one record.
+func recordColumns() []recordColumn {
+	pss := sqlCode("`s`.`pass`", getResult, codesResult...)
+	dkm := fmt.Sprintf("SELECT GROUP_CONCAT(CONCAT_WS(CHAR(9), IFNULL(`d`.`name`, ''), `s`.`selector`, %s, `s`.`human_result`) ORDER BY `d`.`name`, `s`.`selector`, %s SEPARATOR '\\n') FROM `%s` AS `s`", pss, pss, table_signatures) +
+		fmt.Sprintf(" LEFT JOIN `%s` AS `d` ON `d`.`id` = `s`.`domain` WHERE `s`.`message` = `m`.`id`", table_domains)
+
+	// the aliases of the codes are not column names of messages, as the group by search the columns first
+	return []recordColumn{
+		{"IFNULL(`i`.`name`, '')", "ip"},
+		{sqlCode("`m`.`disp`", getDisposition, codesDisposition...), "c_disp"},
+		{sqlCode("`m`.`align_dkim`", getAlignment, codesAlignment...), "c_align_dkim"},
+		{sqlCode("`m`.`align_spf`", getAlignment, codesAlignment...), "c_align_spf"},
+		{"`m`.`reason`", ""},
+		{"`m`.`reason_comment`", ""},
+		{"IFNULL(`t`.`name`, '')", "to"},
+		{"IFNULL(`f`.`name`, '')", "from"},
+		{"IFNULL(`e`.`name`, '')", "env"},
+		{"`m`.`spf_scope`", ""},
+		{sqlCode("`m`.`spf`", getResult, codesResult...), "c_spf"},
+		{"IFNULL(`sd`.`name`, '')", "spf_domain"},
+		{sqlCode("`m`.`arc`", getResult, codesResult...), "c_arc"},
+		{sqlCode("`m`.`arc_policy`", getResult, codesResult...), "c_arc_policy"},
+		{"`m`.`arc_seals`", ""},
+		{"IFNULL((" + dkm + "), '')", "dkim"},
+	}
+}
+
+// recordFrom return the messages table joined with the ip and domains names of the records query
+func recordFrom() string {
+	return fmt.Sprintf(" FROM `%s` AS `m`", table_messages) +
+		fmt.Sprintf(" LEFT JOIN `%s` AS `i` ON `i`.`id` = `m`.`ip`", table_ipaddr) +
+		fmt.Sprintf(" LEFT JOIN `%s` AS `t` ON `t`.`id` = `m`.`to_domain`", table_domains) +
+		fmt.Sprintf(" LEFT JOIN `%s` AS `f` ON `f`.`id` = `m`.`from_domain`", table_domains) +
+		fmt.Sprintf(" LEFT JOIN `%s` AS `e` ON `e`.`id` = `m`.`env_domain`", table_domains) +
+		fmt.Sprintf(" LEFT JOIN `%s` AS `sd` ON `sd`.`id` = `m`.`spf_domain`", table_domains)
+}
+
+// GetReportRecords return a source of report records for a request. Each cursor run one query
+// joining messages, ip, domains and signatures, already grouped and counted by the database
+// and sorted by group, so the records are streamed without any per message round-trip.
+// Each record carry the key of its group, to find again the messages of a record dropped from the report.
+func GetReportRecords(request *Requests, window Window) report.RecordSource {
+	return func() (report.RecordCursor, error) {
+		var (
+			rows *sql.Rows
+			err  error
+			sel  = make([]string, 0)
+			grp  = make([]string, 0)
+		)
+
+		whr, arg := window.where("m")
+
+		for _, c := range recordColumns() {
+			if c.name == "" {
+				sel = append(sel, c.expr)
+				grp = append(grp, c.expr)
+			} else {
+				sel = append(sel, c.expr+" AS `"+c.name+"`")
+				grp = append(grp, "`"+c.name+"`")
+			}
+		}
+
+		qry := "SELECT " + strings.Join(sel, ", ") + ", COUNT(*) AS `count`" + recordFrom() +
+			" WHERE `m`.`request_id`=? AND " + whr +
+			" GROUP BY " + strings.Join(grp, ", ") +
+			" ORDER BY " + strings.Join(grp, ", ")
+
+		if rows, err = GetDbCli().Query(qry, append([]interface{}{request.Id}, arg...)...); err != nil {
+			return nil, err
+		} else if err = rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		DebugLevel.Logf("Open records cursor into table %s for request '%s' (id: %d)", table_messages, request.Repuri, request.Id)
+
+		return report.NewAggregateCursor(&recordCursor{
+			rows: rows,
+		}), nil
+	}
+}
+
+// GetDroppedMessages return the id of the messages of the window grouped into the records dropped from the report,
+// found by the keys given back by the report. Those messages are left out of the sent and queued updates.
+func GetDroppedMessages(request *Requests, window Window, keys []interface{}) ([]int64, error) {
+	var (
+		res = make([]int64, 0)
+		col = recordColumns()
+		cnd = make([]string, 0, len(col))
+	)
+
+	whr, arg := window.where("m")
+
+	for _, c := range col {
+		cnd = append(cnd, c.expr+" <=> ?")
+	}
+
+	qry := "SELECT `m`.`id`" + recordFrom() + " WHERE `m`.`request_id`=? AND " + whr + " AND " + strings.Join(cnd, " AND ")
+
+	for _, k := range keys {
+		key, ok := k.(recordKey)
+
+		if !ok || len(key) != len(col) {
+			return res, fmt.Errorf("invalid key of dropped record for request '%s' (id: %d)", request.Repuri, request.Id)
+		}
+
+		rows, err := GetDbCli().Query(qry, append(append([]interface{}{request.Id}, arg...), key...)...)
+		if err != nil {
+			return res, err
+		}
+
+		for rows.Next() {
+			var id int64
+
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return res, err
+			}
+
+			res = append(res, id)
+		}
+
+		err = rows.Err()
+		rows.Close()
+
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+func (cur *recordCursor) Next() bool {
+	if cur.err != nil || !cur.rows.Next() {
+		return false
+	}
+
+	var (
+		msg Messages
+		ipa string
+		tod string
+		frm string
+		env string
+		spd string
+		dkm string
+		nbr int
+	)
+
+	if cur.err = cur.rows.Scan(&ipa, &msg.Disp, &msg.AlignDKIM, &msg.AlignSPF, &msg.Reason, &msg.ReasonComment, &tod, &frm, &env, &msg.SPFScope, &msg.SPF, &spd, &msg.ARC, &msg.ARCPolicy, &msg.ARCSeals, &dkm, &nbr); cur.err != nil {
+		return false
+	}
+
+	cur.rec = report.GetReportRecord(ipa, msg.GetDisp(), msg.GetAlignDKIM(), msg.GetAlignSPF(), frm, env, msg.GetSPF(), nbr, parseRecordSignatures(dkm))
+	cur.rec.SetEnvelopeTo(tod)
+	cur.rec.SetSPFDomain(spd)
+	cur.rec.SetSPFScope(msg.SPFScope)
+	cur.rec.AddReason(msg.Reason, msg.ReasonComment)
+	msg.addARCReason(&cur.rec)
+	cur.rec.SetKey(recordKey{ipa, msg.Disp, msg.AlignDKIM, msg.AlignSPF, msg.Reason, msg.ReasonComment, tod, frm, env, msg.SPFScope, msg.SPF, spd, msg.ARC, msg.ARCPolicy, msg.ARCSeals, dkm})
+
+	return true
+}
+
+func (cur *recordCursor) Record() report.ReportRecord {
+	return cur.rec
+}
+
+func (cur *recordCursor) Err() error {
+	if cur.err != nil {
+		return cur.err
+	}
+
+	return cur.rows.Err()
+}
+
+func (cur *recordCursor) Close() error {
+	return cur.rows.Close()
+}
+
+// sqlCode return a sql expression of the column giving one code by name : the codes with the same name
+// are replaced by the first one, and the codes without name by CodeUnknown
+func sqlCode(col string, name func(int) string, codes ...int) string {
+	var (
+		lst = make([]string, 0)
+		grp = make(map[string][]string)
+		res = "CASE"
+	)
+
+	for _, c := range codes {
+		n := name(c)
+
+		if _, ok := grp[n]; !ok {
+			lst = append(lst, n)
+		}
+
+		grp[n] = append(grp[n], strconv.Itoa(c))
+	}
+
+	for _, n := range lst {
+		res += fmt.Sprintf(" WHEN %s IN (%s) THEN %s", col, strings.Join(grp[n], ", "), grp[n][0])
+	}
+
+	return res + fmt.Sprintf(" ELSE %d END", CodeUnknown)
+}
+
+// parseRecordSignatures decode the list of "<domain>\t<selector>\t<pass>\t<human result>" lines build by the records query
+func parseRecordSignatures(str string) []report.ReportDKIM {
+	var res = make([]report.ReportDKIM, 0)
+
+	for _, s := range strings.Split(str, "\n") {
+		if s == "" {
+			continue
+		}
+
+		var (
+			sig Signatures
+			p   = strings.SplitN(s, "\t", 4)
+		)
+
+		if len(p) != 4 {
+			continue
+		}
+
+		if val, err := strconv.Atoi(p[2]); err == nil {
+			sig.Pass = val
+		}
+
+		res = append(res, report.GetReportDKIM(p[0], p[1], sig.GetPass(), p[3]))
+	}
+
+	return res
+}
+
+// SetSentWindow update the sent flag of all messages of a request included into the window with one query.
+// The window must be the pinned one of the report, so only the messages written by its cursor are updated.
+func SetSentWindow(request *Requests, window Window, sent bool) error {
+	whr, arg := window.where("")
+
+	res, err := GetDbCli().Exec(fmt.Sprintf("UPDATE `%s` SET `sent` = ?, `queued` = 0 WHERE `request_id`=? AND %s", table_messages, whr), append([]interface{}{sent, request.Id}, arg...)...)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err := res.RowsAffected(); err != nil {
+		return err
+	} else if row != 0 {
+		DebugLevel.Logf("Updated %d row into table %s for request '%s' (id: %d) : sent = %v", row, table_messages, request.Repuri, request.Id, sent)
+	}
+
+	return nil
+}
+
+// SetQueuedWindow update the queued flag of all messages of a request included into the window.
+// Queued messages wait for a delivery of the retry queue and are not included into a new report.
+func SetQueuedWindow(request *Requests, window Window, queued bool) error {
+	whr, arg := window.where("")
+
+	res, err := GetDbCli().Exec(fmt.Sprintf("UPDATE `%s` SET `queued` = ? WHERE `request_id`=? AND %s", table_messages, whr), append([]interface{}{queued, request.Id}, arg...)...)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err := res.RowsAffected(); err != nil {
+		return err
+	} else if row != 0 {
+		DebugLevel.Logf("Updated %d row into table %s for request '%s' (id: %d) : queued = %v", row, table_messages, request.Repuri, request.Id, queued)
+	}
+
+	return nil
+}
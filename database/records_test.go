@@ -0,0 +1,70 @@
+package database
+
+import (
+	"testing"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestSqlCode(t *testing.T) {
+	tst := []struct {
+		col string
+		get func(int) string
+		cod []int
+		exp string
+	}{
+		{"`disp`", getDisposition, codesDisposition, "CASE WHEN `disp` IN (0, 1) THEN 0 WHEN `disp` IN (2) THEN 2 WHEN `disp` IN (4) THEN 4 ELSE 255 END"},
+		{"`align`", getAlignment, codesAlignment, "CASE WHEN `align` IN (4) THEN 4 WHEN `align` IN (5) THEN 5 ELSE 255 END"},
+	}
+
+	for _, tc := range tst {
+		if res := sqlCode(tc.col, tc.get, tc.cod...); res != tc.exp {
+			t.Errorf("%s: got %q, want %q", tc.col, res, tc.exp)
+		}
+	}
+}
+
+func TestCodesNames(t *testing.T) {
+	tst := []struct {
+		nam string
+		get func(int) string
+		cod []int
+	}{
+		{"disposition", getDisposition, codesDisposition},
+		{"result", getResult, codesResult},
+		{"alignment", getAlignment, codesAlignment},
+	}
+
+	// the codes out of the lists are grouped as unknown, they must have no other name
+	for _, tc := range tst {
+		var lst = make(map[int]bool)
+
+		for _, c := range tc.cod {
+			lst[c] = true
+
+			if tc.get(c) == "unknown" {
+				t.Errorf("%s: code %d listed without name", tc.nam, c)
+			}
+		}
+
+		for c := 0; c < 256; c++ {
+			if !lst[c] && tc.get(c) != "unknown" {
+				t.Errorf("%s: code %d named '%s' but not listed", tc.nam, c, tc.get(c))
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const table_report_destinations = "report_destinations"
+const field_report_destinations = "`id`, `date`, `report`, `report_id`, `uri`, `receiver`, `transport`, `format`, `compression`, `file`, `size`, `hash`, `status`, `error`"
+
+// ReportDestinations is the result of sending a report to one rua destination.
+// ReportId differ from the parent report id when the report was split for the destination size limit.
+type ReportDestinations struct {
+	Generic
+
+	Report      *Reports
+	ReportId    string
+	Uri         string
+	Receiver    string
+	Transport   string
+	Format      string
+	Compression string
+	File        string
+	Size        int64
+	Hash        string
+	Status      string
+	Error       string
+}
+
+func NewReportDestinations(rep *Reports) *ReportDestinations {
+	obj := &ReportDestinations{
+		Generic: Generic{
+			table: table_report_destinations,
+			fctField: func() FieldList {
+				return FieldList{
+					"id":          "int(11) NOT NULL AUTO_INCREMENT",
+					"date":        "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
+					"report":      "int(10) unsigned NOT NULL DEFAULT '0'",
+					"report_id":   "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"uri":         "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"receiver":    "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"transport":   "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"format":      "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"compression": "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"file":        "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"size":        "bigint(20) unsigned NOT NULL DEFAULT '0'",
+					"hash":        "char(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"status":      "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"error":       "text COLLATE utf8mb4_unicode_ci",
+				}
+			},
+			fctIndex: func() IndexList {
+				return IndexList{
+					"PRIMARY":  {"type": "PRIMARY", "fields": "id"},
+					"report":   {"type": "INDEX", "fields": "report"},
+					"receiver": {"type": "INDEX", "fields": "receiver,date"},
+				}
+			},
+		},
+		Report: rep,
+	}
+
+	if obj.Report == nil {
+		obj.Report = NewReports(nil)
+	}
+
+	return obj
+}
+
+// SetDelivery fill the row with the result of sending the report to one destination
+func (obj *ReportDestinations) SetDelivery(dlv report.Delivery) {
+	obj.Date = dlv.Date
+	obj.ReportId = dlv.ReportId
+	obj.Uri = dlv.Destination.Uri
+	obj.Receiver = dlv.Destination.Host
+	obj.Transport = dlv.Destination.Scheme
+	obj.Format = dlv.Destination.Format.String()
+	obj.Compression = dlv.Destination.Compression.String()
+	obj.File = dlv.FileName
+	obj.Size = dlv.Size
+	obj.Hash = dlv.Hash
+	obj.Status = dlv.Status
+
+	if dlv.Error != nil {
+		obj.Error = dlv.Error.Error()
+	}
+}
+
+func (obj *ReportDestinations) Save() error {
+	var (
+		res sql.Result
+		row int64
+		nbr int64
+		err error
+	)
+
+	if obj.Id != 0 {
+		return fmt.Errorf("cannot update an history row into table %s", obj.table)
+	}
+
+	if obj.Report.Id == 0 {
+		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
+	}
+
+	fld := strings.SplitN(field_report_destinations, ",", 2)
+	lst := strings.TrimSpace(fld[1])
+
+	res, err = GetDbCli().Exec(
+		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(%s)", obj.table, lst, placeholders(13)),
+		obj.Date,
+		obj.Report.Id,
+		obj.ReportId,
+		obj.Uri,
+		obj.Receiver,
+		obj.Transport,
+		obj.Format,
+		obj.Compression,
+		obj.File,
+		obj.Size,
+		obj.Hash,
+		obj.Status,
+		obj.Error,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	if row != 0 {
+		if nbr, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		obj.Id = int(nbr)
+		DebugLevel.Logf("Added %d row into table %s : %s / %s (id: %d)", row, obj.table, obj.Uri, obj.Status, obj.Id)
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const table_reports = "reports"
+const field_reports = "`id`, `date`, `report_id`, `request_id`, `domain`, `date_begin`, `date_end`, `records`, `messages`, `dropped`, `xml_size`, `zip_size`, `hash`, `window_until`, `window_last_id`"
+
+// Reports is the history of each generated report, the file sizes and hash are the ones of the first rua destination
+type Reports struct {
+	Generic
+
+	ReportId  string
+	Request   *Requests
+	Domain    *Domain
+	DateBegin time.Time
+	DateEnd   time.Time
+	Records   int
+	Messages  int
+	Dropped   int
+	XmlSize   int64
+	ZipSize   int64
+	Hash      string
+
+	// Until is the upper date bound of the messages window of the report
+	Until time.Time
+	// LastId is the highest message id of the window, to find again the exact messages of the report
+	LastId int64
+}
+
+func NewReports(request *Requests) *Reports {
+	obj := &Reports{
+		Generic: Generic{
+			table: table_reports,
+			fctField: func() FieldList {
+				return FieldList{
+					"id":             "int(11) NOT NULL AUTO_INCREMENT",
+					"date":           "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
+					"report_id":      "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"request_id":     "int(10) unsigned NOT NULL DEFAULT '0'",
+					"domain":         "int(10) unsigned NOT NULL DEFAULT '0'",
+					"date_begin":     "timestamp NULL DEFAULT NULL",
+					"date_end":       "timestamp NULL DEFAULT NULL",
+					"records":        "int(10) unsigned NOT NULL DEFAULT '0'",
+					"messages":       "int(10) unsigned NOT NULL DEFAULT '0'",
+					"dropped":        "int(10) unsigned NOT NULL DEFAULT '0'",
+					"xml_size":       "bigint(20) unsigned NOT NULL DEFAULT '0'",
+					"zip_size":       "bigint(20) unsigned NOT NULL DEFAULT '0'",
+					"hash":           "char(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"window_until":   "timestamp NULL DEFAULT NULL",
+					"window_last_id": "bigint(20) NOT NULL DEFAULT '0'",
+				}
+			},
+			fctIndex: func() IndexList {
+				return IndexList{
+					"PRIMARY":   {"type": "PRIMARY", "fields": "id"},
+					"report_id": {"type": "UNIQUE", "fields": "report_id"},
+					"domain":    {"type": "INDEX", "fields": "domain,date_begin,date_end"},
+				}
+			},
+		},
+	}
+
+	if request != nil {
+		obj.Request = request
+		obj.Domain = request.Domain
+	} else {
+		obj.Request = NewRequests(nil)
+		obj.Domain = NewDomain("")
+	}
+
+	return obj
+}
+
+func GetReports(Id int) (*Reports, error) {
+	obj := NewReports(nil)
+
+	var err error
+
+	if Id != 0 {
+		obj.Id = Id
+		err = obj.Load()
+	}
+
+	return obj, err
+}
+
+func (obj *Reports) Load() error {
+	var (
+		rows *sql.Rows
+		err  error
+		req  int
+		dom  int
+		beg  *time.Time
+		end  *time.Time
+		unt  *time.Time
+	)
+
+	if obj.Id == 0 {
+		return fmt.Errorf("cannot load null row into table %s", obj.table)
+	}
+
+	if rows, err = GetDbCli().Query(fmt.Sprintf("SELECT %s FROM `%s` WHERE `id`=? LIMIT 1", field_reports, obj.table), obj.Id); err != nil {
+		return err
+	} else if err = rows.Err(); err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = rows.Scan(&obj.Id, &obj.Date, &obj.ReportId, &req, &dom, &beg, &end, &obj.Records, &obj.Messages, &obj.Dropped, &obj.XmlSize, &obj.ZipSize, &obj.Hash, &unt, &obj.LastId); err != nil {
+			return err
+		}
+
+		if beg != nil {
+			obj.DateBegin = *beg
+		}
+
+		if end != nil {
+			obj.DateEnd = *end
+		}
+
+		if unt != nil {
+			obj.Until = *unt
+		}
+
+		if req > 0 {
+			if obj.Request, err = GetRequests(req); err != nil {
+				return err
+			}
+		}
+
+		if dom > 0 {
+			if obj.Domain, err = GetDomain(dom); err != nil {
+				return err
+			}
+		}
+
+		DebugLevel.Logf("Find row into table %s : %s (id: %d)", obj.table, obj.ReportId, obj.Id)
+		break
+	}
+
+	return rows.Err()
+}
+
+func (obj *Reports) Save() error {
+	var (
+		res sql.Result
+		row int64
+		nbr int64
+		err error
+	)
+
+	if obj.Id != 0 {
+		return fmt.Errorf("cannot update an history row into table %s", obj.table)
+	}
+
+	if obj.ReportId == "" {
+		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
+	}
+
+	if obj.Date.IsZero() {
+		obj.Date = time.Now()
+	}
+
+	fld := strings.SplitN(field_reports, ",", 2)
+	lst := strings.TrimSpace(fld[1])
+
+	res, err = GetDbCli().Exec(
+		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(%s)", obj.table, lst, placeholders(14)),
+		obj.Date,
+		obj.ReportId,
+		obj.Request.Id,
+		obj.Domain.Id,
+		obj.DateBegin,
+		obj.DateEnd,
+		obj.Records,
+		obj.Messages,
+		obj.Dropped,
+		obj.XmlSize,
+		obj.ZipSize,
+		obj.Hash,
+		obj.Until,
+		obj.LastId,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	if row != 0 {
+		if nbr, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		obj.Id = int(nbr)
+		DebugLevel.Logf("Added %d row into table %s : %s (id: %d)", row, obj.table, obj.ReportId, obj.Id)
+	}
+
+	return nil
+}
+
+// SaveReport record the report sent for a request and the result of each of its destinations
+func SaveReport(request *Requests, window Window, rep report.Report, lst []report.Delivery) (*Reports, error) {
+	var (
+		obj      = NewReports(request)
+		beg, end = rep.GetDateRange()
+	)
+
+	obj.Until = window.Until
+	obj.LastId = window.LastId
+	obj.ReportId = rep.GetReportId()
+	obj.DateBegin = beg
+	obj.DateEnd = end
+	obj.Records = rep.GetRecordCount()
+	obj.Messages = rep.GetMessageCount()
+	obj.Dropped = rep.GetDroppedCount()
+
+	if dst := rep.GetDestinations(); len(dst) > 0 {
+		obj.XmlSize = rep.GetXmlSize(dst[0])
+		obj.ZipSize = rep.GetArchiveSize(dst[0])
+		obj.Hash = rep.GetArchiveHash(dst[0])
+	}
+
+	if err := obj.Save(); err != nil {
+		return obj, err
+	}
+
+	for _, d := range lst {
+		dst := NewReportDestinations(obj)
+		dst.SetDelivery(d)
+
+		if err := dst.Save(); err != nil {
+			return obj, err
+		}
+	}
+
+	return obj, nil
+}
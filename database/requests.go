@@ -12,8 +12,10 @@ import (
 
 	"errors"
 
+	"github.com/nabbar/opendmarc-reports/config"
 	. "github.com/nabbar/opendmarc-reports/logger"
 	"github.com/nabbar/opendmarc-reports/report"
+	"github.com/nabbar/opendmarc-reports/tools"
 )
 
 /*
@@ -33,7 +35,7 @@ limitations under the License.
 */
 
 const table_requests = "requests"
-const field_requests = "`id`, `date`, `domain`, `repuri`, `pct`, `policy`, `spolicy`, `aspf`, `adkim`, `locked`"
+const field_requests = "`id`, `date`, `domain`, `repuri`, `pct`, `policy`, `spolicy`, `aspf`, `adkim`, `locked`, `fo`, `npolicy`, `testing`"
 
 type Requests struct {
 	Generic
@@ -46,6 +48,9 @@ type Requests struct {
 	ASPF    int
 	ADKIM   int
 	Locked  bool
+	Fo      string
+	Npolicy int
+	Testing int
 }
 
 func NewRequests(domain *Domain) *Requests {
@@ -64,6 +69,9 @@ func NewRequests(domain *Domain) *Requests {
 					"aspf":    "tinyint(4) NOT NULL DEFAULT '0'",
 					"adkim":   "tinyint(4) NOT NULL DEFAULT '0'",
 					"locked":  "tinyint(4) NOT NULL DEFAULT '0'",
+					"fo":      "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"npolicy": "tinyint(4) NOT NULL DEFAULT '0'",
+					"testing": "tinyint(4) NOT NULL DEFAULT '0'",
 				}
 			},
 			fctIndex: func() IndexList {
@@ -178,6 +186,18 @@ func (obj Requests) IsLocked() bool {
 }
 
 func (obj *Requests) Load() error {
+	return obj.load(GetDbCli())
+}
+
+func (obj *Requests) Save() error {
+	return obj.save(GetDbCli())
+}
+
+func (obj *Requests) Update() error {
+	return obj.update(GetDbCli())
+}
+
+func (obj *Requests) load(db dbExec) error {
 	var (
 		rows *sql.Rows
 		err  error
@@ -195,7 +215,7 @@ func (obj *Requests) Load() error {
 		return fmt.Errorf("cannot load null row into table %s", obj.table)
 	}
 
-	if rows, err = GetDbCli().Query(qry, arg...); err != nil {
+	if rows, err = db.Query(qry, arg...); err != nil {
 		return err
 	} else if err = rows.Err(); err != nil {
 		return err
@@ -217,6 +237,9 @@ func (obj *Requests) Load() error {
 			&obj.ASPF,
 			&obj.ADKIM,
 			&obj.Locked,
+			&obj.Fo,
+			&obj.Npolicy,
+			&obj.Testing,
 		)
 
 		if err != nil {
@@ -242,7 +265,7 @@ func (obj *Requests) Load() error {
 	return nil
 }
 
-func (obj *Requests) Save() error {
+func (obj *Requests) save(db dbExec) error {
 	var (
 		res sql.Result
 		row int64
@@ -251,7 +274,7 @@ func (obj *Requests) Save() error {
 	)
 
 	if obj.Id != 0 {
-		return obj.Update()
+		return obj.update(db)
 	}
 
 	if obj.Repuri == "" {
@@ -265,8 +288,8 @@ func (obj *Requests) Save() error {
 	fld := strings.SplitN(field_requests, ",", 2)
 	lst := strings.TrimSpace(fld[1])
 
-	res, err = GetDbCli().Exec(
-		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)", obj.table, lst),
+	res, err = db.Exec(
+		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(%s)", obj.table, lst, placeholders(12)),
 		&obj.Date,
 		&obj.Domain.Id,
 		&obj.Repuri,
@@ -276,6 +299,9 @@ func (obj *Requests) Save() error {
 		&obj.ASPF,
 		&obj.ADKIM,
 		&obj.Locked,
+		&obj.Fo,
+		&obj.Npolicy,
+		&obj.Testing,
 	)
 
 	if err != nil {
@@ -303,7 +329,7 @@ func (obj *Requests) Save() error {
 	return nil
 }
 
-func (obj *Requests) Update() error {
+func (obj *Requests) update(db dbExec) error {
 	var (
 		res sql.Result
 		row int64
@@ -311,7 +337,7 @@ func (obj *Requests) Update() error {
 	)
 
 	if obj.Id == 0 {
-		return obj.Save()
+		return obj.save(db)
 	}
 
 	if obj.Repuri == "" {
@@ -351,6 +377,21 @@ func (obj *Requests) Update() error {
 		arg = append(arg, obj.ADKIM)
 	}
 
+	if obj.Fo != "" {
+		sql = sql + ", `fo` = ? "
+		arg = append(arg, obj.Fo)
+	}
+
+	if obj.Npolicy != 0 {
+		sql = sql + ", `npolicy` = ? "
+		arg = append(arg, obj.Npolicy)
+	}
+
+	if obj.Testing != 0 {
+		sql = sql + ", `testing` = ? "
+		arg = append(arg, obj.Testing)
+	}
+
 	if !obj.Date.IsZero() {
 		sql = sql + ", `date` = ? "
 		arg = append(arg, obj.Date)
@@ -358,7 +399,7 @@ func (obj *Requests) Update() error {
 
 	sql = sql + ", `locked` = ? "
 	arg = append(arg, obj.Locked, obj.Id)
-	res, err = GetDbCli().Exec(sql+" WHERE `id`=? LIMIT 1", arg...)
+	res, err = db.Exec(sql+" WHERE `id`=? LIMIT 1", arg...)
 
 	if err != nil {
 		return err
@@ -403,25 +444,56 @@ func (obj *Requests) SetDateTime(received time.Time) error {
 	return nil
 }
 
-func (obj *Requests) setSentMessages(sent bool, dateMode bool, dateInterval time.Duration) error {
-	lst, err := GetAllMessages(obj, sent, dateMode, dateInterval)
-	if err != nil {
-		return err
+// merge copy the values of the request read into an history file into the saved request of the domain
+func (obj *Requests) merge(src *Requests) {
+	obj.Repuri = tools.CleanJoin(tools.UnicSliceString(tools.CleanMergeSlice(strings.Split(obj.Repuri, ","), strings.Split(src.Repuri, ",")...)), ",")
+	if !src.Date.IsZero() {
+		obj.SetDateTime(src.Date)
 	}
 
-	for _, m := range lst {
-		err = m.SetSent(true)
-		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving sent messages '%s' (ID: %d)", m.JobId, m.Id), err)
+	if src.Pct != 0 {
+		obj.Pct = src.Pct
 	}
 
-	return nil
+	if src.Policy != 0 {
+		obj.Policy = src.Policy
+	}
+
+	if src.Spolicy != 0 {
+		obj.Spolicy = src.Spolicy
+	}
+
+	if src.ADKIM != 0 {
+		obj.ADKIM = src.ADKIM
+	}
+
+	if src.ASPF != 0 {
+		obj.ASPF = src.ASPF
+	}
+
+	if src.Fo != "" {
+		obj.Fo = src.Fo
+	}
+
+	if src.Npolicy != 0 {
+		obj.Npolicy = src.Npolicy
+	}
+
+	if src.Testing != 0 {
+		obj.Testing = src.Testing
+	}
+}
+
+func (obj *Requests) setSentMessages(window Window) error {
+	return SetSentWindow(obj, window, true)
 }
 
-func (obj *Requests) SendReport(org, email string, upd, sent bool, dateMode bool, dateInterval time.Duration) error {
+// SendReport generate and send the report of the request, it return the number of records dropped from the report
+func (obj *Requests) SendReport(org, email, contact string, compression report.ReportCompression, upd, sent bool, dateMode bool, dateInterval time.Duration) (int, error) {
 	if obj.IsLocked() {
-		return errors.New("cannot generate report for a locked request")
+		return 0, errors.New("cannot generate report for a locked request")
 	} else if err := obj.SetLocked(); err != nil {
-		return err
+		return 0, err
 	}
 
 	defer func() {
@@ -434,72 +506,187 @@ func (obj *Requests) SendReport(org, email string, upd, sent bool, dateMode bool
 		}
 	}()
 
+	win, err := NewWindow(sent, dateMode, dateInterval).Pin()
+	if err != nil {
+		return 0, err
+	}
+
+	// the testing mode send nothing : the messages and the retry queue are left as is
+	if config.GetConfig().IsTesting() {
+		upd = false
+	}
+
 	if obj.Repuri == "-" {
 		InfoLevel.Logf("Skip Report => empty RUA : '%s' (id : %d)", obj.Repuri, obj.Id)
 
 		if !upd {
 			InfoLevel.Logf("Not updated sent messages for request '%s' (id : %d)", obj.Repuri, obj.Id)
-			return nil
+			return 0, nil
 		}
 
-		return obj.setSentMessages(sent, dateMode, dateInterval)
+		return 0, obj.setSentMessages(win)
 	}
 
-	df, de, err := GetRangeDate(obj, sent, dateMode, dateInterval)
+	df, de, err := GetWindowRangeDate(obj, win)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	rep := obj.makeReport(org, email, contact, obj.Repuri, compression, win, df, de)
+
+	defer func() {
+		err := rep.Close()
+		ErrorLevel.LogErrorCtxf(NilLevel, "removing temporary report file for request '%s' (ID: %d)", err, obj.Repuri, obj.Id)
+	}()
+
+	lst := rep.SendReport()
+	DebugLevel.Logf("Report sent for request '%s' (id: %d) : %d messages into %d records", obj.Repuri, obj.Id, rep.GetMessageCount(), rep.GetRecordCount())
+
+	his, err := SaveReport(obj, win, rep, lst)
+	ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving report history for request '%s' (ID: %d)", obj.Repuri, obj.Id), err)
+
+	// an invalid report is refused before any transport and kept for the next report
+	var inv error
+
+	for _, d := range lst {
+		if d.Status == report.DeliveryInvalid {
+			inv = d.Error
+			break
+		}
+	}
+
+	drp := rep.GetDroppedCount()
+
+	if !upd {
+		InfoLevel.Logf("Not updated sent messages for request '%s' (id : %d)", obj.Repuri, obj.Id)
+		return drp, inv
+	}
+
+	// the messages of the dropped records are not in the report : they are neither sent nor queued
+	if drp > 0 {
+		if win.Exclude, err = GetDroppedMessages(obj, win, rep.GetDroppedKeys()); err != nil {
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("finding messages of dropped records for request '%s' (ID: %d), messages kept for the next report", obj.Repuri, obj.Id), err)
+			return drp, err
+		}
+
+		WarnLevel.Logf("Dropped %d records from report of request '%s' (id : %d), %d messages left unsent", drp, obj.Repuri, obj.Id, len(win.Exclude))
 	}
 
-	lst, err := GetAllMessages(obj, sent, dateMode, dateInterval)
+	var nbr int
+
+	if his.Id != 0 {
+		nbr, err = QueueDeliveries(his, lst)
+		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("queuing failed deliveries for request '%s' (ID: %d)", obj.Repuri, obj.Id), err)
+	}
+
+	for _, d := range lst {
+		if d.IsSent() {
+			err = obj.setSentMessages(win)
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving sent messages for request '%s' (ID: %d)", obj.Repuri, obj.Id), err)
+
+			return drp, obj.SetUnLocked()
+		}
+	}
+
+	if nbr > 0 {
+		// sent by the retry queue or included again into a next report once the queue expire
+		InfoLevel.Logf("No destination reached for request '%s' (id : %d), %d deliveries queued", obj.Repuri, obj.Id, nbr)
+		err = SetQueuedWindow(obj, win, true)
+		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving queued messages for request '%s' (ID: %d)", obj.Repuri, obj.Id), err)
+	} else {
+		InfoLevel.Logf("No destination reached for request '%s' (id : %d), messages kept for the next report", obj.Repuri, obj.Id)
+	}
+
+	if err = obj.SetUnLocked(); err != nil {
+		return drp, err
+	}
+
+	return drp, inv
+}
+
+// ResendReport generate again the report of the messages already sent into the window and send it
+// to the request destinations or the given repuri, only the report history is recorded.
+func (obj *Requests) ResendReport(org, email, contact, repuri string, compression report.ReportCompression, win Window) error {
+	if repuri == "" {
+		repuri = obj.Repuri
+	}
+
+	if repuri == "" || repuri == "-" {
+		return fmt.Errorf("no destination to resend report for request '%s' (id : %d)", obj.Repuri, obj.Id)
+	}
+
+	df, de, err := GetWindowRangeDate(obj, win)
 	if err != nil {
 		return err
+	} else if df == 0 && de == 0 {
+		return fmt.Errorf("no sent messages to resend for request '%s' (id : %d)", obj.Repuri, obj.Id)
 	}
 
-	var msg = make([]report.ReportRecord, 0)
+	rep := obj.makeReport(org, email, contact, repuri, compression, win, df, de)
 
-	for _, m := range lst {
-		if r, e := m.GetReport(); e != nil {
-			return err
-		} else {
-			msg = append(msg, r)
+	defer func() {
+		err := rep.Close()
+		ErrorLevel.LogErrorCtxf(NilLevel, "removing temporary report file for request '%s' (ID: %d)", err, obj.Repuri, obj.Id)
+	}()
+
+	lst := rep.SendReport()
+	DebugLevel.Logf("Report resent for request '%s' (id: %d) : %d messages into %d records", obj.Repuri, obj.Id, rep.GetMessageCount(), rep.GetRecordCount())
+
+	_, err = SaveReport(obj, win, rep, lst)
+	ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving report history for request '%s' (ID: %d)", obj.Repuri, obj.Id), err)
+
+	for _, d := range lst {
+		if d.IsSent() || d.Status == report.DeliveryTesting {
+			return nil
 		}
 	}
 
-	rep := report.GetReport(
-		obj.Repuri,
-		report.GetReportMetadata(org, email, fmt.Sprintf("%s-%d", obj.Domain.Name, time.Now().Unix()), df, de),
-		report.GetReportPolicy(obj.Domain.Name, obj.GetADKIM(), obj.GetASPF(), obj.GetPolicy(), obj.GetSPolicy(), obj.Pct),
-		msg,
-	)
-
-	rep.SendReport()
+	return fmt.Errorf("no destination reached for request '%s' (id : %d)", repuri, obj.Id)
+}
 
-	if !upd {
-		InfoLevel.Logf("Not updated sent messages for request '%s' (id : %d)", obj.Repuri, obj.Id)
-		return nil
+// PreviewReport generate the report of the messages not yet sent into the window without sending it,
+// the request is not locked and the messages are not updated. The caller must close the report.
+func (obj *Requests) PreviewReport(org, email, contact string, compression report.ReportCompression, sent, dateMode bool, dateInterval time.Duration) (report.Report, error) {
+	win, err := NewWindow(sent, dateMode, dateInterval).Pin()
+	if err != nil {
+		return nil, err
 	}
 
-	for _, m := range lst {
-		err = m.SetSent(true)
-		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving sent messages '%s' (ID: %d)", m.JobId, m.Id), err)
+	df, de, err := GetWindowRangeDate(obj, win)
+	if err != nil {
+		return nil, err
 	}
 
-	return obj.SetUnLocked()
+	return obj.makeReport(org, email, contact, obj.Repuri, compression, win, df, de), nil
+}
+
+func (obj *Requests) makeReport(org, email, contact, repuri string, compression report.ReportCompression, win Window, dateFrom, dateTo int) report.Report {
+	pol := report.GetReportPolicy(obj.Domain.Name, obj.GetADKIM(), obj.GetASPF(), obj.GetPolicy(), obj.GetSPolicy(), obj.Pct, obj.Fo)
+	pol.SetDMARCbis(obj.GetNPolicy(), obj.IsTesting())
+
+	return report.GetReportSource(
+		repuri,
+		report.GetReportMetadata(org, email, contact, fmt.Sprintf("%s-%d", obj.Domain.Name, time.Now().Unix()), dateFrom, dateTo),
+		pol,
+		compression,
+		GetReportRecords(obj, win),
+	)
 }
 
 func (obj Requests) GetADKIM() string {
-	switch obj.ADKIM {
-	case 114:
-		return "r"
-	case 115:
-		return "s"
-	default:
-		return "unknown"
-	}
+	return getAlignmentMode(obj.ADKIM)
 }
 
 func (obj Requests) GetASPF() string {
-	switch obj.ASPF {
+	return getAlignmentMode(obj.ASPF)
+}
+
+// getAlignmentMode return the name of an alignment mode code
+func getAlignmentMode(code int) string {
+	switch code {
+	case 0:
+		// relaxed is the default alignment mode (RFC 7489 §6.3)
+		return "r"
 	case 114:
 		return "r"
 	case 115:
@@ -530,7 +717,29 @@ func (obj Requests) GetSPolicy() string {
 		return "quarantine"
 	case 114:
 		return "reject"
+	case 0:
+		// the sub domain policy default to the domain policy (RFC 7489 §6.3)
+		return obj.GetPolicy()
 	default:
 		return "unknown"
 	}
 }
+
+func (obj Requests) GetNPolicy() string {
+	switch obj.Npolicy {
+	case 110:
+		return "none"
+	case 113:
+		return "quarantine"
+	case 114:
+		return "reject"
+	case 0:
+		return ""
+	default:
+		return "unknown"
+	}
+}
+
+func (obj Requests) IsTesting() bool {
+	return obj.Testing == 121
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestRequestsAlignment(t *testing.T) {
+	tst := []struct {
+		adkim int
+		aspf  int
+		expd  string
+		exps  string
+	}{
+		{115, 114, "s", "r"},
+		{114, 115, "r", "s"},
+		{0, 115, "r", "s"},
+		{115, 0, "s", "r"},
+	}
+
+	for _, tc := range tst {
+		req := Requests{ADKIM: tc.adkim, ASPF: tc.aspf}
+		pol := report.GetReportPolicy("example.com", req.GetADKIM(), req.GetASPF(), "none", "none", 100, req.Fo)
+
+		if pol.ADKIM != tc.expd || pol.ASPF != tc.exps {
+			t.Errorf("adkim %d / aspf %d: got adkim=%s aspf=%s, want adkim=%s aspf=%s", tc.adkim, tc.aspf, pol.ADKIM, pol.ASPF, tc.expd, tc.exps)
+		}
+
+		if pol.FO != "0" {
+			t.Errorf("adkim %d / aspf %d: got fo=%s, want the default 0", tc.adkim, tc.aspf, pol.FO)
+		}
+	}
+}
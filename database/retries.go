@@ -0,0 +1,456 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+	"github.com/nabbar/opendmarc-reports/report"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const table_retries = "retry_queue"
+const field_retries = "`id`, `date`, `report`, `report_id`, `uri`, `format`, `compression`, `file`, `payload`, `attempts`, `next_try`, `error`"
+
+// maximum delay between two attempts of a queued delivery
+const retry_max_delay = 24 * time.Hour
+
+// RetryQueue is a failed delivery waiting for a new attempt, with the file sent to the destination
+type RetryQueue struct {
+	Generic
+
+	Report      *Reports
+	ReportId    string
+	Uri         string
+	Format      string
+	Compression string
+	File        string
+	Payload     []byte
+	Attempts    int
+	NextTry     time.Time
+	Error       string
+}
+
+func NewRetryQueue(rep *Reports) *RetryQueue {
+	obj := &RetryQueue{
+		Generic: Generic{
+			table: table_retries,
+			fctField: func() FieldList {
+				return FieldList{
+					"id":          "int(11) NOT NULL AUTO_INCREMENT",
+					"date":        "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
+					"report":      "int(10) unsigned NOT NULL DEFAULT '0'",
+					"report_id":   "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"uri":         "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"format":      "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"compression": "varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"file":        "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"payload":     "longblob",
+					"attempts":    "int(10) unsigned NOT NULL DEFAULT '0'",
+					"next_try":    "timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP",
+					"error":       "text COLLATE utf8mb4_unicode_ci",
+				}
+			},
+			fctIndex: func() IndexList {
+				return IndexList{
+					"PRIMARY":  {"type": "PRIMARY", "fields": "id"},
+					"report":   {"type": "INDEX", "fields": "report"},
+					"next_try": {"type": "INDEX", "fields": "next_try"},
+				}
+			},
+		},
+		Report: rep,
+	}
+
+	if obj.Report == nil {
+		obj.Report = NewReports(nil)
+	}
+
+	return obj
+}
+
+func GetRetryQueue(Id int) (*RetryQueue, error) {
+	obj := NewRetryQueue(nil)
+
+	var err error
+
+	if Id != 0 {
+		obj.Id = Id
+		err = obj.Load()
+	}
+
+	return obj, err
+}
+
+// GetRetryList return the id of the queued deliveries with a next attempt due
+func GetRetryList() (retryIds []int, err error) {
+	var rows *sql.Rows
+
+	retryIds = make([]int, 0)
+
+	if rows, err = GetDbCli().Query(fmt.Sprintf("SELECT `id` FROM `%s` WHERE `next_try` <= NOW() ORDER BY `next_try`", table_retries)); err != nil {
+		return
+	} else if err = rows.Err(); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+
+		if err = rows.Scan(&id); err != nil {
+			return
+		}
+
+		retryIds = append(retryIds, id)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// QueueDeliveries add the failed deliveries of a report to the retry queue and return the number of queued deliveries.
+// The first attempt is done by the next run of the retry queue.
+func QueueDeliveries(rep *Reports, lst []report.Delivery) (int, error) {
+	var nbr int
+
+	for _, d := range lst {
+		if d.Status != report.DeliveryFailed || d.Size < 1 {
+			continue
+		}
+
+		obj := NewRetryQueue(rep)
+
+		if err := obj.SetDelivery(d); err != nil {
+			return nbr, err
+		}
+
+		obj.Attempts = 1
+		obj.NextTry = time.Now()
+
+		if err := obj.Save(); err != nil {
+			return nbr, err
+		}
+
+		nbr++
+	}
+
+	return nbr, nil
+}
+
+// retryDelay return the exponential delay before the next attempt
+func retryDelay(interval time.Duration, attempts int) time.Duration {
+	var d = interval
+
+	for i := 1; i < attempts && d < retry_max_delay; i++ {
+		d *= 2
+	}
+
+	if d > retry_max_delay {
+		d = retry_max_delay
+	}
+
+	return d
+}
+
+// SetDelivery fill the row with the failed delivery and the content of the file sent
+func (obj *RetryQueue) SetDelivery(dlv report.Delivery) error {
+	var err error
+
+	obj.Date = dlv.Date
+	obj.ReportId = dlv.ReportId
+	obj.Uri = dlv.Destination.Uri
+	obj.Format = dlv.Destination.Format.String()
+	obj.Compression = dlv.Destination.Compression.String()
+	obj.File = dlv.FileName
+
+	if dlv.Error != nil {
+		obj.Error = dlv.Error.Error()
+	}
+
+	obj.Payload, err = dlv.Payload()
+
+	return err
+}
+
+// GetDestination return the destination of the queued delivery, with the format and compression of its file
+func (obj RetryQueue) GetDestination() (report.Destination, error) {
+	cmp, err := report.ParseCompression(obj.Compression)
+	dst := report.ParseDestination(obj.Uri, cmp)
+
+	if err != nil {
+		return dst, fmt.Errorf("queued delivery '%s' (id: %d): %v", obj.Uri, obj.Id, err)
+	} else if dst.Format, err = report.ParseFormat(obj.Format); err != nil {
+		return dst, fmt.Errorf("queued delivery '%s' (id: %d): %v", obj.Uri, obj.Id, err)
+	}
+
+	dst.Compression = cmp
+
+	return dst, nil
+}
+
+func (obj *RetryQueue) Load() error {
+	var (
+		rows *sql.Rows
+		err  error
+		rep  int
+	)
+
+	if obj.Id == 0 {
+		return fmt.Errorf("cannot load null row into table %s", obj.table)
+	}
+
+	if rows, err = GetDbCli().Query(fmt.Sprintf("SELECT %s FROM `%s` WHERE `id`=? LIMIT 1", field_retries, obj.table), obj.Id); err != nil {
+		return err
+	} else if err = rows.Err(); err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg sql.NullString
+
+		if err = rows.Scan(&obj.Id, &obj.Date, &rep, &obj.ReportId, &obj.Uri, &obj.Format, &obj.Compression, &obj.File, &obj.Payload, &obj.Attempts, &obj.NextTry, &msg); err != nil {
+			return err
+		}
+
+		obj.Error = msg.String
+
+		if rep > 0 {
+			if obj.Report, err = GetReports(rep); err != nil {
+				return err
+			}
+		}
+
+		DebugLevel.Logf("Find row into table %s : %s / %s (id: %d)", obj.table, obj.ReportId, obj.Uri, obj.Id)
+		break
+	}
+
+	return rows.Err()
+}
+
+func (obj *RetryQueue) Save() error {
+	var (
+		res sql.Result
+		row int64
+		nbr int64
+		err error
+	)
+
+	if obj.Id != 0 {
+		return obj.Update()
+	}
+
+	if obj.Report.Id == 0 || len(obj.Payload) < 1 {
+		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
+	}
+
+	if obj.Date.IsZero() {
+		obj.Date = time.Now()
+	}
+
+	fld := strings.SplitN(field_retries, ",", 2)
+	lst := strings.TrimSpace(fld[1])
+
+	res, err = GetDbCli().Exec(
+		fmt.Sprintf("INSERT INTO `%s`(%s) VALUES(%s)", obj.table, lst, placeholders(11)),
+		obj.Date,
+		obj.Report.Id,
+		obj.ReportId,
+		obj.Uri,
+		obj.Format,
+		obj.Compression,
+		obj.File,
+		obj.Payload,
+		obj.Attempts,
+		obj.NextTry,
+		obj.Error,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	if row != 0 {
+		if nbr, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		obj.Id = int(nbr)
+		DebugLevel.Logf("Added %d row into table %s : %s / %s (id: %d)", row, obj.table, obj.ReportId, obj.Uri, obj.Id)
+	}
+
+	return nil
+}
+
+func (obj *RetryQueue) Update() error {
+	if obj.Id == 0 {
+		return obj.Save()
+	}
+
+	res, err := GetDbCli().Exec(fmt.Sprintf("UPDATE `%s` SET `attempts` = ?, `next_try` = ?, `error` = ? WHERE `id`=? LIMIT 1", obj.table), obj.Attempts, obj.NextTry, obj.Error, obj.Id)
+
+	if err != nil {
+		return err
+	}
+
+	if row, err := res.RowsAffected(); err != nil {
+		return err
+	} else if row != 0 {
+		DebugLevel.Logf("Updated %d row into table %s : %s / %s (id: %d)", row, obj.table, obj.ReportId, obj.Uri, obj.Id)
+	}
+
+	return nil
+}
+
+// Retry send again the queued file to its destination. On success or in testing mode, the row is removed
+// and the messages still queued for the report are marked as sent. Otherwise the next
+// attempt is delayed, until the max age is reached and the delivery is given up.
+func (obj *RetryQueue) Retry(org, email, contact string, interval, maxAge time.Duration) error {
+	if maxAge > 0 && time.Since(obj.Date) > maxAge {
+		return obj.expire(fmt.Errorf("max age of %s reached after %d attempts", maxAge.String(), obj.Attempts))
+	}
+
+	var (
+		beg = int(obj.Report.DateBegin.Unix())
+		end = int(obj.Report.DateEnd.Unix())
+	)
+
+	dst, err := obj.GetDestination()
+	if err != nil {
+		return err
+	}
+
+	rep, err := report.GetReportPayload(
+		report.GetReportMetadata(org, email, contact, obj.ReportId, beg, end),
+		report.ReportPolicy{Domain: obj.Report.Domain.Name},
+		dst, obj.File, obj.Payload,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := rep.Close()
+		ErrorLevel.LogErrorCtxf(NilLevel, "removing temporary report file of queued delivery '%s' (ID: %d)", err, obj.Uri, obj.Id)
+	}()
+
+	dlv := rep.SendTo(dst)
+	obj.record(dlv)
+
+	switch dlv.Status {
+	case report.DeliveryFailed:
+		obj.Attempts++
+		obj.NextTry = time.Now().Add(retryDelay(interval, obj.Attempts))
+		obj.Error = dlv.Error.Error()
+
+		if maxAge > 0 && obj.NextTry.Sub(obj.Date) > maxAge {
+			return obj.expire(dlv.Error)
+		}
+
+		InfoLevel.Logf("Queued delivery of report '%s' to '%s' failed, next attempt at %s", obj.ReportId, obj.Uri, obj.NextTry.String())
+		return obj.Update()
+
+	case report.DeliveryTesting:
+		// as for a new report, the testing mode send nothing : the delivery and its messages are left as is
+		InfoLevel.Logf("Testing mode : queued delivery of report '%s' to '%s' is kept", obj.ReportId, obj.Uri)
+		return nil
+
+	default:
+		InfoLevel.Logf("Queued delivery of report '%s' to '%s' is sent after %d attempts", obj.ReportId, obj.Uri, obj.Attempts+1)
+	}
+
+	if err = obj.Generic.Delete(); err != nil {
+		return err
+	}
+
+	if obj.Report.Until.IsZero() {
+		return errors.New("missing window of report to mark messages as sent")
+	}
+
+	return SetSentWindow(obj.Report.Request, obj.window(), true)
+}
+
+// window return the window of the queued messages of the report : the ones of its date bound and last message id
+func (obj *RetryQueue) window() Window {
+	return Window{
+		Queued: true,
+		Until:  obj.Report.Until,
+		LastId: obj.Report.LastId,
+	}
+}
+
+// expire give up the delivery and release the queued messages if no other delivery of the report is waiting
+func (obj *RetryQueue) expire(reason error) error {
+	var nbr int
+
+	WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("giving up queued delivery of report '%s' to '%s'", obj.ReportId, obj.Uri), reason)
+
+	// the queued file is kept as is, only the receiver of the destination is needed
+	rcv, _ := obj.GetDestination()
+
+	dst := NewReportDestinations(obj.Report)
+	dst.ReportId = obj.ReportId
+	dst.Uri = obj.Uri
+	dst.Receiver = rcv.Host
+	dst.Transport = rcv.Scheme
+	dst.Format = obj.Format
+	dst.Compression = obj.Compression
+	dst.File = obj.File
+	dst.Size = int64(len(obj.Payload))
+	dst.Status = report.DeliveryExpired
+	dst.Error = reason.Error()
+	dst.Date = time.Now()
+
+	if err := dst.Save(); err != nil {
+		return err
+	}
+
+	if err := obj.Generic.Delete(); err != nil {
+		return err
+	}
+
+	if err := GetDbCli().QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `report`=?", obj.table), obj.Report.Id).Scan(&nbr); err != nil {
+		return err
+	} else if nbr > 0 || obj.Report.Until.IsZero() {
+		return nil
+	}
+
+	// included again into the next report
+	return SetQueuedWindow(obj.Report.Request, obj.window(), false)
+}
+
+// record add the result of the attempt to the report history
+func (obj *RetryQueue) record(dlv report.Delivery) {
+	dst := NewReportDestinations(obj.Report)
+	dst.SetDelivery(dlv)
+
+	err := dst.Save()
+	ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("saving result of queued delivery '%s' (ID: %d)", obj.Uri, obj.Id), err)
+}
@@ -25,6 +25,7 @@ limitations under the License.
 */
 
 const table_signatures = "signatures"
+const field_signatures = "`id`,`message`,`domain`,`pass`,`error`,`selector`,`human_result`"
 
 type Signatures struct {
 	Generic
@@ -34,6 +35,9 @@ type Signatures struct {
 	Domain  *Domain
 	Pass    int
 	Error   bool
+
+	Selector    string
+	HumanResult string
 }
 
 func NewSignatures(Message *Messages) *Signatures {
@@ -42,11 +46,13 @@ func NewSignatures(Message *Messages) *Signatures {
 			table: table_signatures,
 			fctField: func() FieldList {
 				return FieldList{
-					"id":      "int(11) NOT NULL AUTO_INCREMENT",
-					"message": "int(11) NOT NULL DEFAULT '0'",
-					"domain":  "int(11) NOT NULL DEFAULT '0'",
-					"pass":    "tinyint(4) NOT NULL DEFAULT '0'",
-					"error":   "tinyint(4) NOT NULL DEFAULT '0'",
+					"id":           "int(11) NOT NULL AUTO_INCREMENT",
+					"message":      "int(11) NOT NULL DEFAULT '0'",
+					"domain":       "int(11) NOT NULL DEFAULT '0'",
+					"pass":         "tinyint(4) NOT NULL DEFAULT '0'",
+					"error":        "tinyint(4) NOT NULL DEFAULT '0'",
+					"selector":     "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
+					"human_result": "varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''",
 				}
 			},
 			fctIndex: func() IndexList {
@@ -85,7 +91,7 @@ func GetAllSignatures(Message *Messages) ([]*Signatures, error) {
 		err  error
 	)
 
-	sql := fmt.Sprintf("SELECT `id`,`message`,`domain`,`pass`,`error` FROM `%s`", table_signatures)
+	sql := fmt.Sprintf("SELECT %s FROM `%s`", field_signatures, table_signatures)
 	rows, err = GetDbCli().Query(sql+" WHERE `message`=?", Message.Id)
 
 	if err != nil {
@@ -101,7 +107,7 @@ func GetAllSignatures(Message *Messages) ([]*Signatures, error) {
 		dom := 0
 		msg := 0
 
-		if err = rows.Scan(&obj.Id, &msg, &dom, &obj.Pass, &obj.Error); err != nil {
+		if err = rows.Scan(&obj.Id, &msg, &dom, &obj.Pass, &obj.Error, &obj.Selector, &obj.HumanResult); err != nil {
 			return res, err
 		} else if err = rows.Err(); err != nil {
 			return res, err
@@ -156,7 +162,7 @@ func (obj *Signatures) Load() error {
 		msg  int
 	)
 
-	sql := fmt.Sprintf("SELECT `id`,`message`,`domain`,`pass`,`error` FROM `%s`", obj.table)
+	sql := fmt.Sprintf("SELECT %s FROM `%s`", field_signatures, obj.table)
 
 	if obj.Id != 0 {
 		rows, err = GetDbCli().Query(sql+" WHERE `id`=? LIMIT 1", obj.Id)
@@ -175,16 +181,14 @@ func (obj *Signatures) Load() error {
 	defer rows.Close()
 
 	for rows.Next() {
-		if err = rows.Scan(&obj.Id, &msg, &dom, &obj.Pass, &obj.Error); err != nil {
+		if err = rows.Scan(&obj.Id, &msg, &dom, &obj.Pass, &obj.Error, &obj.Selector, &obj.HumanResult); err != nil {
 			return err
 		} else if err = rows.Err(); err != nil {
 			return err
 		}
 
 		if msg > 0 {
-			if obj.Message != nil && msg == obj.Message.Id {
-				obj.Message = obj.Message
-			} else {
+			if obj.Message == nil || msg != obj.Message.Id {
 				obj.Message, _ = GetMessages(msg)
 			}
 		}
@@ -207,7 +211,7 @@ func (obj *Signatures) Load() error {
 			obj.Domain = NewDomain("")
 		}
 
-		logger.DebugLevel.Logf("Find row into table %s : %s (id: %d)", obj.table, obj.Message, obj.Id)
+		logger.DebugLevel.Logf("Find row into table %s : Job ref %s (id: %d)", obj.table, obj.Message.JobId, obj.Id)
 		break
 	}
 
@@ -226,7 +230,7 @@ func (obj *Signatures) Save() error {
 		err error
 	)
 
-	obj.Domain.Save()
+	obj.Domain.Resolve()
 
 	if obj.Id != 0 {
 		return obj.Update()
@@ -236,7 +240,7 @@ func (obj *Signatures) Save() error {
 		return fmt.Errorf("cannot add an empty row into table %s", obj.table)
 	}
 
-	res, err = GetDbCli().Exec(fmt.Sprintf("INSERT INTO `%s`(`message`,`domain`,`pass`,`error`) VALUES(?, ?, ?, ?)", obj.table), obj.Message.Id, obj.Domain.Id, obj.Pass, obj.Error)
+	res, err = GetDbCli().Exec(fmt.Sprintf("INSERT INTO `%s`(`message`,`domain`,`pass`,`error`,`selector`,`human_result`) VALUES(?, ?, ?, ?, ?, ?)", obj.table), obj.Message.Id, obj.Domain.Id, obj.Pass, obj.Error, obj.Selector, obj.HumanResult)
 
 	if err != nil {
 		return err
@@ -257,7 +261,7 @@ func (obj *Signatures) Save() error {
 		}
 
 		obj.Id = int(nbr)
-		logger.DebugLevel.Logf("Added %d row into table %s : %d (id: %d)", row, obj.table, obj.Message, obj.Id)
+		logger.DebugLevel.Logf("Added %d row into table %s : Job ref %s (id: %d)", row, obj.table, obj.Message.JobId, obj.Id)
 	}
 
 	return nil
@@ -291,6 +295,16 @@ func (obj *Signatures) Update() error {
 		arg = append(arg, obj.Pass)
 	}
 
+	if obj.Selector != "" {
+		sql = sql + ", `selector` = ? "
+		arg = append(arg, obj.Selector)
+	}
+
+	if obj.HumanResult != "" {
+		sql = sql + ", `human_result` = ? "
+		arg = append(arg, obj.HumanResult)
+	}
+
 	sql = sql + ", `error` = ? "
 	arg = append(arg, obj.Error, obj.Id)
 	res, err = GetDbCli().Exec(sql+" WHERE `id`=? LIMIT 1", arg...)
@@ -306,7 +320,7 @@ func (obj *Signatures) Update() error {
 	}
 
 	if row != 0 {
-		logger.DebugLevel.Logf("Updated %d row into table %s : %d (id: %d)", row, obj.table, obj.Message, obj.Id)
+		logger.DebugLevel.Logf("Updated %d row into table %s : Job ref %s (id: %d)", row, obj.table, obj.Message.JobId, obj.Id)
 	}
 
 	return nil
@@ -336,7 +350,7 @@ func (obj *Signatures) Delete() error {
 	}
 
 	if row != 0 {
-		logger.DebugLevel.Logf("Deleted %d row into table %s : %d (id: %d)", row, obj.table, obj.Message, obj.Id)
+		logger.DebugLevel.Logf("Deleted %d row into table %s : Job ref %s (id: %d)", row, obj.table, obj.Message.JobId, obj.Id)
 	}
 
 	return nil
@@ -373,34 +387,9 @@ func (obj *Signatures) DeleteFromMessage() error {
 }
 
 func (obj Signatures) GetReport() report.ReportDKIM {
-	return report.GetReportDKIM(obj.Domain.Name, obj.GetPass())
+	return report.GetReportDKIM(obj.Domain.Name, obj.Selector, obj.GetPass(), obj.HumanResult)
 }
 
 func (obj Signatures) GetPass() string {
-	switch obj.Pass {
-	case 0:
-		return "pass"
-	case 2:
-		return "softfail"
-	case 3:
-		return "neutral"
-	case 4:
-		return "temperror"
-	case 5:
-		return "permerror"
-	case 6:
-		return "none"
-	case 7:
-		return "fail"
-	case 8:
-		return "policy"
-	case 9:
-		return "nxdomain"
-	case 10:
-		return "signed"
-	case 12:
-		return "discard"
-	default:
-		return "unknown"
-	}
+	return getResult(obj.Pass)
 }
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Window select the messages to include into a report : sent / queued flags and date range
+type Window struct {
+	Sent     bool
+	Queued   bool
+	DateMode bool
+	Interval time.Duration
+
+	// Until is the fixed upper date bound once the window is pinned
+	Until time.Time
+	// From is an optional lower date bound
+	From time.Time
+	// LastId is the highest message id once the window is pinned : messages imported
+	// while the report is running are left for the next report whatever their date
+	LastId int64
+	// Exclude is the id of the messages left out of the window, as the messages of the records dropped from the report
+	Exclude []int64
+}
+
+func NewWindow(sent, dateMode bool, dateInterval time.Duration) Window {
+	return Window{
+		Sent:     sent,
+		DateMode: dateMode,
+		Interval: dateInterval,
+	}
+}
+
+// NewRangeWindow select the messages already sent between the two dates (from included, until excluded)
+func NewRangeWindow(from, until time.Time) Window {
+	return Window{
+		Sent:  true,
+		From:  from,
+		Until: until,
+	}
+}
+
+// Pin resolve the relative upper date bound with the database clock,
+// so that all queries of a same report work on the same messages.
+func (w Window) Pin() (Window, error) {
+	var (
+		qry  string
+		arg  = make([]interface{}, 0)
+		rows *sql.Rows
+		err  error
+	)
+
+	if !w.Until.IsZero() {
+		return w, nil
+	}
+
+	if w.DateMode {
+		qry = "SELECT TIMESTAMP(DATE(DATE_SUB(CURRENT_DATE(), INTERVAL 1 DAY)))"
+	} else {
+		qry = "SELECT DATE_SUB(NOW(), INTERVAL ? SECOND)"
+		arg = append(arg, w.Interval.Seconds())
+	}
+
+	// -1 for an empty table, to exclude any message imported after
+	qry = qry + fmt.Sprintf(", (SELECT IFNULL(MAX(`id`), -1) FROM `%s`)", table_messages)
+
+	if rows, err = GetDbCli().Query(qry, arg...); err != nil {
+		return w, err
+	} else if err = rows.Err(); err != nil {
+		return w, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = rows.Scan(&w.Until, &w.LastId); err != nil {
+			return w, err
+		}
+
+		break
+	}
+
+	if err = rows.Err(); err != nil {
+		return w, err
+	} else if w.Until.IsZero() {
+		return w, fmt.Errorf("cannot resolve date bound of report window")
+	}
+
+	return w, nil
+}
+
+// where return the sql condition (without WHERE keyword) and its args for the messages table alias given
+func (w Window) where(alias string) (string, []interface{}) {
+	var (
+		col = func(name string) string {
+			if alias == "" {
+				return fmt.Sprintf("`%s`", name)
+			}
+			return fmt.Sprintf("`%s`.`%s`", alias, name)
+		}
+		arg = []interface{}{w.Sent, w.Queued}
+		qry = col("sent") + "=? AND " + col("queued") + "=?"
+	)
+
+	if !w.From.IsZero() {
+		qry = qry + " AND " + col("date") + " >= ?"
+		arg = append(arg, w.From)
+	}
+
+	if !w.Until.IsZero() {
+		qry = qry + " AND " + col("date") + " < ?"
+		arg = append(arg, w.Until)
+	} else if w.DateMode {
+		qry = qry + " AND DATE(" + col("date") + ") < DATE(DATE_SUB(CURRENT_DATE(), INTERVAL 1 DAY))"
+	} else {
+		qry = qry + " AND " + col("date") + " < DATE_SUB(NOW(), INTERVAL ? SECOND)"
+		arg = append(arg, w.Interval.Seconds())
+	}
+
+	if w.LastId != 0 {
+		qry = qry + " AND " + col("id") + " <= ?"
+		arg = append(arg, w.LastId)
+	}
+
+	if len(w.Exclude) > 0 {
+		qry = qry + " AND " + col("id") + " NOT IN (" + placeholders(len(w.Exclude)) + ")"
+
+		for _, id := range w.Exclude {
+			arg = append(arg, id)
+		}
+	}
+
+	return qry, arg
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestWindowWhere(t *testing.T) {
+	var unt = time.Date(2018, 7, 14, 0, 0, 0, 0, time.UTC)
+
+	tst := []struct {
+		name string
+		win  Window
+		qry  string
+		nbr  int
+	}{
+		{"pinned", Window{Until: unt, LastId: 42}, "`m`.`sent`=? AND `m`.`queued`=? AND `m`.`date` < ? AND `m`.`id` <= ?", 4},
+		{"empty table", Window{Until: unt, LastId: -1}, "`m`.`date` < ? AND `m`.`id` <= ?", 4},
+		{"range", NewRangeWindow(unt.Add(-time.Hour), unt), "`m`.`date` >= ? AND `m`.`date` < ?", 4},
+		{"excluded", Window{Until: unt, LastId: 42, Exclude: []int64{7, 9}}, "`m`.`id` <= ? AND `m`.`id` NOT IN (?, ?)", 6},
+		{"unpinned", NewWindow(false, false, time.Hour), "`m`.`date` < DATE_SUB(NOW(), INTERVAL ? SECOND)", 3},
+	}
+
+	for _, tc := range tst {
+		qry, arg := tc.win.where("m")
+
+		if !strings.HasSuffix(qry, tc.qry) {
+			t.Errorf("%s: got query %q, want suffix %q", tc.name, qry, tc.qry)
+		}
+
+		if len(arg) != tc.nbr {
+			t.Errorf("%s: got %d args, want %d", tc.name, len(arg), tc.nbr)
+		}
+	}
+
+	if qry, _ := NewWindow(false, false, time.Hour).where(""); strings.Contains(qry, "`id`") {
+		t.Errorf("unpinned window must not be bounded by id : %q", qry)
+	}
+}
@@ -0,0 +1,566 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// keys of the OpenDMARC history format, as written by opendmarc for each message
+const (
+	KeyJob       = "job"
+	KeyReporter  = "reporter"
+	KeyReceived  = "received"
+	KeyIpAddr    = "ipaddr"
+	KeyFrom      = "from"
+	KeyMFrom     = "mfrom"
+	KeyRua       = "rua"
+	KeyP         = "p"
+	KeySP        = "sp"
+	KeyNP        = "np"
+	KeyPct       = "pct"
+	KeyADKIM     = "adkim"
+	KeyASPF      = "aspf"
+	KeyT         = "t"
+	KeyDKIM      = "dkim"
+	KeySPF       = "spf"
+	KeyAlignDKIM = "align_dkim"
+	KeyAlignSPF  = "align_spf"
+	KeyAction    = "action"
+	KeyPDomain   = "pdomain"
+	KeyPolicy    = "policy"
+	KeyARC       = "arc"
+	KeyARCPolicy = "arc_policy"
+)
+
+// extension keys, never written by OpenDMARC : they fill the RFC 7489 elements that OpenDMARC does not log
+// and are only given by other writers of the history format (the Writer of this package, a json client of
+// serve-ingest, a patched MTA...). Without them, envelope_to is omitted, the spf scope is mfrom,
+// no override reason is reported and fo is reported with its default value 0.
+const (
+	KeyEnvelopeTo = "envelope_to"
+	KeyFo         = "fo"
+	KeySPFScope   = "spf_scope"
+	KeyReason     = "reason"
+)
+
+// Field is one line of an history job, as read into the file
+type Field struct {
+	Line  int    `json:"line" yaml:"line"`
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// error result codes of a dkim signature
+const (
+	DKIMTempError = 4
+	DKIMPermError = 5
+)
+
+// DKIM is the result of one dkim signature of a job
+type DKIM struct {
+	Line     int    `json:"line" yaml:"line"`
+	Domain   string `json:"domain" yaml:"domain"`
+	Selector string `json:"selector,omitempty" yaml:"selector,omitempty"`
+	Result   int    `json:"result" yaml:"result"`
+}
+
+// ARCSeal is one ARC set of the chain evaluated by the arc policy, as written in json by OpenDMARC
+type ARCSeal struct {
+	Instance int    `json:"i" yaml:"i"`
+	Domain   string `json:"d" yaml:"d"`
+	Selector string `json:"s" yaml:"s"`
+	Ip       string `json:"ip,omitempty" yaml:"ip,omitempty"`
+}
+
+// Job is one message of an history file, with the typed values of all known keys.
+// The lines with an unknown key are kept into Unknown, the lines that cannot be parsed into Errors.
+type Job struct {
+	JobId  string `json:"job" yaml:"job"`
+	Line   int    `json:"line" yaml:"line"`
+	Offset int64  `json:"offset" yaml:"offset"`
+
+	Reporter   string    `json:"reporter,omitempty" yaml:"reporter,omitempty"`
+	Received   time.Time `json:"received,omitempty" yaml:"received,omitempty"`
+	IpAddr     string    `json:"ipaddr,omitempty" yaml:"ipaddr,omitempty"`
+	From       string    `json:"from,omitempty" yaml:"from,omitempty"`
+	MFrom      string    `json:"mfrom,omitempty" yaml:"mfrom,omitempty"`
+	EnvelopeTo string    `json:"envelope_to,omitempty" yaml:"envelope_to,omitempty"`
+	PDomain    string    `json:"pdomain,omitempty" yaml:"pdomain,omitempty"`
+
+	Rua   []string `json:"rua,omitempty" yaml:"rua,omitempty"`
+	P     int      `json:"p" yaml:"p"`
+	SP    int      `json:"sp" yaml:"sp"`
+	NP    int      `json:"np" yaml:"np"`
+	Pct   int      `json:"pct" yaml:"pct"`
+	ADKIM int      `json:"adkim" yaml:"adkim"`
+	ASPF  int      `json:"aspf" yaml:"aspf"`
+	Fo    string   `json:"fo,omitempty" yaml:"fo,omitempty"`
+	T     int      `json:"t" yaml:"t"`
+
+	DKIM      []DKIM `json:"dkim,omitempty" yaml:"dkim,omitempty"`
+	SPF       int    `json:"spf" yaml:"spf"`
+	SPFDomain string `json:"spf_domain,omitempty" yaml:"spf_domain,omitempty"`
+	SPFScope  string `json:"spf_scope,omitempty" yaml:"spf_scope,omitempty"`
+	AlignDKIM int    `json:"align_dkim" yaml:"align_dkim"`
+	AlignSPF  int    `json:"align_spf" yaml:"align_spf"`
+	Action    int    `json:"action" yaml:"action"`
+	Policy    int    `json:"policy" yaml:"policy"`
+	Reason    string `json:"reason,omitempty" yaml:"reason,omitempty"`
+
+	ARC       int       `json:"arc" yaml:"arc"`
+	ARCPolicy int       `json:"arc_policy" yaml:"arc_policy"`
+	ARCSeals  []ARCSeal `json:"arc_seals,omitempty" yaml:"arc_seals,omitempty"`
+
+	Unknown []Field       `json:"unknown,omitempty" yaml:"unknown,omitempty"`
+	Errors  []*ParseError `json:"-" yaml:"-"`
+	// Missing is the list of keys not recovered for a job rebuilt from syslog
+	Missing []string `json:"missing,omitempty" yaml:"missing,omitempty"`
+
+	set map[string]bool
+	// dmarc is the dmarc result of a job rebuilt from syslog, used to compute its alignments
+	dmarc string
+}
+
+// ParseError is a line of an history file that cannot be read
+type ParseError struct {
+	Line  int
+	JobId string
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+
+	return fmt.Sprintf("line %d: key '%s' with value '%s': %v", e.Line, e.Key, e.Value, e.Err)
+}
+
+// NewJob return an empty job, started at the given line number and byte offset
+func NewJob(jobId string, line int, offset int64) *Job {
+	return &Job{
+		JobId:  jobId,
+		Line:   line,
+		Offset: offset,
+		set:    make(map[string]bool),
+	}
+}
+
+// SplitLine return the key and the value of an history line, the key is returned for a line without value
+func SplitLine(line string) (string, string, error) {
+	p := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+
+	if p[0] == "" {
+		return "", "", fmt.Errorf("line not well formatted")
+	} else if len(p) != 2 {
+		return strings.ToLower(p[0]), "", fmt.Errorf("value missing")
+	}
+
+	return strings.ToLower(p[0]), p[1], nil
+}
+
+// Has return true if the key was set into the job
+func (j *Job) Has(key string) bool {
+	return j.set[key]
+}
+
+// HasError return true if a line of the key cannot be parsed, the value of the key is then not set
+func (j *Job) HasError(key string) bool {
+	for _, e := range j.Errors {
+		if e.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmarshalJSON read a job encoded in json, the keys given into the json object are then set
+func (j *Job) UnmarshalJSON(data []byte) error {
+	type job Job
+
+	var (
+		val = job{}
+		key = make(map[string]json.RawMessage)
+	)
+
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	} else if err = json.Unmarshal(data, &key); err != nil {
+		return err
+	}
+
+	*j = Job(val)
+	j.set = make(map[string]bool)
+
+	for k := range key {
+		j.set[k] = true
+	}
+
+	return nil
+}
+
+// jsonKeys is the set of the keys of a job encoded in json
+var jsonKeys = func() map[string]bool {
+	var (
+		res = make(map[string]bool)
+		typ = reflect.TypeOf(Job{})
+	)
+
+	for i := 0; i < typ.NumField(); i++ {
+		if k := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; k != "" && k != "-" {
+			res[k] = true
+		}
+	}
+
+	return res
+}()
+
+// ParseJSON return the job of a json object, checked as a job read into an history file : a value that cannot
+// be decoded or checked is added to Errors and not set, an unknown key is kept into Unknown. The line is the
+// number of the object into its stream, the line and offset keys of the object are ignored.
+func ParseJSON(line int, data []byte) (*Job, error) {
+	var (
+		obj = make(map[string]json.RawMessage)
+		lst = make([]string, 0)
+		job = NewJob("", line, 0)
+	)
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+
+	for k := range obj {
+		lst = append(lst, k)
+	}
+
+	// the job id first for the errors, then the errors and the unknown keys always in the same order
+	sort.Slice(lst, func(i, k int) bool {
+		if lst[i] == KeyJob || lst[k] == KeyJob {
+			return lst[i] == KeyJob && lst[k] != KeyJob
+		}
+
+		return lst[i] < lst[k]
+	})
+
+	for _, k := range lst {
+		job.setJSON(line, k, obj[k])
+	}
+
+	return job, nil
+}
+
+// setJSON decode the json value of a key, and check it as Set do
+func (j *Job) setJSON(line int, key string, value json.RawMessage) {
+	type job Job
+
+	var (
+		obj = []byte(fmt.Sprintf("{%q:%s}", key, value))
+		err error
+	)
+
+	switch {
+	case key == "line" || key == "offset":
+		return
+	case key == "unknown":
+		var lst []Field
+
+		if err = json.Unmarshal(value, &lst); err == nil {
+			j.Unknown = append(j.Unknown, lst...)
+			return
+		}
+	case !jsonKeys[key]:
+		j.Unknown = append(j.Unknown, Field{Line: line, Key: key, Value: string(value)})
+		return
+	case key == KeyReceived && !strings.HasPrefix(strings.TrimSpace(string(value)), `"`):
+		// a unix timestamp, as into the history files
+		j.Received, err = parseTime(string(value))
+	default:
+		// decoded apart first, so a bad value does not change the job
+		if err = json.Unmarshal(obj, &job{}); err == nil {
+			err = json.Unmarshal(obj, (*job)(j))
+		}
+	}
+
+	if err == nil {
+		err = j.checkJSON(line, key)
+	}
+
+	if err != nil {
+		j.AddError(line, key, string(value), err)
+		return
+	}
+
+	j.set[key] = true
+}
+
+// checkJSON check the decoded value of a key as Set do for an history line
+func (j *Job) checkJSON(line int, key string) error {
+	var err error
+
+	switch key {
+	case KeyJob:
+		j.JobId = strings.TrimSpace(j.JobId)
+	case KeyFo:
+		j.Fo = strings.TrimSpace(j.Fo)
+	case KeySPFScope:
+		j.SPFScope, err = parseScope(j.SPFScope)
+	case KeyReason:
+		j.Reason, err = parseReason(j.Reason)
+	case KeyDKIM:
+		var lst = make([]DKIM, 0, len(j.DKIM))
+
+		for _, d := range j.DKIM {
+			if d.Domain == "" {
+				err = fmt.Errorf("domain missing")
+				continue
+			}
+
+			d.Line = line
+			lst = append(lst, d)
+		}
+
+		j.DKIM = lst
+	}
+
+	return err
+}
+
+// Set parse the value of a key read at the given line. An unknown key is kept into Unknown,
+// a value that cannot be parsed is added to Errors and returned.
+func (j *Job) Set(line int, key, value string) error {
+	var err error
+
+	if j.set == nil {
+		j.set = make(map[string]bool)
+	}
+
+	key = strings.ToLower(key)
+
+	switch key {
+	case KeyReporter:
+		j.Reporter = value
+	case KeyReceived:
+		j.Received, err = parseTime(value)
+	case KeyIpAddr:
+		j.IpAddr = value
+	case KeyFrom:
+		j.From = value
+	case KeyMFrom:
+		j.MFrom = value
+	case KeyEnvelopeTo:
+		j.EnvelopeTo = value
+	case KeyPDomain:
+		j.PDomain = value
+	case KeyRua:
+		j.Rua = append(j.Rua, value)
+	case KeyP:
+		j.P, err = parseInt(value)
+	case KeySP:
+		j.SP, err = parseInt(value)
+	case KeyNP:
+		j.NP, err = parseInt(value)
+	case KeyPct:
+		j.Pct, err = parseInt(value)
+	case KeyADKIM:
+		j.ADKIM, err = parseInt(value)
+	case KeyASPF:
+		j.ASPF, err = parseInt(value)
+	case KeyFo:
+		j.Fo = strings.TrimSpace(value)
+	case KeyT:
+		j.T, err = parseInt(value)
+	case KeyDKIM:
+		err = j.setDKIM(line, value)
+	case KeySPF:
+		err = j.setSPF(value)
+	case KeySPFScope:
+		j.SPFScope, err = parseScope(value)
+	case KeyAlignDKIM:
+		j.AlignDKIM, err = parseInt(value)
+	case KeyAlignSPF:
+		j.AlignSPF, err = parseInt(value)
+	case KeyAction:
+		j.Action, err = parseInt(value)
+	case KeyPolicy:
+		j.Policy, err = parseInt(value)
+	case KeyReason:
+		j.Reason, err = parseReason(value)
+	case KeyARC:
+		j.ARC, err = parseInt(value)
+	case KeyARCPolicy:
+		err = j.setARCPolicy(value)
+	default:
+		j.Unknown = append(j.Unknown, Field{Line: line, Key: key, Value: value})
+		return nil
+	}
+
+	if err != nil {
+		return j.AddError(line, key, value, err)
+	}
+
+	j.set[key] = true
+	return nil
+}
+
+// setDKIM read a signature formatted as "<domain> [<selector>] <result>"
+func (j *Job) setDKIM(line int, value string) error {
+	var (
+		d   = strings.Fields(value)
+		sig = DKIM{Line: line}
+		err error
+	)
+
+	switch len(d) {
+	case 2:
+		sig.Domain = d[0]
+	case 3:
+		sig.Domain = d[0]
+		sig.Selector = d[1]
+	default:
+		return fmt.Errorf("domain or result missing")
+	}
+
+	if sig.Result, err = parseInt(d[len(d)-1]); err != nil {
+		// the signature is kept as a permanent error
+		sig.Result = DKIMPermError
+	}
+
+	j.DKIM = append(j.DKIM, sig)
+	return err
+}
+
+// setSPF read a spf result formatted as "[<domain> [<scope>]] <result>"
+func (j *Job) setSPF(value string) error {
+	var (
+		d   = strings.Fields(value)
+		err error
+	)
+
+	switch len(d) {
+	case 1:
+	case 2:
+		j.SPFDomain = d[0]
+	case 3:
+		j.SPFDomain = d[0]
+
+		if j.SPFScope, err = parseScope(d[1]); err != nil {
+			return err
+		}
+
+		j.set[KeySPFScope] = true
+	default:
+		return fmt.Errorf("result missing or too many values")
+	}
+
+	j.SPF, err = parseInt(d[len(d)-1])
+	return err
+}
+
+// setARCPolicy read the arc policy result and the evaluated seals, formatted as "<result> json:[<seal>, ...]"
+func (j *Job) setARCPolicy(value string) error {
+	var (
+		d   = strings.SplitN(strings.TrimSpace(value), " ", 2)
+		err error
+	)
+
+	if j.ARCPolicy, err = parseInt(d[0]); err != nil {
+		return err
+	} else if len(d) < 2 {
+		return nil
+	}
+
+	j.ARCSeals, err = ParseARCSeals(d[1])
+	return err
+}
+
+// ParseARCSeals decode the json list of ARC seals, with or without the "json:" prefix
+func ParseARCSeals(value string) ([]ARCSeal, error) {
+	var res = make([]ARCSeal, 0)
+
+	value = strings.TrimPrefix(strings.TrimSpace(value), "json:")
+
+	if value == "" {
+		return res, nil
+	}
+
+	err := json.Unmarshal([]byte(value), &res)
+	return res, err
+}
+
+// AddError record an error of a line of the job, and return it
+func (j *Job) AddError(line int, key, value string, err error) error {
+	e := &ParseError{
+		Line:  line,
+		JobId: j.JobId,
+		Key:   key,
+		Value: value,
+		Err:   err,
+	}
+
+	j.Errors = append(j.Errors, e)
+	return e
+}
+
+// parseScope check the scope of the spf domain
+func parseScope(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch value {
+	case "helo", "mfrom":
+		return value, nil
+	}
+
+	return "", fmt.Errorf("spf scope '%s' not understand", value)
+}
+
+// parseReason check the type of a policy override reason formatted as "<type> [<comment>]"
+func parseReason(value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	switch strings.ToLower(strings.SplitN(value, " ", 2)[0]) {
+	case "forwarded", "sampled_out", "trusted_forwarder", "mailing_list", "local_policy", "other":
+		return value, nil
+	}
+
+	return "", fmt.Errorf("policy override reason '%s' not understand", value)
+}
+
+func parseInt(value string) (int, error) {
+	val, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return int(val), err
+}
+
+// parseTime read a unix timestamp or a RFC 3339 date
+func parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if nix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(nix, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,276 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestSplitLine(t *testing.T) {
+	tst := []struct {
+		lin string
+		key string
+		val string
+		err bool
+	}{
+		{"from example.com\n", "from", "example.com", false},
+		{"DKIM example.com sel 0\r\n", "dkim", "example.com sel 0", false},
+		{"reason forwarded by list", "reason", "forwarded by list", false},
+		{"from  two spaces", "from", " two spaces", false},
+		{"from \n", "from", "", false},
+		{"novalue\n", "novalue", "", true},
+		{" leading space", "", "", true},
+		{"\n", "", "", true},
+	}
+
+	for _, tc := range tst {
+		key, val, err := SplitLine(tc.lin)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.lin, err, tc.err)
+		} else if key != tc.key || val != tc.val {
+			t.Errorf("%q: got key '%s' value '%s', want key '%s' value '%s'", tc.lin, key, val, tc.key, tc.val)
+		}
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	tst := []struct {
+		str string
+		res string
+		err bool
+	}{
+		{"mfrom", "mfrom", false},
+		{" HELO ", "helo", false},
+		{"", "", true},
+		{"pra", "", true},
+	}
+
+	for _, tc := range tst {
+		res, err := parseScope(tc.str)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.str, err, tc.err)
+		} else if res != tc.res {
+			t.Errorf("%q: got '%s', want '%s'", tc.str, res, tc.res)
+		}
+	}
+}
+
+func TestParseReason(t *testing.T) {
+	tst := []struct {
+		str string
+		res string
+		err bool
+	}{
+		{"forwarded", "forwarded", false},
+		{" mailing_list list.example.org ", "mailing_list list.example.org", false},
+		{"Local_Policy by admin", "Local_Policy by admin", false},
+		{"sampled_out", "sampled_out", false},
+		{"trusted_forwarder", "trusted_forwarder", false},
+		{"other", "other", false},
+		{"", "", true},
+		{"forwarded_by list", "", true},
+	}
+
+	for _, tc := range tst {
+		res, err := parseReason(tc.str)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.str, err, tc.err)
+		} else if res != tc.res {
+			t.Errorf("%q: got '%s', want '%s'", tc.str, res, tc.res)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tst := []struct {
+		str string
+		res int64
+		err bool
+	}{
+		{"1525859396", 1525859396, false},
+		{" 1525859396\n", 1525859396, false},
+		{"2018-05-09T10:29:56Z", 1525861796, false},
+		{"2018-05-09T12:29:56+02:00", 1525861796, false},
+		{"2018-05-09 10:29:56", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tc := range tst {
+		res, err := parseTime(tc.str)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.str, err, tc.err)
+		} else if !tc.err && res.Unix() != tc.res {
+			t.Errorf("%q: got %s, want %s", tc.str, res, time.Unix(tc.res, 0))
+		}
+	}
+}
+
+func TestSetDKIM(t *testing.T) {
+	tst := []struct {
+		val string
+		sig []DKIM
+		err bool
+	}{
+		{"example.com sel1 0", []DKIM{{Line: 7, Domain: "example.com", Selector: "sel1", Result: 0}}, false},
+		{"example.com  2", []DKIM{{Line: 7, Domain: "example.com", Result: 2}}, false},
+		{"example.com sel1 fail", []DKIM{{Line: 7, Domain: "example.com", Selector: "sel1", Result: DKIMPermError}}, true},
+		{"example.com", nil, true},
+		{"example.com sel1 0 extra", nil, true},
+	}
+
+	for _, tc := range tst {
+		j := NewJob("A", 1, 0)
+		err := j.Set(7, KeyDKIM, tc.val)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.val, err, tc.err)
+		} else if !reflect.DeepEqual(j.DKIM, tc.sig) {
+			t.Errorf("%q: got signatures %+v, want %+v", tc.val, j.DKIM, tc.sig)
+		} else if tc.err && (len(j.Errors) != 1 || j.Errors[0].Line != 7 || j.Errors[0].Key != KeyDKIM) {
+			t.Errorf("%q: got errors %v", tc.val, j.Errors)
+		}
+	}
+}
+
+func TestSetSPF(t *testing.T) {
+	tst := []struct {
+		val string
+		res int
+		dom string
+		scp string
+		err bool
+	}{
+		{"0", 0, "", "", false},
+		{"example.com 2", 2, "example.com", "", false},
+		{"example.com helo 1", 1, "example.com", "helo", false},
+		{"example.com pra 1", 0, "example.com", "", true},
+		{"example.com mfrom 1 extra", 0, "", "", true},
+		{"", 0, "", "", true},
+	}
+
+	for _, tc := range tst {
+		j := NewJob("A", 1, 0)
+		err := j.Set(3, KeySPF, tc.val)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.val, err, tc.err)
+		} else if j.SPF != tc.res || j.SPFDomain != tc.dom || j.SPFScope != tc.scp {
+			t.Errorf("%q: got result %d domain '%s' scope '%s'", tc.val, j.SPF, j.SPFDomain, j.SPFScope)
+		} else if j.Has(KeySPF) == tc.err {
+			t.Errorf("%q: got spf set %v", tc.val, j.Has(KeySPF))
+		} else if j.Has(KeySPFScope) != (tc.scp != "") {
+			t.Errorf("%q: got spf scope set %v", tc.val, j.Has(KeySPFScope))
+		}
+	}
+}
+
+func TestParseARCSeals(t *testing.T) {
+	tst := []struct {
+		val string
+		res []ARCSeal
+		err bool
+	}{
+		{"", []ARCSeal{}, false},
+		{"json:[]", []ARCSeal{}, false},
+		{
+			`json:[{"i":2,"d":"b.example","s":"s2","ip":"192.0.2.2"},{"i":1,"d":"a.example","s":"s1"}]`,
+			[]ARCSeal{{Instance: 2, Domain: "b.example", Selector: "s2", Ip: "192.0.2.2"}, {Instance: 1, Domain: "a.example", Selector: "s1"}},
+			false,
+		},
+		{` [{"i":1,"d":"a.example","s":"s1"}] `, []ARCSeal{{Instance: 1, Domain: "a.example", Selector: "s1"}}, false},
+		{"json:{", nil, true},
+	}
+
+	for _, tc := range tst {
+		res, err := ParseARCSeals(tc.val)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.val, err, tc.err)
+		} else if !tc.err && !reflect.DeepEqual(res, tc.res) {
+			t.Errorf("%q: got %+v, want %+v", tc.val, res, tc.res)
+		}
+	}
+}
+
+func TestSetUnknown(t *testing.T) {
+	j := NewJob("A", 1, 0)
+
+	if err := j.Set(4, "X-Custom", "a value"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exp := []Field{{Line: 4, Key: "x-custom", Value: "a value"}}; !reflect.DeepEqual(j.Unknown, exp) {
+		t.Errorf("got unknown %+v, want %+v", j.Unknown, exp)
+	} else if j.Has("x-custom") {
+		t.Errorf("unknown key set as a known key")
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	const obj = `{"job":" A ","line":12,"received":1525859396,"from":"example.com","spf":"abc","action":2,
+		"spf_scope":"pra","dkim":[{"domain":"example.com","selector":"s1","result":0},{"result":1}],"x-custom":[1]}`
+
+	job, err := ParseJSON(3, []byte(obj))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if job.JobId != "A" || job.Line != 3 || job.From != "example.com" || job.Action != 2 || job.Received.Unix() != 1525859396 {
+		t.Errorf("got job %+v", job)
+	}
+
+	if !job.Has(KeyAction) || !job.Has(KeyFrom) || job.Has(KeySPF) || job.Has(KeySPFScope) {
+		t.Errorf("got keys set action %v from %v spf %v spf_scope %v", job.Has(KeyAction), job.Has(KeyFrom), job.Has(KeySPF), job.Has(KeySPFScope))
+	}
+
+	if exp := []DKIM{{Line: 3, Domain: "example.com", Selector: "s1"}}; !reflect.DeepEqual(job.DKIM, exp) {
+		t.Errorf("got dkim %+v, want %+v", job.DKIM, exp)
+	}
+
+	if exp := []Field{{Line: 3, Key: "x-custom", Value: "[1]"}}; !reflect.DeepEqual(job.Unknown, exp) {
+		t.Errorf("got unknown %+v, want %+v", job.Unknown, exp)
+	}
+
+	var key []string
+
+	for _, e := range job.Errors {
+		if e.Line != 3 || e.JobId != "A" {
+			t.Errorf("got error %+v", e)
+		}
+
+		key = append(key, e.Key)
+	}
+
+	if exp := []string{KeyDKIM, KeySPF, KeySPFScope}; !reflect.DeepEqual(key, exp) {
+		t.Errorf("got errors of keys %v, want %v", key, exp)
+	}
+
+	if job.SPF != 0 || job.SPFScope != "" {
+		t.Errorf("got spf %d scope '%s' from bad values", job.SPF, job.SPFScope)
+	}
+
+	if _, err = ParseJSON(1, []byte(`["job"]`)); err == nil {
+		t.Errorf("got no error for a json list")
+	}
+}
@@ -0,0 +1,166 @@
+package history
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// JobReader is a reader of jobs, from an history file or rebuilt from syslog
+type JobReader interface {
+	Next() (*Job, error)
+}
+
+// Reader read the jobs of an OpenDMARC history file
+type Reader struct {
+	r    *bufio.Reader
+	cur  *Job
+	part string
+	line int
+	off  int64
+}
+
+// NewReader return a reader of the history lines of r
+func NewReader(r io.Reader) *Reader {
+	return NewReaderAt(r, 0)
+}
+
+// NewReaderAt return a reader of r, already positioned at the byte offset of the underlying file.
+// The job offsets start from this offset, but the line numbers start from 1.
+func NewReaderAt(r io.Reader, offset int64) *Reader {
+	return NewReaderLine(r, offset, 0)
+}
+
+// NewReaderLine return a reader of r, already positioned at the byte offset of the underlying file
+// after the given number of lines : the job offsets and the line numbers are the ones of the file.
+func NewReaderLine(r io.Reader, offset int64, line int) *Reader {
+	return &Reader{
+		r:    bufio.NewReader(r),
+		off:  offset,
+		line: line,
+	}
+}
+
+// Next return the next job, once its last line is read. It return io.EOF at the end of input.
+// A *ParseError is returned for a line outside of any job, the reading can continue after it.
+// On another error, the line partially read is kept and the reading can continue if the error is temporary.
+func (r *Reader) Next() (*Job, error) {
+	for {
+		txt, err := r.r.ReadString('\n')
+		txt, r.part = r.part+txt, ""
+
+		if err != nil && err != io.EOF {
+			r.part = txt
+			return nil, err
+		} else if err == io.EOF && txt == "" {
+			if job := r.cur; job != nil {
+				r.cur = nil
+				return job, nil
+			}
+
+			return nil, io.EOF
+		}
+
+		r.line++
+		beg := r.off
+		r.off += int64(len(txt))
+
+		if strings.TrimSpace(txt) == "" {
+			continue
+		}
+
+		key, val, err := SplitLine(txt)
+
+		if err != nil {
+			var raw string
+
+			if key == "" {
+				raw = strings.TrimRight(txt, "\r\n")
+			}
+
+			if r.cur == nil {
+				return nil, &ParseError{Line: r.line, Key: key, Value: raw, Err: err}
+			}
+
+			r.cur.AddError(r.line, key, raw, err)
+			continue
+		}
+
+		if key == KeyJob {
+			job := r.cur
+			r.cur = NewJob(strings.TrimSpace(val), r.line, beg)
+
+			if job != nil {
+				return job, nil
+			}
+
+			continue
+		}
+
+		if r.cur == nil {
+			return nil, &ParseError{Line: r.line, Key: key, Value: val, Err: errors.New("line outside of a job")}
+		}
+
+		r.cur.Set(r.line, key, val)
+	}
+}
+
+// Flush return the pending job as complete, as if the next job line was read : a reader of a stream can so
+// return the last job received before a pause. It return nil without pending job or if a line is partially read.
+func (r *Reader) Flush() *Job {
+	if r.part != "" {
+		return nil
+	}
+
+	job := r.cur
+	r.cur = nil
+
+	return job
+}
+
+// Continue make the job the pending job, as if its job line was just read : the lines read before the next
+// job line are added to it. A followed file so complete the last job of the file it replaced, the offset
+// of the job is moved to the current offset.
+func (r *Reader) Continue(job *Job) {
+	job.Offset = r.off
+	r.cur = job
+}
+
+// Drop discard the line partially read and return it, the pending job can then be flushed
+func (r *Reader) Drop() string {
+	txt := r.part
+	r.part = ""
+
+	return txt
+}
+
+// Offset return the byte offset of the first line not yet returned into a job
+func (r *Reader) Offset() int64 {
+	if r.cur != nil {
+		return r.cur.Offset
+	}
+
+	return r.off
+}
+
+// Line return the number of lines read
+func (r *Reader) Line() int {
+	return r.line
+}
@@ -0,0 +1,485 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const testHistory = `job 4A0E31C0A2B
+reporter mail.example.org
+received 1525859396
+ipaddr 192.0.2.10
+from example.com
+mfrom bounce.example.com
+rua mailto:dmarc@example.com
+p 110
+sp 113
+pct 100
+adkim 114
+aspf 115
+t 0
+dkim example.com sel1 0
+dkim other.example.net 2
+spf bounce.example.com mfrom 0
+align_dkim 4
+align_spf 5
+action 2
+pdomain example.com
+policy 14
+arc 2
+arc_policy 0 json:[{"i":1,"d":"relay.example.net","s":"arc","ip":"198.51.100.1"}]
+job 4A0E31C0A2C
+reporter mail.example.org
+received 1525859400
+ipaddr 2001:db8::1
+from example.net
+p 0
+spf 2
+`
+
+// readAll return the jobs of the history text, the parse errors outside of jobs are returned apart
+func readAll(t testing.TB, txt string) ([]*Job, []*ParseError) {
+	var (
+		rdr = NewReader(strings.NewReader(txt))
+		res = make([]*Job, 0)
+		bad = make([]*ParseError, 0)
+	)
+
+	for {
+		job, err := rdr.Next()
+
+		if err == io.EOF {
+			return res, bad
+		}
+
+		var per *ParseError
+
+		if errors.As(err, &per) {
+			bad = append(bad, per)
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else {
+			res = append(res, job)
+		}
+	}
+}
+
+// writeAll return the history text of the jobs
+func writeAll(t testing.TB, jobs []*Job) string {
+	var (
+		buf = bytes.NewBuffer(make([]byte, 0))
+		wrt = NewWriter(buf)
+	)
+
+	for _, j := range jobs {
+		if err := wrt.Write(j); err != nil {
+			t.Fatalf("job '%s': unexpected error: %v", j.JobId, err)
+		}
+	}
+
+	if err := wrt.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	tst := []struct {
+		nam string
+		in  string
+		out string
+	}{
+		{
+			"opendmarc",
+			testHistory,
+			testHistory,
+		},
+		{
+			"zero values",
+			"job A\np 0\npct 0\naction 0\nspf 0\n",
+			"job A\np 0\npct 0\nspf 0\naction 0\n",
+		},
+		{
+			"unset values",
+			"job A\nreporter mx\n",
+			"job A\nreporter mx\n",
+		},
+		{
+			"key order and case",
+			"job A\nACTION 1\nFrom example.com\nP 114\n",
+			"job A\nfrom example.com\np 114\naction 1\n",
+		},
+		{
+			"unknown keys last",
+			"job A\nx-custom one two\nfrom example.com\nx-other 3\n",
+			"job A\nfrom example.com\nx-custom one two\nx-other 3\n",
+		},
+		{
+			"extension keys",
+			"job A\nenvelope_to example.org\nfo 1:d\nspf example.com 0\nspf_scope helo\nreason forwarded by list\n",
+			"job A\nenvelope_to example.org\nfo 1:d\nspf example.com helo 0\nreason forwarded by list\n",
+		},
+		{
+			"spf scope without domain",
+			"job A\nspf 0\nspf_scope mfrom\n",
+			"job A\nspf 0\nspf_scope mfrom\n",
+		},
+		{
+			"rfc 3339 received",
+			"job A\nreceived 2018-05-09T10:29:56Z\n",
+			"job A\nreceived 1525861796\n",
+		},
+		{
+			"arc seals without prefix",
+			"job A\narc_policy 1 [{\"i\":1,\"d\":\"a.example\",\"s\":\"s1\"}]\n",
+			"job A\narc_policy 1 json:[{\"i\":1,\"d\":\"a.example\",\"s\":\"s1\"}]\n",
+		},
+		{
+			"invalid lines dropped",
+			"job A\nfrom example.com\naction abc\nnovalue\n\ndkim example.com\n",
+			"job A\nfrom example.com\n",
+		},
+		{
+			"lines outside of a job",
+			"from example.com\n\njob A\nreporter mx\n",
+			"job A\nreporter mx\n",
+		},
+		{
+			"crlf and no final newline",
+			"job A\r\nreporter mx\r\nunknown value\r\njob B\r\np 1",
+			"job A\nreporter mx\nunknown value\njob B\np 1\n",
+		},
+	}
+
+	for _, tc := range tst {
+		job, _ := readAll(t, tc.in)
+		out := writeAll(t, job)
+
+		if out != tc.out {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.nam, out, tc.out)
+			continue
+		}
+
+		if job2, _ := readAll(t, out); len(job2) != len(job) {
+			t.Errorf("%s: got %d jobs after round trip, want %d", tc.nam, len(job2), len(job))
+		} else if out2 := writeAll(t, job2); out2 != out {
+			t.Errorf("%s: round trip not stable, got\n%s\nwant\n%s", tc.nam, out2, out)
+		}
+	}
+}
+
+func TestReaderLines(t *testing.T) {
+	const txt = "ipaddr 192.0.2.1\n" + // 1: outside of a job
+		"job A\n" + // 2
+		"x-custom 1\n" + // 3
+		"\n" + // 4
+		"dkim example.com sel 0\n" + // 5
+		"action abc\n" + // 6
+		"novalue\n" + // 7
+		" leading space\n" + // 8
+		"job B\n" + // 9
+		"X-Custom 2\n" + // 10
+		"dkim example.net 1\n" // 11
+
+	job, bad := readAll(t, txt)
+
+	if len(bad) != 1 {
+		t.Fatalf("got %d errors outside of jobs, want 1", len(bad))
+	} else if e := bad[0]; e.Line != 1 || e.Key != KeyIpAddr || e.Value != "192.0.2.1" {
+		t.Errorf("got error outside of job %+v", e)
+	}
+
+	if len(job) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(job))
+	}
+
+	a, b := job[0], job[1]
+
+	if a.JobId != "A" || a.Line != 2 || a.Offset != 17 {
+		t.Errorf("job A: got id '%s', line %d, offset %d", a.JobId, a.Line, a.Offset)
+	}
+
+	if b.JobId != "B" || b.Line != 9 || b.Offset != int64(strings.Index(txt, "job B")) {
+		t.Errorf("job B: got id '%s', line %d, offset %d", b.JobId, b.Line, b.Offset)
+	}
+
+	if exp := []Field{{Line: 3, Key: "x-custom", Value: "1"}}; !reflect.DeepEqual(a.Unknown, exp) {
+		t.Errorf("job A: got unknown %+v, want %+v", a.Unknown, exp)
+	}
+
+	if exp := []Field{{Line: 10, Key: "x-custom", Value: "2"}}; !reflect.DeepEqual(b.Unknown, exp) {
+		t.Errorf("job B: got unknown %+v, want %+v", b.Unknown, exp)
+	}
+
+	if exp := []DKIM{{Line: 5, Domain: "example.com", Selector: "sel", Result: 0}}; !reflect.DeepEqual(a.DKIM, exp) {
+		t.Errorf("job A: got dkim %+v, want %+v", a.DKIM, exp)
+	}
+
+	if exp := []DKIM{{Line: 11, Domain: "example.net", Result: 1}}; !reflect.DeepEqual(b.DKIM, exp) {
+		t.Errorf("job B: got dkim %+v, want %+v", b.DKIM, exp)
+	}
+
+	exp := []struct {
+		line int
+		key  string
+		val  string
+	}{
+		{6, KeyAction, "abc"},
+		{7, "novalue", ""},
+		{8, "", " leading space"},
+	}
+
+	if len(a.Errors) != len(exp) {
+		t.Fatalf("job A: got %d errors, want %d", len(a.Errors), len(exp))
+	}
+
+	for i, e := range exp {
+		if g := a.Errors[i]; g.Line != e.line || g.Key != e.key || g.Value != e.val || g.JobId != "A" {
+			t.Errorf("job A: error %d: got %+v, want line %d key '%s' value '%s'", i, g, e.line, e.key, e.val)
+		}
+	}
+
+	if a.Has(KeyAction) || !a.HasError(KeyAction) {
+		t.Errorf("job A: action set with an invalid value")
+	} else if a.HasError(KeyDKIM) {
+		t.Errorf("job A: dkim error without bad dkim line")
+	}
+
+	if len(b.Errors) != 0 {
+		t.Errorf("job B: got errors %v", b.Errors)
+	}
+}
+
+func TestReaderOffset(t *testing.T) {
+	const (
+		off = int64(1000)
+		txt = "job A\nfrom example.com\njob B\nfrom example.net\n"
+	)
+
+	rdr := NewReaderAt(strings.NewReader(txt), off)
+
+	if rdr.Offset() != off {
+		t.Errorf("got offset %d before reading, want %d", rdr.Offset(), off)
+	}
+
+	job, err := rdr.Next()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if job.JobId != "A" || job.Offset != off || job.Line != 1 {
+		t.Errorf("got job '%s' at offset %d line %d", job.JobId, job.Offset, job.Line)
+	}
+
+	// job B is pending : its offset is the resume point
+	if exp := off + int64(strings.Index(txt, "job B")); rdr.Offset() != exp {
+		t.Errorf("got offset %d with a pending job, want %d", rdr.Offset(), exp)
+	}
+
+	if job, err = rdr.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if job.JobId != "B" || job.Line != 3 {
+		t.Errorf("got job '%s' at line %d", job.JobId, job.Line)
+	}
+
+	if _, err = rdr.Next(); err != io.EOF {
+		t.Errorf("got error %v, want EOF", err)
+	}
+
+	if exp := off + int64(len(txt)); rdr.Offset() != exp {
+		t.Errorf("got offset %d at the end, want %d", rdr.Offset(), exp)
+	}
+
+	if rdr.Line() != 4 {
+		t.Errorf("got %d lines read, want 4", rdr.Line())
+	}
+}
+
+// FuzzReader check that any input can be read without panic and that the jobs read then written
+// are written again the same once read back
+func FuzzReader(f *testing.F) {
+	f.Add(testHistory)
+	f.Add("job A\r\nreporter mx\r\nunknown value\r\njob B\r\np 1")
+	f.Add("from example.com\njob A\naction abc\nnovalue\n dkim\njob\n")
+	f.Add("job A\nspf example.com helo 0\nspf_scope mfrom\nreason other\narc_policy 1 json:[]\n")
+	f.Add("job A\nreceived 2018-05-09T10:29:56+02:00\ndkim a b c d\nfo \n")
+
+	f.Fuzz(func(t *testing.T, txt string) {
+		var (
+			rdr = NewReader(strings.NewReader(txt))
+			lst = rdr.Offset()
+		)
+
+		for {
+			job, err := rdr.Next()
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				var per *ParseError
+
+				if !errors.As(err, &per) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if job.Offset < lst || job.Line < 1 || job.Line > rdr.Line() {
+				t.Fatalf("job '%s' at offset %d line %d, after offset %d line %d", job.JobId, job.Offset, job.Line, lst, rdr.Line())
+			}
+
+			if rdr.Offset() < lst || rdr.Offset() > int64(len(txt)) {
+				t.Fatalf("offset %d out of range [%d, %d]", rdr.Offset(), lst, len(txt))
+			}
+
+			lst = rdr.Offset()
+		}
+
+		if rdr.Offset() != int64(len(txt)) {
+			t.Fatalf("got offset %d at the end, want %d", rdr.Offset(), len(txt))
+		}
+
+		job, _ := readAll(t, txt)
+		val := make([]*Job, 0, len(job))
+
+		for _, j := range job {
+			if j.JobId != "" {
+				val = append(val, j)
+			}
+		}
+
+		out := writeAll(t, val)
+		job, _ = readAll(t, out)
+
+		if out2 := writeAll(t, job); out2 != out {
+			t.Fatalf("round trip not stable, got\n%q\nwant\n%q", out2, out)
+		}
+	})
+}
+
+// pauseReader return its chunks one per read, an empty chunk return a pause error
+type pauseReader struct {
+	lst []string
+}
+
+var errPause = errors.New("pause")
+
+func (p *pauseReader) Read(b []byte) (int, error) {
+	if len(p.lst) == 0 {
+		return 0, io.EOF
+	}
+
+	c := p.lst[0]
+	p.lst = p.lst[1:]
+
+	if c == "" {
+		return 0, errPause
+	}
+
+	return copy(b, c), nil
+}
+
+func TestReaderFlush(t *testing.T) {
+	var (
+		src = &pauseReader{lst: []string{"job A\nfrom exa", "", "mple.com\n", "", "job B\nfrom example.net\n"}}
+		rdr = NewReader(src)
+	)
+
+	if rdr.Flush() != nil {
+		t.Errorf("got a job before reading")
+	}
+
+	// paused into a line : job A is not complete
+	if _, err := rdr.Next(); err != errPause {
+		t.Fatalf("got error %v, want pause", err)
+	} else if rdr.Flush() != nil {
+		t.Fatalf("got job A while a line is partially read")
+	}
+
+	if _, err := rdr.Next(); err != errPause {
+		t.Fatalf("got error %v, want pause", err)
+	}
+
+	job := rdr.Flush()
+
+	if job == nil {
+		t.Fatalf("got no job A after the pause")
+	} else if job.JobId != "A" || job.From != "example.com" || len(job.Errors) != 0 {
+		t.Errorf("got job '%s' from '%s' with errors %v", job.JobId, job.From, job.Errors)
+	} else if rdr.Flush() != nil {
+		t.Errorf("got job A twice")
+	}
+
+	if job, err := rdr.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if job.JobId != "B" || job.Line != 3 || job.Offset != int64(len("job A\nfrom example.com\n")) {
+		t.Errorf("got job '%s' at line %d offset %d", job.JobId, job.Line, job.Offset)
+	}
+
+	if _, err := rdr.Next(); err != io.EOF {
+		t.Errorf("got error %v, want EOF", err)
+	}
+}
+
+func TestReaderContinue(t *testing.T) {
+	var (
+		old = NewJob("A", 1, 0)
+		txt = "received never\nfrom example.com\n"
+		// the new file start after 10 lines and 100 bytes, with a partial line at its end
+		src = &pauseReader{lst: []string{txt + "job B\nfrom example.net\nfrom exa", ""}}
+		rdr = NewReaderLine(src, 100, 10)
+	)
+
+	rdr.Continue(old)
+
+	if rdr.Offset() != 100 {
+		t.Errorf("got offset %d of the continued job, want 100", rdr.Offset())
+	}
+
+	if job, err := rdr.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if job != old || job.From != "example.com" {
+		t.Errorf("got job '%s' from '%s'", job.JobId, job.From)
+	} else if len(job.Errors) != 1 || job.Errors[0].Line != 11 {
+		t.Errorf("got errors %v, want one at line 11", job.Errors)
+	}
+
+	if _, err := rdr.Next(); err != errPause {
+		t.Fatalf("got error %v, want pause", err)
+	} else if rdr.Flush() != nil {
+		t.Fatalf("got job B while a line is partially read")
+	}
+
+	if txt := rdr.Drop(); txt != "from exa" {
+		t.Errorf("got partial line %q", txt)
+	}
+
+	job := rdr.Flush()
+
+	if job == nil {
+		t.Fatalf("got no job B once the partial line is dropped")
+	} else if job.JobId != "B" || job.Line != 13 || job.Offset != 100+int64(len(txt)) || job.From != "example.net" {
+		t.Errorf("got job '%s' from '%s' at line %d offset %d", job.JobId, job.From, job.Line, job.Offset)
+	}
+
+	if off := 100 + int64(len(txt+"job B\nfrom example.net\n")); rdr.Offset() != off {
+		t.Errorf("got offset %d, want %d", rdr.Offset(), off)
+	}
+}
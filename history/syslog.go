@@ -0,0 +1,562 @@
+package history
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// number of lines read after the last line of a job before the job is complete
+const syslogWindow = 1000
+
+// keys of a job rebuilt from syslog, the ones not found are listed into Missing
+var syslogKeys = []string{KeyReporter, KeyReceived, KeyIpAddr, KeyFrom, KeyMFrom, KeyPDomain, KeyRua, KeyP, KeyDKIM, KeySPF, KeyAlignDKIM, KeyAlignSPF, KeyAction}
+
+var (
+	// rfc 3164 or rfc 3339 timestamp, host, program[pid]: message
+	syslogHeader = regexp.MustCompile(`^(\w{3} +\d{1,2} \d\d:\d\d:\d\d|\d{4}-\d\d-\d\dT\S+) (\S+) ([^:\[ ]+)(?:\[\d+\])?: (.*)$`)
+	// <job id>: <text>
+	syslogJobId = regexp.MustCompile(`^([0-9A-Za-z]+): (.*)$`)
+	// opendmarc result : <from domain> <dmarc result>
+	syslogResult = regexp.MustCompile(`^(\S+\.\S+) (none|pass|fail|bestguesspass|temperror|permerror|reject|quarantine)$`)
+	// opendmarc spf : SPF(<scope>): <domain> <result>
+	syslogSPF = regexp.MustCompile(`^SPF\((\w+)\): (\S+) (\w+)$`)
+	// client ip of postfix smtpd or of a header_checks warning
+	syslogClient = regexp.MustCompile(`(?:^client=|\sfrom )\S*?\[([0-9A-Fa-f:.]+)\]`)
+	// envelope sender of postfix qmgr
+	syslogFrom = regexp.MustCompile(`^from=<[^>]*@([^>@]+)>`)
+	// comment of an authentication result
+	syslogComment = regexp.MustCompile(`\(([^)]*)\)`)
+)
+
+// SyslogReader rebuild the jobs from the OpenDMARC results and the Authentication-Results headers
+// logged to syslog, and the postfix client and sender lines of the same job id. The lines of a job
+// could be mixed with other jobs, so a job is complete once syslogWindow lines are read after its
+// last line, or at the end of input. The jobs without any dmarc result are ignored.
+type SyslogReader struct {
+	r    *bufio.Reader
+	line int
+	now  time.Time
+	jobs map[string]*syslogJob
+	// que is the list of pending job ids in order of their first line
+	que []string
+}
+
+type syslogJob struct {
+	job  *Job
+	last int
+	// dmarc is the result logged by opendmarc or into the Authentication-Results header, srv the authserv-id of the header
+	dmarc string
+	srv   string
+}
+
+// NewSyslogReader return a reader of the syslog lines of r
+func NewSyslogReader(r io.Reader) *SyslogReader {
+	return &SyslogReader{
+		r:    bufio.NewReader(r),
+		now:  time.Now(),
+		jobs: make(map[string]*syslogJob),
+		que:  make([]string, 0),
+	}
+}
+
+// Next return the next complete job. It return io.EOF at the end of input.
+func (r *SyslogReader) Next() (*Job, error) {
+	for {
+		if j := r.complete(false); j != nil {
+			return j, nil
+		}
+
+		txt, err := r.r.ReadString('\n')
+
+		if err == io.EOF && txt == "" {
+			if j := r.complete(true); j != nil {
+				return j, nil
+			}
+
+			return nil, io.EOF
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		r.line++
+		r.parse(strings.TrimRight(txt, "\r\n"))
+	}
+}
+
+// complete return the first job complete, all jobs are complete at the end of input
+func (r *SyslogReader) complete(end bool) *Job {
+	for len(r.que) > 0 {
+		s := r.jobs[r.que[0]]
+
+		if !end && s.last+syslogWindow > r.line {
+			return nil
+		}
+
+		r.que = r.que[1:]
+		delete(r.jobs, s.job.JobId)
+
+		// not evaluated by opendmarc
+		if s.job.Has(KeyFrom) {
+			return s.finish()
+		}
+	}
+
+	return nil
+}
+
+// parse read a syslog line and add its values to its job
+func (r *SyslogReader) parse(txt string) {
+	hdr := syslogHeader.FindStringSubmatch(txt)
+	if hdr == nil {
+		return
+	}
+
+	msg := syslogJobId.FindStringSubmatch(hdr[4])
+	if msg == nil || strings.ToLower(msg[1]) == msg[1] && strings.IndexAny(msg[1], "0123456789") < 0 {
+		// a lower case word is not a job id (warning, error...)
+		return
+	} else if msg[1] == "NOQUEUE" {
+		// a message without queue id (rejected before queued), its lines cannot be grouped
+		return
+	}
+
+	s, ok := r.jobs[msg[1]]
+	if !ok {
+		s = &syslogJob{job: NewJob(msg[1], r.line, 0)}
+		r.jobs[msg[1]] = s
+		r.que = append(r.que, msg[1])
+
+		if t, err := r.parseTime(hdr[1]); err == nil {
+			s.job.Set(r.line, KeyReceived, t.Format(time.RFC3339))
+		}
+	}
+
+	s.last = r.line
+	s.set(r.line, hdr[2], msg[2])
+}
+
+// parseTime read a syslog timestamp, a rfc 3164 timestamp without year is into the last twelve months
+func (r *SyslogReader) parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("Jan _2 15:04:05", strings.Join(strings.Fields(value), " "), time.Local)
+	if err != nil {
+		return t, err
+	}
+
+	t = t.AddDate(r.now.Year(), 0, 0)
+
+	if t.After(r.now.AddDate(0, 0, 1)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t, nil
+}
+
+// set read the message of a syslog line of the job
+func (s *syslogJob) set(line int, host, msg string) {
+	var j = s.job
+
+	if !j.Has(KeyReporter) {
+		j.Set(line, KeyReporter, host)
+	}
+
+	if m := syslogClient.FindStringSubmatch(msg); m != nil && !j.Has(KeyIpAddr) {
+		j.Set(line, KeyIpAddr, m[1])
+	}
+
+	if i := strings.Index(msg, "Authentication-Results:"); i >= 0 {
+		s.setAuthResults(line, msg[i+len("Authentication-Results:"):])
+	} else if m := syslogResult.FindStringSubmatch(msg); m != nil {
+		s.setFrom(line, m[1])
+		s.dmarc = m[2]
+
+		switch m[2] {
+		case "reject", "quarantine":
+			s.dmarc = "fail"
+			j.Set(line, KeyAction, strconv.Itoa(syslogAction(m[2])))
+		}
+	} else if m = syslogSPF.FindStringSubmatch(msg); m != nil && !j.Has(KeySPF) {
+		s.setSPF(line, m[1], m[2], m[3])
+	} else if m = syslogFrom.FindStringSubmatch(msg); m != nil && !j.Has(KeyMFrom) {
+		j.Set(line, KeyMFrom, strings.ToLower(m[1]))
+	}
+}
+
+// setAuthResults read an Authentication-Results header formatted as
+// "<authserv-id>; <method>=<result> [(<comment>)] [<ptype>.<property>=<value> ...]; ..."
+func (s *syslogJob) setAuthResults(line int, value string) {
+	var j = s.job
+
+	// the header could be followed by the client of a postfix header_checks warning
+	if i := strings.Index(value, " from "); i >= 0 && syslogClient.MatchString(value[i:]) {
+		value = value[:i]
+	}
+
+	lst := syslogSplit(value)
+	srv := strings.Fields(lst[0])
+
+	if len(srv) < 1 || s.srv != "" && s.srv != srv[0] {
+		// only the header added by the reporter is read
+		return
+	}
+
+	s.srv = srv[0]
+	j.Set(line, KeyReporter, srv[0])
+
+	for _, res := range lst[1:] {
+		var (
+			cmt = syslogComment.FindStringSubmatch(res)
+			fld = strings.Fields(syslogComment.ReplaceAllString(res, " "))
+			prp = make(map[string]string)
+		)
+
+		if len(fld) < 1 || !strings.Contains(fld[0], "=") {
+			continue
+		}
+
+		for _, f := range append(fld[1:], syslogFields(cmt)...) {
+			if p := strings.SplitN(f, "=", 2); len(p) == 2 {
+				prp[strings.ToLower(p[0])] = strings.Trim(p[1], "\"")
+			}
+		}
+
+		var (
+			mtd = strings.SplitN(strings.ToLower(fld[0]), "=", 2)
+			rst = mtd[1]
+		)
+
+		switch mtd[0] {
+		case "dmarc":
+			s.dmarc = rst
+			s.setFrom(line, prp["header.from"])
+
+			if p, ok := prp["p"]; ok && !j.Has(KeyP) {
+				j.Set(line, KeyP, strconv.Itoa(syslogPolicy(p)))
+			}
+
+			if d, ok := prp["dis"]; ok {
+				j.Set(line, KeyAction, strconv.Itoa(syslogAction(d)))
+			}
+		case "spf":
+			if d := prp["smtp.mailfrom"]; d != "" {
+				s.setSPF(line, "mfrom", d, rst)
+			} else if d = prp["smtp.helo"]; d != "" {
+				s.setSPF(line, "helo", d, rst)
+			}
+		case "dkim":
+			d := prp["header.d"]
+
+			if i := strings.LastIndex(prp["header.i"], "@"); d == "" && i >= 0 {
+				d = prp["header.i"][i+1:]
+			}
+
+			if d != "" {
+				j.Set(line, KeyDKIM, strings.TrimSpace(fmt.Sprintf("%s %s %d", strings.ToLower(d), prp["header.s"], syslogResultCode(rst))))
+			}
+		}
+	}
+}
+
+// setFrom set the from domain, also used as policy domain as the organizational domain is not known
+func (s *syslogJob) setFrom(line int, domain string) {
+	if domain = strings.ToLower(domain); domain == "" || s.job.Has(KeyFrom) {
+		return
+	}
+
+	s.job.Set(line, KeyFrom, domain)
+	s.job.Set(line, KeyPDomain, domain)
+}
+
+// setSPF set the spf result, the domain is the envelope sender domain for the mfrom scope
+func (s *syslogJob) setSPF(line int, scope, domain, result string) {
+	var j = s.job
+
+	if i := strings.LastIndex(domain, "@"); i >= 0 {
+		domain = domain[i+1:]
+	}
+
+	if scope = strings.ToLower(scope); scope == "mailfrom" {
+		scope = "mfrom"
+	}
+
+	domain = strings.ToLower(domain)
+
+	if scope == "mfrom" && !j.Has(KeyMFrom) {
+		j.Set(line, KeyMFrom, domain)
+	}
+
+	j.Set(line, KeySPF, fmt.Sprintf("%s %s %d", domain, scope, syslogResultCode(result)))
+}
+
+// finish compute the alignments from the results found and list the keys not recovered.
+// The results not recovered are set as none, so they are not reported as pass.
+func (s *syslogJob) finish() *Job {
+	var j = s.job
+
+	j.dmarc = s.dmarc
+	j.syslogAlign()
+
+	// the policy is not applied to a message passing dmarc
+	if !j.Has(KeyAction) && s.dmarc == "pass" {
+		j.Set(j.Line, KeyAction, strconv.Itoa(syslogAction("none")))
+	}
+
+	for _, k := range syslogKeys {
+		var has = j.Has(k)
+
+		// an alignment is always set, but not recovered without its result, except both fail with dmarc
+		switch k {
+		case KeyAlignDKIM:
+			has = j.Has(KeyDKIM) || s.dmarc == "fail"
+		case KeyAlignSPF:
+			has = j.Has(KeySPF) || s.dmarc == "fail"
+		}
+
+		if !has {
+			j.Missing = append(j.Missing, k)
+		}
+	}
+
+	if !j.Has(KeySPF) {
+		j.Set(j.Line, KeySPF, strconv.Itoa(syslogResultCode("none")))
+	}
+
+	if !j.Has(KeyAction) {
+		j.Set(j.Line, KeyAction, strconv.Itoa(syslogAction("none")))
+	}
+
+	return j
+}
+
+// syslogSplit split an Authentication-Results header on the ';' outside of the comments, as "(2048-bit key; unprotected)"
+func syslogSplit(value string) []string {
+	var (
+		res = make([]string, 0)
+		dep = 0
+		beg = 0
+	)
+
+	for i, c := range value {
+		switch {
+		case c == '(':
+			dep++
+		case c == ')' && dep > 0:
+			dep--
+		case c == ';' && dep == 0:
+			res = append(res, value[beg:i])
+			beg = i + 1
+		}
+	}
+
+	return append(res, value[beg:])
+}
+
+// syslogFields return the key=value pairs of a result comment, as "(p=reject dis=none)"
+func syslogFields(cmt []string) []string {
+	if len(cmt) < 2 {
+		return nil
+	}
+
+	return strings.Fields(cmt[1])
+}
+
+// SetRecord set the keys not yet set from the dmarc record published by the policy domain, formatted as
+// "v=DMARC1; p=reject; rua=mailto:dmarc@example.com", and remove them from Missing. The record is the current
+// one, it is used for a job rebuilt from syslog as OpenDMARC does not log the rua and could not log the policy.
+// The alignments of a job rebuilt from syslog are computed again in the published alignment modes.
+func (j *Job) SetRecord(record string) error {
+	var (
+		tag = make(map[string]string)
+		lst = strings.Split(record, ";")
+	)
+
+	if v := strings.SplitN(lst[0], "=", 2); len(v) != 2 || !strings.EqualFold(strings.TrimSpace(v[1]), "DMARC1") {
+		return fmt.Errorf("dmarc record '%s' not understand", record)
+	}
+
+	for _, t := range lst[1:] {
+		if p := strings.SplitN(t, "=", 2); len(p) == 2 {
+			tag[strings.ToLower(strings.TrimSpace(p[0]))] = strings.TrimSpace(p[1])
+		}
+	}
+
+	if _, ok := tag[KeyP]; !ok {
+		return fmt.Errorf("dmarc record '%s' : policy missing", record)
+	}
+
+	var set = make(map[string]bool)
+
+	for _, k := range []string{KeyRua, KeyP, KeySP, KeyNP, KeyPct, KeyADKIM, KeyASPF, KeyFo} {
+		val, ok := tag[k]
+		if !ok || j.Has(k) || k == KeyRua && len(j.Rua) > 0 {
+			continue
+		}
+
+		switch k {
+		case KeyRua:
+			for _, u := range strings.Split(val, ",") {
+				if u = strings.TrimSpace(u); u != "" {
+					j.Rua = append(j.Rua, u)
+				}
+			}
+		case KeyP, KeySP, KeyNP:
+			j.Set(j.Line, k, strconv.Itoa(syslogPolicy(val)))
+		case KeyADKIM, KeyASPF:
+			j.Set(j.Line, k, strconv.Itoa(syslogAlignMode(val)))
+		default:
+			j.Set(j.Line, k, val)
+		}
+
+		set[k] = true
+	}
+
+	if j.dmarc != "" && (set[KeyADKIM] || set[KeyASPF]) {
+		// the alignments are computed again in the published alignment mode
+		j.syslogAlign()
+	}
+
+	var mis = make([]string, 0, len(j.Missing))
+
+	for _, k := range j.Missing {
+		if !set[k] {
+			mis = append(mis, k)
+		}
+	}
+
+	j.Missing = mis
+
+	return nil
+}
+
+// syslogAlign set the alignments of a job rebuilt from syslog from its passing results, in the alignment modes
+// of the job. A message passing dmarc has at least one aligned result : if none is found (not logged, or aligned
+// on an organizational domain not known without the public suffix list) dkim is aligned if it passed or was not
+// logged, else spf. An alignment not found is set as fail, so it is always reported.
+func (j *Job) syslogAlign() {
+	var (
+		dkm = 5
+		spf = 5
+		pss = false
+	)
+
+	for _, d := range j.DKIM {
+		if d.Result == 0 {
+			pss = true
+
+			if syslogAligned(d.Domain, j.From, j.ADKIM) {
+				dkm = 4
+			}
+		}
+	}
+
+	if j.Has(KeySPF) && j.SPF == 0 && syslogAligned(j.SPFDomain, j.From, j.ASPF) {
+		spf = 4
+	}
+
+	if j.dmarc == "pass" && dkm != 4 && spf != 4 {
+		if pss || !j.Has(KeyDKIM) {
+			dkm = 4
+		} else {
+			spf = 4
+		}
+	}
+
+	j.Set(j.Line, KeyAlignDKIM, strconv.Itoa(dkm))
+	j.Set(j.Line, KeyAlignSPF, strconv.Itoa(spf))
+}
+
+// syslogAligned return true if the domains are aligned in the alignment mode : the same domain in strict mode,
+// in relaxed mode without the public suffix list a domain is only aligned with its sub domains or parent domains
+func syslogAligned(domain, from string, mode int) bool {
+	domain = strings.ToLower(domain)
+	from = strings.ToLower(from)
+
+	if domain == "" {
+		return false
+	} else if domain == from {
+		return true
+	} else if mode == syslogAlignMode("s") {
+		return false
+	}
+
+	return strings.HasSuffix(domain, "."+from) || strings.HasSuffix(from, "."+domain)
+}
+
+// syslogResultCode return the history code of an authentication result
+func syslogResultCode(result string) int {
+	switch strings.ToLower(result) {
+	case "pass":
+		return 0
+	case "softfail":
+		return 2
+	case "neutral":
+		return 3
+	case "temperror":
+		return 4
+	case "permerror":
+		return 5
+	case "fail", "hardfail":
+		return 7
+	case "policy":
+		return 8
+	default:
+		return 6
+	}
+}
+
+// syslogAction return the history code of a disposition
+func syslogAction(disp string) int {
+	switch strings.ToLower(disp) {
+	case "reject":
+		return 0
+	case "quarantine":
+		return 4
+	default:
+		return 2
+	}
+}
+
+// syslogAlignMode return the history code of an alignment mode
+func syslogAlignMode(mode string) int {
+	if strings.EqualFold(mode, "s") {
+		return 115
+	}
+
+	return 114
+}
+
+// syslogPolicy return the history code of a published policy
+func syslogPolicy(pol string) int {
+	switch strings.ToLower(pol) {
+	case "quarantine":
+		return 113
+	case "reject":
+		return 114
+	default:
+		return 110
+	}
+}
@@ -0,0 +1,258 @@
+package history
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// mail.log of a postfix host with opendmarc and opendkim milters, and a header_checks rule
+// "/^Authentication-Results: mx1\.example\.org;/ WARN" logging the headers added by the milters
+const testSyslog = `Oct 17 06:10:01 mx1 postfix/smtpd[21530]: connect from mail-wm1-f54.google.com[209.85.128.54]
+Oct 17 06:10:01 mx1 postfix/smtpd[21530]: 4Hb2xK1FzRz9v: client=mail-wm1-f54.google.com[209.85.128.54]
+Oct 17 06:10:02 mx1 postfix/cleanup[21534]: 4Hb2xK1FzRz9v: message-id=<CAF=abc123@mail.gmail.com>
+Oct 17 06:10:02 mx1 opendkim[812]: 4Hb2xK1FzRz9v: mail-wm1-f54.google.com [209.85.128.54] not internal
+Oct 17 06:10:02 mx1 opendmarc[811]: 4Hb2xK1FzRz9v: SPF(mailfrom): sender@gmail.com pass
+Oct 17 06:10:02 mx1 opendmarc[811]: 4Hb2xK1FzRz9v: gmail.com pass
+Oct 17 06:10:02 mx1 postfix/cleanup[21534]: 4Hb2xK1FzRz9v: warning: header Authentication-Results: mx1.example.org; dkim=pass (2048-bit key; unprotected) header.d=gmail.com header.i=@gmail.com header.s=20230601 header.b="Xk3mE0aB"; dkim-atps=neutral from mail-wm1-f54.google.com[209.85.128.54]; from=<sender@gmail.com> to=<user@example.org> proto=ESMTP helo=<mail-wm1-f54.google.com>
+Oct 17 06:10:02 mx1 postfix/qmgr[1120]: 4Hb2xK1FzRz9v: from=<sender@gmail.com>, size=5210, nrcpt=1 (queue active)
+Oct 17 06:10:03 mx1 postfix/smtpd[21540]: NOQUEUE: reject: RCPT from unknown[203.0.113.5]: 554 5.7.1 <spam@example.org>: Relay access denied; from=<a@spam.example> to=<spam@example.org> proto=ESMTP helo=<x>
+Oct 17 06:10:03 mx1 opendmarc[811]: NOQUEUE: spam.example fail
+Oct 17 06:10:04 mx1 postfix/smtpd[21530]: 4Hb2yP3QwXz1k: client=mx.bad.example[198.51.100.7]
+Oct 17 06:10:04 mx1 opendmarc[811]: 4Hb2yP3QwXz1k: SPF(mailfrom): bounce@bad.example fail
+Oct 17 06:10:04 mx1 postfix/cleanup[21534]: 4Hb2yP3QwXz1k: warning: header Authentication-Results: mx1.example.org; dmarc=fail (p=reject dis=reject) header.from=example.com from mx.bad.example[198.51.100.7]; from=<bounce@bad.example> to=<user@example.org> proto=ESMTP helo=<mx.bad.example>
+Oct 17 06:10:04 mx1 opendmarc[811]: 4Hb2yP3QwXz1k: example.com fail
+Oct 17 06:10:04 mx1 postfix/cleanup[21534]: 4Hb2yP3QwXz1k: milter-reject: END-OF-MESSAGE from mx.bad.example[198.51.100.7]: 5.7.1 rejected by DMARC policy for example.com; from=<bounce@bad.example> to=<user@example.org> proto=ESMTP helo=<mx.bad.example>
+Oct 17 06:10:05 mx1 postfix/smtpd[21530]: 4Hb2zR5TvYz2m: client=localhost[127.0.0.1]
+Oct 17 06:10:05 mx1 postfix/qmgr[1120]: 4Hb2zR5TvYz2m: from=<root@mx1.example.org>, size=610, nrcpt=1 (queue active)
+`
+
+func readSyslog(t *testing.T, txt string) []*Job {
+	var (
+		rdr = NewSyslogReader(strings.NewReader(txt))
+		res = make([]*Job, 0)
+	)
+
+	rdr.now = time.Date(2026, time.October, 17, 12, 0, 0, 0, time.Local)
+
+	for {
+		job, err := rdr.Next()
+
+		if err == io.EOF {
+			return res
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		res = append(res, job)
+	}
+}
+
+func TestSyslogReader(t *testing.T) {
+	job := readSyslog(t, testSyslog)
+
+	// the local message without dmarc result is ignored, the NOQUEUE lines are not a job
+	if len(job) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(job))
+	}
+
+	a, b := job[0], job[1]
+
+	if a.JobId != "4Hb2xK1FzRz9v" || a.Line != 2 {
+		t.Errorf("got job '%s' at line %d", a.JobId, a.Line)
+	}
+
+	if exp := time.Date(2026, time.October, 17, 6, 10, 1, 0, time.Local); !a.Received.Equal(exp) {
+		t.Errorf("got received %s, want %s", a.Received, exp)
+	}
+
+	if a.Reporter != "mx1.example.org" || a.IpAddr != "209.85.128.54" || a.From != "gmail.com" || a.PDomain != "gmail.com" || a.MFrom != "gmail.com" {
+		t.Errorf("got reporter '%s' ip '%s' from '%s' pdomain '%s' mfrom '%s'", a.Reporter, a.IpAddr, a.From, a.PDomain, a.MFrom)
+	}
+
+	if a.SPF != 0 || a.SPFDomain != "gmail.com" || a.SPFScope != "mfrom" || a.AlignSPF != 4 {
+		t.Errorf("got spf %d domain '%s' scope '%s' aligned %d", a.SPF, a.SPFDomain, a.SPFScope, a.AlignSPF)
+	}
+
+	if exp := []DKIM{{Line: 7, Domain: "gmail.com", Selector: "20230601", Result: 0}}; !reflect.DeepEqual(a.DKIM, exp) {
+		t.Errorf("got dkim %+v, want %+v", a.DKIM, exp)
+	} else if a.AlignDKIM != 4 {
+		t.Errorf("got dkim aligned %d", a.AlignDKIM)
+	}
+
+	if a.Action != 2 {
+		t.Errorf("got action %d for a message passing dmarc", a.Action)
+	}
+
+	if exp := []string{KeyRua, KeyP}; !reflect.DeepEqual(a.Missing, exp) {
+		t.Errorf("got missing %v, want %v", a.Missing, exp)
+	}
+
+	if b.JobId != "4Hb2yP3QwXz1k" || b.IpAddr != "198.51.100.7" || b.From != "example.com" || b.MFrom != "bad.example" {
+		t.Errorf("got job '%s' ip '%s' from '%s' mfrom '%s'", b.JobId, b.IpAddr, b.From, b.MFrom)
+	}
+
+	if b.P != 114 || b.Action != 0 || b.SPF != 7 || b.AlignSPF != 5 || b.AlignDKIM != 5 {
+		t.Errorf("got p %d action %d spf %d align spf %d align dkim %d", b.P, b.Action, b.SPF, b.AlignSPF, b.AlignDKIM)
+	}
+
+	if exp := []string{KeyRua, KeyDKIM}; !reflect.DeepEqual(b.Missing, exp) {
+		t.Errorf("got missing %v, want %v", b.Missing, exp)
+	}
+
+	for _, j := range job {
+		if len(j.Errors) > 0 || len(j.Unknown) > 0 {
+			t.Errorf("job '%s': got errors %v unknown %v", j.JobId, j.Errors, j.Unknown)
+		}
+	}
+}
+
+func TestSyslogReaderOpenDMARCOnly(t *testing.T) {
+	const txt = `2026-10-17T06:10:02.123456+02:00 mx2 opendmarc[811]: 5C2A81E0F3: SPF(helo): mx.example.net neutral
+2026-10-17T06:10:02.124001+02:00 mx2 opendmarc[811]: 5C2A81E0F3: example.net none
+`
+
+	job := readSyslog(t, txt)
+
+	if len(job) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(job))
+	}
+
+	j := job[0]
+
+	if j.Reporter != "mx2" || j.Received.Unix() != 1792210202 || j.From != "example.net" {
+		t.Errorf("got reporter '%s' received %s from '%s'", j.Reporter, j.Received, j.From)
+	}
+
+	if j.SPF != 3 || j.SPFDomain != "mx.example.net" || j.SPFScope != "helo" || j.AlignSPF != 5 {
+		t.Errorf("got spf %d domain '%s' scope '%s' aligned %d", j.SPF, j.SPFDomain, j.SPFScope, j.AlignSPF)
+	}
+
+	if exp := []string{KeyIpAddr, KeyMFrom, KeyRua, KeyP, KeyDKIM, KeyAlignDKIM, KeyAction}; !reflect.DeepEqual(j.Missing, exp) {
+		t.Errorf("got missing %v, want %v", j.Missing, exp)
+	}
+
+	// not recovered, but never reported as pass or reject
+	if j.Action != 2 || !j.Has(KeyAction) {
+		t.Errorf("got action %d", j.Action)
+	}
+}
+
+func TestSyslogSplit(t *testing.T) {
+	tst := []struct {
+		val string
+		res []string
+	}{
+		{"mx; spf=pass", []string{"mx", " spf=pass"}},
+		{"mx; dkim=pass (2048-bit key; unprotected) header.d=a.example; dmarc=pass", []string{"mx", " dkim=pass (2048-bit key; unprotected) header.d=a.example", " dmarc=pass"}},
+		{"mx; dkim=fail (bad) x=(y; z", []string{"mx", " dkim=fail (bad) x=(y; z"}},
+		{"mx", []string{"mx"}},
+	}
+
+	for _, tc := range tst {
+		if res := syslogSplit(tc.val); !reflect.DeepEqual(res, tc.res) {
+			t.Errorf("%q: got %q, want %q", tc.val, res, tc.res)
+		}
+	}
+}
+
+func TestSetRecord(t *testing.T) {
+	j := NewJob("A", 1, 0)
+	j.Set(1, KeyP, "113")
+	j.Missing = []string{KeyRua, KeyP, KeyDKIM}
+
+	err := j.SetRecord("v=DMARC1; p=reject; sp=none; adkim=s; pct=50; fo=1; rua=mailto:dmarc@example.com,mailto:agg@report.example!10m")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exp := []string{"mailto:dmarc@example.com", "mailto:agg@report.example!10m"}; !reflect.DeepEqual(j.Rua, exp) {
+		t.Errorf("got rua %v, want %v", j.Rua, exp)
+	}
+
+	// the policy logged is kept
+	if j.P != 113 || j.SP != 110 || j.ADKIM != 115 || j.Pct != 50 || j.Fo != "1" || j.Has(KeyASPF) || j.Has(KeyNP) {
+		t.Errorf("got p %d sp %d adkim %d pct %d fo '%s' aspf set %v np set %v", j.P, j.SP, j.ADKIM, j.Pct, j.Fo, j.Has(KeyASPF), j.Has(KeyNP))
+	}
+
+	if exp := []string{KeyP, KeyDKIM}; !reflect.DeepEqual(j.Missing, exp) {
+		t.Errorf("got missing %v, want %v", j.Missing, exp)
+	}
+
+	for _, r := range []string{"", "v=spf1 -all", "p=reject; v=DMARC1", "v=DMARC1; rua=mailto:a@example.com"} {
+		if err = NewJob("A", 1, 0).SetRecord(r); err == nil {
+			t.Errorf("%q: got no error", r)
+		}
+	}
+}
+
+func TestSyslogAligned(t *testing.T) {
+	tst := []struct {
+		domain string
+		from   string
+		mode   int
+		res    bool
+	}{
+		{"example.com", "example.com", 114, true},
+		{"Example.COM", "example.com", 115, true},
+		{"bounce.example.com", "example.com", 114, true},
+		{"example.com", "news.example.com", 114, true},
+		{"bounce.example.com", "example.com", 115, false},
+		{"example.com", "news.example.com", 115, false},
+		{"mailer.example", "example.com", 114, false},
+		{"", "example.com", 114, false},
+	}
+
+	for _, tc := range tst {
+		if res := syslogAligned(tc.domain, tc.from, tc.mode); res != tc.res {
+			t.Errorf("%s / %s mode %d: got %v, want %v", tc.domain, tc.from, tc.mode, res, tc.res)
+		}
+	}
+}
+
+func TestSyslogStrictRecord(t *testing.T) {
+	const txt = `2026-10-17T06:10:02+02:00 mx2 opendmarc[811]: 5C2A81E0F3: SPF(mailfrom): bounce@news.example.com pass
+2026-10-17T06:10:02+02:00 mx2 opendmarc[811]: 5C2A81E0F3: example.com pass
+`
+
+	job := readSyslog(t, txt)
+
+	if len(job) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(job))
+	}
+
+	j := job[0]
+
+	// the sub domain is aligned in relaxed mode, the default mode
+	if j.AlignSPF != 4 || j.AlignDKIM != 5 {
+		t.Fatalf("got align spf %d align dkim %d", j.AlignSPF, j.AlignDKIM)
+	}
+
+	if err := j.SetRecord("v=DMARC1; p=reject; adkim=s; aspf=s"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// not aligned in strict mode, the dmarc pass is so given by dkim
+	if j.AlignSPF != 5 || j.AlignDKIM != 4 {
+		t.Errorf("got align spf %d align dkim %d in strict mode", j.AlignSPF, j.AlignDKIM)
+	}
+}
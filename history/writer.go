@@ -0,0 +1,142 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Writer write jobs in the OpenDMARC history format
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter return a writer of history lines into w, Flush must be called once all jobs are written
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// Write add the lines of the job. The strings are written if not empty, the numbers if not zero
+// or if set by Set. The unknown keys are written after the known keys.
+func (w *Writer) Write(j *Job) error {
+	if j == nil || j.JobId == "" {
+		return errors.New("cannot write a job without id")
+	}
+
+	w.str(KeyJob, j.JobId)
+	w.str(KeyReporter, j.Reporter)
+
+	if !j.Received.IsZero() {
+		w.line(KeyReceived, strconv.FormatInt(j.Received.Unix(), 10))
+	}
+
+	w.str(KeyIpAddr, j.IpAddr)
+	w.str(KeyFrom, j.From)
+	w.str(KeyMFrom, j.MFrom)
+	w.str(KeyEnvelopeTo, j.EnvelopeTo)
+
+	for _, r := range j.Rua {
+		w.line(KeyRua, r)
+	}
+
+	w.int(j, KeyP, j.P)
+	w.int(j, KeySP, j.SP)
+	w.int(j, KeyNP, j.NP)
+	w.int(j, KeyPct, j.Pct)
+	w.int(j, KeyADKIM, j.ADKIM)
+	w.int(j, KeyASPF, j.ASPF)
+	w.str(KeyFo, j.Fo)
+	w.int(j, KeyT, j.T)
+
+	for _, d := range j.DKIM {
+		if d.Selector != "" {
+			w.line(KeyDKIM, fmt.Sprintf("%s %s %d", d.Domain, d.Selector, d.Result))
+		} else {
+			w.line(KeyDKIM, fmt.Sprintf("%s %d", d.Domain, d.Result))
+		}
+	}
+
+	if j.SPFDomain != "" && j.SPFScope != "" {
+		w.line(KeySPF, fmt.Sprintf("%s %s %d", j.SPFDomain, j.SPFScope, j.SPF))
+	} else if j.SPFDomain != "" {
+		w.line(KeySPF, fmt.Sprintf("%s %d", j.SPFDomain, j.SPF))
+		w.str(KeySPFScope, j.SPFScope)
+	} else {
+		w.int(j, KeySPF, j.SPF)
+		w.str(KeySPFScope, j.SPFScope)
+	}
+	w.int(j, KeyAlignDKIM, j.AlignDKIM)
+	w.int(j, KeyAlignSPF, j.AlignSPF)
+	w.int(j, KeyAction, j.Action)
+	w.str(KeyPDomain, j.PDomain)
+	w.int(j, KeyPolicy, j.Policy)
+	w.str(KeyReason, j.Reason)
+	w.int(j, KeyARC, j.ARC)
+
+	if len(j.ARCSeals) > 0 {
+		js, err := json.Marshal(j.ARCSeals)
+
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+
+		w.line(KeyARCPolicy, fmt.Sprintf("%d json:%s", j.ARCPolicy, js))
+	} else {
+		w.int(j, KeyARCPolicy, j.ARCPolicy)
+	}
+
+	for _, f := range j.Unknown {
+		w.line(f.Key, f.Value)
+	}
+
+	return w.err
+}
+
+// Flush write the buffered lines to the underlying writer
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	return w.w.Flush()
+}
+
+func (w *Writer) line(key, value string) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, "%s %s\n", key, value)
+	}
+}
+
+func (w *Writer) str(key, value string) {
+	if value != "" {
+		w.line(key, value)
+	}
+}
+
+func (w *Writer) int(j *Job, key string, value int) {
+	if value != 0 || j.Has(key) {
+		w.line(key, strconv.Itoa(value))
+	}
+}
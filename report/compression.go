@@ -0,0 +1,79 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// ReportCompression is the way the xml report file is packed before sending (RFC 7489 §7.2.1.1)
+type ReportCompression uint8
+
+const (
+	CompressZip ReportCompression = iota
+	CompressGzip
+	CompressNone
+)
+
+// ParseCompression return the compression of the given name, zip if empty, or an error if unknown
+func ParseCompression(str string) (ReportCompression, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "", CompressZip.String():
+		return CompressZip, nil
+	case CompressGzip.String(), "gz":
+		return CompressGzip, nil
+	case CompressNone.String(), "xml":
+		return CompressNone, nil
+	}
+
+	return CompressZip, fmt.Errorf("unknown report compression '%s' (%s, %s, %s)", str, CompressZip.String(), CompressGzip.String(), CompressNone.String())
+}
+
+func (c ReportCompression) String() string {
+	switch c {
+	case CompressGzip:
+		return "gzip"
+	case CompressNone:
+		return "none"
+	default:
+		return "zip"
+	}
+}
+
+// Extension return the file extension of the packed report, including the xml extension
+func (c ReportCompression) Extension() string {
+	switch c {
+	case CompressGzip:
+		return ".xml.gz"
+	case CompressNone:
+		return ".xml"
+	default:
+		return ".zip"
+	}
+}
+
+func (c ReportCompression) ContentType() string {
+	switch c {
+	case CompressGzip:
+		return "application/gzip"
+	case CompressNone:
+		return "text/xml"
+	default:
+		return "application/zip"
+	}
+}
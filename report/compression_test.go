@@ -0,0 +1,48 @@
+package report
+
+import (
+	"testing"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestParseCompression(t *testing.T) {
+	tst := []struct {
+		str string
+		cmp ReportCompression
+		err bool
+	}{
+		{"", CompressZip, false},
+		{"zip", CompressZip, false},
+		{" GZIP ", CompressGzip, false},
+		{"gz", CompressGzip, false},
+		{"none", CompressNone, false},
+		{"xml", CompressNone, false},
+		{"bzip2", CompressZip, true},
+		{"zstd", CompressZip, true},
+	}
+
+	for _, tc := range tst {
+		got, err := ParseCompression(tc.str)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.str, err, tc.err)
+		} else if got != tc.cmp {
+			t.Errorf("%q: got compression %s, want %s", tc.str, got, tc.cmp)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package report
+
+import (
+	"errors"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// RecordCursor iterate over report records in the same way as sql.Rows
+type RecordCursor interface {
+	Next() bool
+	Record() ReportRecord
+	Err() error
+	Close() error
+}
+
+// RecordSource open a new cursor starting at the first record of the report.
+// It could be called many times to generate the report more than once.
+type RecordSource func() (RecordCursor, error)
+
+type listCursor struct {
+	lst []ReportRecord
+	idx int
+}
+
+// NewRecordList return a record source over an in memory list of records
+func NewRecordList(lst []ReportRecord) RecordSource {
+	return func() (RecordCursor, error) {
+		return &listCursor{
+			lst: lst,
+			idx: -1,
+		}, nil
+	}
+}
+
+func (cur *listCursor) Next() bool {
+	cur.idx++
+	return cur.idx < len(cur.lst)
+}
+
+func (cur *listCursor) Record() ReportRecord {
+	if cur.idx < 0 || cur.idx >= len(cur.lst) {
+		return ReportRecord{}
+	}
+
+	return cur.lst[cur.idx]
+}
+
+func (cur *listCursor) Err() error {
+	return nil
+}
+
+func (cur *listCursor) Close() error {
+	return nil
+}
+
+type limitCursor struct {
+	src RecordCursor
+	nbr int
+}
+
+// NewRecordLimit return a source over the next nbr records of an opened cursor, shared by the consecutive
+// parts of a split report so the records are only queried once. The source could only be read once
+// and the opened cursor is not closed with the returned cursor.
+func NewRecordLimit(src RecordCursor, nbr int) RecordSource {
+	var used bool
+
+	return func() (RecordCursor, error) {
+		if used {
+			return nil, errors.New("records of the shared cursor already read")
+		}
+
+		used = true
+
+		return &limitCursor{
+			src: src,
+			nbr: nbr,
+		}, nil
+	}
+}
+
+func (cur *limitCursor) Next() bool {
+	if cur.nbr < 1 {
+		return false
+	}
+
+	cur.nbr--
+
+	return cur.src.Next()
+}
+
+func (cur *limitCursor) Record() ReportRecord {
+	return cur.src.Record()
+}
+
+func (cur *limitCursor) Err() error {
+	return cur.src.Err()
+}
+
+func (cur *limitCursor) Close() error {
+	return nil
+}
+
+type aggregateCursor struct {
+	src  RecordCursor
+	cur  ReportRecord
+	next ReportRecord
+	has  bool
+	end  bool
+}
+
+// NewAggregateCursor merge the consecutive records of the given cursor sharing the same group.
+// The source cursor must be sorted by group to have only one record by group.
+func NewAggregateCursor(src RecordCursor) RecordCursor {
+	return &aggregateCursor{
+		src: src,
+	}
+}
+
+func (cur *aggregateCursor) Next() bool {
+	if cur.end {
+		return false
+	}
+
+	if !cur.has {
+		if !cur.src.Next() {
+			cur.end = true
+			return false
+		}
+
+		cur.next = cur.src.Record()
+	}
+
+	cur.cur = cur.next
+	cur.has = false
+	key := cur.cur.groupKey()
+
+	for cur.src.Next() {
+		rec := cur.src.Record()
+
+		if rec.groupKey() != key {
+			cur.next = rec
+			cur.has = true
+			return true
+		}
+
+		cur.cur.Row.Count += rec.Row.Count
+		// the full slice expression force a copy, not to write into the keys of the source record
+		cur.cur.keys = append(cur.cur.keys[:len(cur.cur.keys):len(cur.cur.keys)], rec.keys...)
+	}
+
+	cur.end = true
+	return true
+}
+
+func (cur *aggregateCursor) Record() ReportRecord {
+	return cur.cur
+}
+
+func (cur *aggregateCursor) Err() error {
+	return cur.src.Err()
+}
+
+func (cur *aggregateCursor) Close() error {
+	return cur.src.Close()
+}
@@ -0,0 +1,117 @@
+package report
+
+import (
+	"testing"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func testRecord(count int, dkim ...ReportDKIM) ReportRecord {
+	return GetReportRecord("192.0.2.1", "none", "pass", "fail", "example.com", "example.org", "softfail", count, dkim)
+}
+
+func TestGroupKey(t *testing.T) {
+	var (
+		sga = GetReportDKIM("example.com", "s1", "pass", "")
+		sgb = GetReportDKIM("example.com", "s2", "fail", "bad sig")
+	)
+
+	tst := []struct {
+		name string
+		a    func() ReportRecord
+		b    func() ReportRecord
+		same bool
+	}{
+		{"count ignored", func() ReportRecord { return testRecord(1) }, func() ReportRecord { return testRecord(5) }, true},
+		{"dkim order ignored", func() ReportRecord { return testRecord(1, sga, sgb) }, func() ReportRecord { return testRecord(1, sgb, sga) }, true},
+		{"dkim result", func() ReportRecord { return testRecord(1, sga) }, func() ReportRecord { return testRecord(1, sgb) }, false},
+		{"source ip", func() ReportRecord { return testRecord(1) }, func() ReportRecord {
+			r := testRecord(1)
+			r.Row.SourceIp = "192.0.2.2"
+			return r
+		}, false},
+		{"envelope to", func() ReportRecord { return testRecord(1) }, func() ReportRecord {
+			r := testRecord(1)
+			r.SetEnvelopeTo("example.net")
+			return r
+		}, false},
+		{"spf scope", func() ReportRecord { return testRecord(1) }, func() ReportRecord {
+			r := testRecord(1)
+			r.SetSPFScope("helo")
+			return r
+		}, false},
+		{"reason", func() ReportRecord { return testRecord(1) }, func() ReportRecord {
+			r := testRecord(1)
+			r.AddReason("forwarded", "")
+			return r
+		}, false},
+		{"reason comment", func() ReportRecord {
+			r := testRecord(1)
+			r.AddReason("local_policy", "a")
+			return r
+		}, func() ReportRecord {
+			r := testRecord(1)
+			r.AddReason("local_policy", "b")
+			return r
+		}, false},
+	}
+
+	for _, tc := range tst {
+		if got := tc.a().groupKey() == tc.b().groupKey(); got != tc.same {
+			t.Errorf("%s: same key = %v, want %v", tc.name, got, tc.same)
+		}
+	}
+}
+
+func TestAggregateCursor(t *testing.T) {
+	var (
+		oth = testRecord(4)
+		lst = []ReportRecord{testRecord(1), testRecord(2), oth, testRecord(3)}
+	)
+
+	oth.Row.SourceIp = "192.0.2.9"
+	lst[2] = oth
+
+	cur, err := NewRecordList(lst)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agg := NewAggregateCursor(cur)
+	res := make([]int, 0)
+
+	for agg.Next() {
+		res = append(res, agg.Record().Row.Count)
+	}
+
+	if err = agg.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only consecutive records are merged : the source must be sorted by group
+	exp := []int{3, 4, 3}
+
+	if len(res) != len(exp) {
+		t.Fatalf("got counts %v, want %v", res, exp)
+	}
+
+	for i := range exp {
+		if res[i] != exp[i] {
+			t.Fatalf("got counts %v, want %v", res, exp)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package report
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/nabbar/opendmarc-reports/config"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const (
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+	DeliveryNotice  = "notice"
+	DeliveryTesting = "testing"
+	DeliveryExpired = "expired"
+	DeliveryInvalid = "invalid"
+)
+
+// Delivery is the result of sending a report file to one destination
+type Delivery struct {
+	Destination Destination
+	ReportId    string
+	FileName    string
+	Size        int64
+	Hash        string
+	Status      string
+	Error       error
+	Date        time.Time
+
+	rep *reportFile
+}
+
+func (rep *reportFile) delivery(dst Destination, status string, err error) Delivery {
+	if IsInvalidReport(err) {
+		status = DeliveryInvalid
+	} else if err != nil {
+		status = DeliveryFailed
+	} else if config.GetConfig().IsTesting() {
+		status = DeliveryTesting
+	}
+
+	return Delivery{
+		Destination: dst,
+		ReportId:    rep.GetReportId(),
+		FileName:    rep.GetArchiveName(dst),
+		Size:        rep.GetArchiveSize(dst),
+		Hash:        rep.GetArchiveHash(dst),
+		Status:      status,
+		Error:       err,
+		Date:        time.Now(),
+		rep:         rep,
+	}
+}
+
+// IsSent return true if the receiver got the report or the notice
+func (d Delivery) IsSent() bool {
+	return d.Status == DeliverySent || d.Status == DeliveryNotice
+}
+
+// Payload return the content of the file sent to the destination, only available until the report is closed
+func (d Delivery) Payload() ([]byte, error) {
+	if d.rep == nil || d.Size < 1 {
+		return nil, errors.New("no file for this delivery")
+	}
+
+	src, err := d.rep.Open(d.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	defer src.Close()
+
+	return ioutil.ReadAll(src)
+}
+
+// recoverError convert the panic value of a sender into an error
+func recoverError(r interface{}) error {
+	if e, ok := r.(error); ok {
+		return e
+	}
+
+	return fmt.Errorf("%v", r)
+}
@@ -0,0 +1,179 @@
+package report
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nabbar/opendmarc-reports/config"
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const (
+	SchemeMail    = "mailto"
+	SchemeHttp    = "http"
+	SchemeFtp     = "ftp"
+	SchemeUnknown = ""
+)
+
+// rua size limit suffix : "!" 1*DIGIT [ "k" / "m" / "g" / "t" ] (RFC 7489 §6.4)
+var rua_limit = regexp.MustCompile(`!([0-9]+)([kKmMgGtT]?)$`)
+
+// Destination is one item of the rua list with the report options of its receiver
+type Destination struct {
+	// Uri is the rua item without its size limit suffix
+	Uri    string
+	Scheme string
+	Target string
+	Host   string
+	Format ReportFormat
+
+	Compression ReportCompression
+
+	// Limit is the maximum size in bytes accepted by the receiver, 0 if no limit
+	Limit int64
+}
+
+// ParseDestination parse one rua item and resolve the report options of the receiver domain from config.
+// The compression given is used if none is configured for the receiver domain.
+func ParseDestination(uri string, compression ReportCompression) Destination {
+	var (
+		adr, lim = splitLimit(strings.TrimSpace(uri))
+		dst      = Destination{
+			Uri:         adr,
+			Scheme:      SchemeUnknown,
+			Compression: compression,
+			Limit:       lim,
+		}
+	)
+
+	if u, e := url.Parse(adr); e == nil {
+		switch {
+		case strings.HasPrefix(strings.ToLower(u.Scheme), "mail"):
+			dst.Scheme = SchemeMail
+			dst.Target = strings.TrimSpace(u.Opaque)
+
+			if dst.Target == "" {
+				t := strings.Split(adr, ":")
+				dst.Target = strings.Join(t[1:], ":")
+			}
+
+			if p := strings.Split(dst.Target, "@"); len(p) > 1 {
+				dst.Host = p[len(p)-1]
+			}
+
+		case strings.HasPrefix(strings.ToLower(u.Scheme), "http"):
+			dst.Scheme = SchemeHttp
+			dst.Target = adr
+			dst.Host = u.Hostname()
+
+		case strings.HasPrefix(strings.ToLower(u.Scheme), "ftp"):
+			dst.Scheme = SchemeFtp
+			dst.Target = adr
+			dst.Host = u.Hostname()
+		}
+	}
+
+	dst.Host = strings.ToLower(strings.Trim(dst.Host, ". >"))
+	if f, e := ParseFormat(config.GetConfig().GetReportFormat(dst.Host)); e != nil {
+		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing report format of receiver '%s'", dst.Host), e)
+	} else {
+		dst.Format = f
+	}
+
+	if c := config.GetConfig().GetDestinationCompression(dst.Host); c != "" {
+		if z, e := ParseCompression(c); e != nil {
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing report compression of receiver '%s'", dst.Host), e)
+		} else {
+			dst.Compression = z
+		}
+	}
+
+	return dst
+}
+
+// CheckConfig return an error if the report format or compression of config, global or of a destination, is unknown
+func CheckConfig() error {
+	if _, err := ParseFormat(config.GetConfig().GetReportFormat("")); err != nil {
+		return err
+	} else if _, err = ParseCompression(config.GetConfig().GetReportCompression()); err != nil {
+		return err
+	}
+
+	for _, m := range config.GetConfig().GetDestinationMatches() {
+		if _, err := ParseFormat(config.GetConfig().GetReportFormat(m)); err != nil {
+			return fmt.Errorf("destination '%s': %v", m, err)
+		} else if _, err = ParseCompression(config.GetConfig().GetDestinationCompression(m)); err != nil {
+			return fmt.Errorf("destination '%s': %v", m, err)
+		}
+	}
+
+	return nil
+}
+
+// key identify the generated file used by the destination
+func (dst Destination) key() string {
+	return dst.Format.String() + "/" + dst.Compression.String()
+}
+
+// splitLimit return the rua item without its size limit suffix and the limit in bytes, 0 if none
+func splitLimit(uri string) (string, int64) {
+	if m := rua_limit.FindStringSubmatch(uri); m != nil {
+		return strings.TrimSuffix(uri, m[0]), parseLimit(m[1], m[2])
+	}
+
+	return uri, 0
+}
+
+func parseLimit(nbr, unit string) int64 {
+	val, err := strconv.ParseInt(nbr, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	switch strings.ToLower(unit) {
+	case "k":
+		return val << 10
+	case "m":
+		return val << 20
+	case "g":
+		return val << 30
+	case "t":
+		return val << 40
+	}
+
+	return val
+}
+
+// Fits return true if a report file of the given size could be sent to the destination
+func (dst Destination) Fits(size int64) bool {
+	if dst.Limit < 1 {
+		return true
+	}
+
+	if dst.Scheme == SchemeMail {
+		// the attachment is base64 encoded in lines of 76 chars
+		size = (size + 2) / 3 * 4
+		size += size / 76 * 2
+	}
+
+	return size <= dst.Limit
+}
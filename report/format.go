@@ -0,0 +1,102 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// ReportFormat is the schema version of the generated aggregate report
+type ReportFormat uint8
+
+const (
+	// RFC7489 is the aggregate report schema of RFC 7489 Appendix C
+	RFC7489 ReportFormat = iota
+	// DMARCbis is the aggregate report schema of DMARCbis (urn:ietf:params:xml:ns:dmarc-2.0)
+	DMARCbis
+)
+
+const (
+	namespace_dmarcbis = "urn:ietf:params:xml:ns:dmarc-2.0"
+	discovery_method   = "psl"
+)
+
+// ParseFormat return the report format of the given name, RFC 7489 if empty, or an error if unknown
+func ParseFormat(str string) (ReportFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "", RFC7489.String():
+		return RFC7489, nil
+	case DMARCbis.String():
+		return DMARCbis, nil
+	}
+
+	return RFC7489, fmt.Errorf("unknown report format '%s' (%s, %s)", str, RFC7489.String(), DMARCbis.String())
+}
+
+func (f ReportFormat) String() string {
+	switch f {
+	case DMARCbis:
+		return "dmarcbis"
+	default:
+		return "rfc7489"
+	}
+}
+
+func (f ReportFormat) feedbackTag() xml.StartElement {
+	tag := xml.StartElement{Name: xml.Name{Local: "feedback"}}
+
+	if f == DMARCbis {
+		tag.Attr = append(tag.Attr, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: namespace_dmarcbis})
+	}
+
+	return tag
+}
+
+// ReportPolicyBis is the policy_published element of the DMARCbis schema
+type ReportPolicyBis struct {
+	Domain    string `xml:"domain"`
+	P         string `xml:"p"`
+	SP        string `xml:"sp,omitempty"`
+	NP        string `xml:"np,omitempty"`
+	ADKIM     string `xml:"adkim,omitempty"`
+	ASPF      string `xml:"aspf,omitempty"`
+	Discovery string `xml:"discovery_method"`
+	FO        string `xml:"fo,omitempty"`
+	Testing   string `xml:"testing"`
+}
+
+func (pol ReportPolicy) dmarcbis() ReportPolicyBis {
+	var tst = "n"
+
+	if pol.Testing {
+		tst = "y"
+	}
+
+	return ReportPolicyBis{
+		Domain:    pol.Domain,
+		P:         pol.P,
+		SP:        pol.SP,
+		NP:        pol.NP,
+		ADKIM:     pol.ADKIM,
+		ASPF:      pol.ASPF,
+		Discovery: discovery_method,
+		FO:        pol.FO,
+		Testing:   tst,
+	}
+}
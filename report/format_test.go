@@ -0,0 +1,45 @@
+package report
+
+import (
+	"testing"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestParseFormat(t *testing.T) {
+	tst := []struct {
+		str string
+		fmt ReportFormat
+		err bool
+	}{
+		{"", RFC7489, false},
+		{"rfc7489", RFC7489, false},
+		{" DMARCbis ", DMARCbis, false},
+		{"dmarc2", RFC7489, true},
+		{"rfc7490", RFC7489, true},
+	}
+
+	for _, tc := range tst {
+		got, err := ParseFormat(tc.str)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error %v", tc.str, err, tc.err)
+		} else if got != tc.fmt {
+			t.Errorf("%q: got format %s, want %s", tc.str, got, tc.fmt)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package report
 
 import (
+	"fmt"
+
 	"github.com/nabbar/opendmarc-reports/config"
 	. "github.com/nabbar/opendmarc-reports/logger"
 )
@@ -21,20 +23,29 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-func (rep reportFile) SendFtp(uri string) {
+func (rep *reportFile) SendFtp(dst Destination) (err error) {
+	var uri = dst.Target
+
 	defer func() {
 		if r := recover(); r != nil {
 			InfoLevel.Logf("Recover Panic Value : %v", r)
-			return
+			err = recoverError(r)
 		}
 	}()
 
 	if config.GetConfig().IsTesting() {
-		InfoLevel.Logf("Testing mode : don't upload zip file '%s' to ftp '%s'", rep.GetZipName(), uri)
-		return
+		InfoLevel.Logf("Testing mode : don't upload file '%s' to ftp '%s'", rep.GetArchiveName(dst), uri)
+		return nil
 	}
 
+	src, err := rep.Open(dst)
+	PanicLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("opening report file '%s'", rep.GetArchiveName(dst)), err)
+
+	defer src.Close()
+
 	cli := config.GetConfig().GetFTP(uri)
 	defer cli.Close()
-	cli.Store(rep.GetFileName(), rep.zipFile)
+	cli.Store(rep.GetArchiveName(dst), src)
+
+	return nil
 }
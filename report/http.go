@@ -1,6 +1,9 @@
 package report
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/nabbar/opendmarc-reports/config"
 	. "github.com/nabbar/opendmarc-reports/logger"
 )
@@ -21,22 +24,35 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-func (rep reportFile) SendHttp(uri string) {
+func (rep *reportFile) SendHttp(dst Destination) (err error) {
+	var uri = dst.Target
+
 	defer func() {
 		if r := recover(); r != nil {
 			InfoLevel.Logf("Recover Panic Value : %v", r)
-			return
+			err = recoverError(r)
 		}
 	}()
 
 	if config.GetConfig().IsTesting() {
-		InfoLevel.Logf("Testing mode : don't post zip file '%s' to url '%s'", rep.GetZipName(), uri)
-		return
+		InfoLevel.Logf("Testing mode : don't post file '%s' to url '%s'", rep.GetArchiveName(dst), uri)
+		return nil
 	}
 
+	src, err := rep.Open(dst)
+	PanicLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("opening report file '%s'", rep.GetArchiveName(dst)), err)
+
+	defer src.Close()
+
 	cli := config.GetConfig().GetHTTP(uri)
 
-	if cli.Check() {
-		cli.Call(rep.zipFile)
+	if !cli.Check() {
+		return fmt.Errorf("checking url '%s'", uri)
 	}
+
+	if ok, res := cli.Call(dst.Compression.ContentType(), src); !ok {
+		return fmt.Errorf("posting file to url '%s' : %s", uri, strings.TrimSpace(res.String()))
+	}
+
+	return nil
 }
@@ -1,5 +1,10 @@
 package report
 
+import (
+	"sort"
+	"strings"
+)
+
 /*
 Copyright 2018 Nicolas JUHEL
 
@@ -16,44 +21,76 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 type ReportRecord struct {
-	Row         ReportRow `xml:"row"`
-	Identifiers struct {
-		HeaderFrom string `xml:"header_from"`
-	} `xml:"identifiers"`
-	AuthResults ReportAuth `xml:"auth_results"`
+	Row         ReportRow         `xml:"row"`
+	Identifiers ReportIdentifiers `xml:"identifiers"`
+	AuthResults ReportAuth        `xml:"auth_results"`
+
+	// keys identify the stored rows of the record, given back by the report for a dropped record
+	keys []interface{}
 }
 
 func GetReportRecord(ip, disp, dkim, spf, from, domain, result string, count int, repdkim []ReportDKIM) ReportRecord {
 	return ReportRecord{
-		Row: GetReportRow(ip, disp, dkim, spf, count),
-		Identifiers: struct {
-			HeaderFrom string `xml:"header_from"`
-		}{
-			HeaderFrom: from,
-		},
+		Row:         GetReportRow(ip, disp, dkim, spf, count),
+		Identifiers: GetReportIdentifiers("", domain, from),
 		AuthResults: GetReportAuth(domain, result, repdkim),
 	}
 }
 
+// SetKey set the key of the stored row of the record, a record merged from many rows keep all their keys
+func (rec *ReportRecord) SetKey(key interface{}) {
+	rec.keys = []interface{}{key}
+}
+
+// SetEnvelopeTo set the envelope recipient domain of the record
+func (rec *ReportRecord) SetEnvelopeTo(to string) {
+	rec.Identifiers.EnvelopeTo = to
+}
+
+// SetSPFDomain set the domain checked by SPF, if not the envelope from domain
+func (rec *ReportRecord) SetSPFDomain(domain string) {
+	if domain != "" {
+		rec.AuthResults.SPF.Domain = domain
+	}
+}
+
+// SetSPFScope set the scope (helo or mfrom) of the SPF domain of the record
+func (rec *ReportRecord) SetSPFScope(scope string) {
+	if scope != "" {
+		rec.AuthResults.SPF.Scope = scope
+	}
+}
+
+// AddReason add a policy override reason to the evaluated policy of the record
+func (rec *ReportRecord) AddReason(reason, comment string) {
+	if reason != "" {
+		rec.Row.PolicyEvaluated.Reason = append(rec.Row.PolicyEvaluated.Reason, GetReportReason(reason, comment))
+	}
+}
+
 type ReportRow struct {
-	SourceIp        string `xml:"source_ip"`
-	Count           int    `xml:"count"`
-	PolicyEvaluated struct {
-		Disposition string `xml:"disposition"`
-		DKIM        string `xml:"dkim"`
-		SPF         string `xml:"spf"`
-	} `xml:"policy_evaluated"`
+	SourceIp        string                `xml:"source_ip"`
+	Count           int                   `xml:"count"`
+	PolicyEvaluated ReportPolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type ReportPolicyEvaluated struct {
+	Disposition string         `xml:"disposition"`
+	DKIM        string         `xml:"dkim"`
+	SPF         string         `xml:"spf"`
+	Reason      []ReportReason `xml:"reason,omitempty"`
+}
+
+type ReportReason struct {
+	Type    string `xml:"type"`
+	Comment string `xml:"comment,omitempty"`
 }
 
 func GetReportRow(ip, disp, dkim, spf string, count int) ReportRow {
 	return ReportRow{
 		SourceIp: ip,
 		Count:    count,
-		PolicyEvaluated: struct {
-			Disposition string `xml:"disposition"`
-			DKIM        string `xml:"dkim"`
-			SPF         string `xml:"spf"`
-		}{
+		PolicyEvaluated: ReportPolicyEvaluated{
 			Disposition: disp,
 			DKIM:        dkim,
 			SPF:         spf,
@@ -61,13 +98,35 @@ func GetReportRow(ip, disp, dkim, spf string, count int) ReportRow {
 	}
 }
 
+func GetReportReason(reason, comment string) ReportReason {
+	return ReportReason{
+		Type:    reason,
+		Comment: comment,
+	}
+}
+
+type ReportIdentifiers struct {
+	EnvelopeTo   string `xml:"envelope_to,omitempty"`
+	EnvelopeFrom string `xml:"envelope_from"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+func GetReportIdentifiers(to, from, header string) ReportIdentifiers {
+	return ReportIdentifiers{
+		EnvelopeTo:   to,
+		EnvelopeFrom: from,
+		HeaderFrom:   header,
+	}
+}
+
 type ReportAuth struct {
-	SPF  ReportSPF    `xml:"spf"`
 	DKIM []ReportDKIM `xml:"dkim"`
+	SPF  ReportSPF    `xml:"spf"`
 }
 
 type ReportSPF struct {
 	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
 	Result string `xml:"result"`
 }
 
@@ -81,6 +140,41 @@ func GetReportAuth(domain, result string, dkim []ReportDKIM) ReportAuth {
 func GetReportSPF(domain, result string) ReportSPF {
 	return ReportSPF{
 		Domain: domain,
+		Scope:  "mfrom",
 		Result: result,
 	}
 }
+
+// groupKey return the identity of a record : records with the same source, evaluated policy,
+// identifiers and auth results are the same row with a summed count (RFC 7489 Appendix C).
+func (rec ReportRecord) groupKey() string {
+	var (
+		dkim = make([]string, 0)
+		resn = make([]string, 0)
+	)
+
+	for _, d := range rec.AuthResults.DKIM {
+		dkim = append(dkim, d.Domain+"/"+d.Selector+"="+d.Result+" "+d.HumanResult)
+	}
+
+	for _, r := range rec.Row.PolicyEvaluated.Reason {
+		resn = append(resn, r.Type+" "+r.Comment)
+	}
+
+	sort.Strings(dkim)
+
+	return strings.Join([]string{
+		rec.Row.SourceIp,
+		rec.Row.PolicyEvaluated.Disposition,
+		rec.Row.PolicyEvaluated.DKIM,
+		rec.Row.PolicyEvaluated.SPF,
+		strings.Join(resn, ","),
+		rec.Identifiers.EnvelopeTo,
+		rec.Identifiers.EnvelopeFrom,
+		rec.Identifiers.HeaderFrom,
+		rec.AuthResults.SPF.Domain,
+		rec.AuthResults.SPF.Scope,
+		rec.AuthResults.SPF.Result,
+		strings.Join(dkim, ","),
+	}, "|")
+}
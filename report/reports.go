@@ -9,17 +9,22 @@ import (
 	"strings"
 
 	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"time"
 
-	"net/url"
-
 	"sync"
 
+	"io/ioutil"
+	"os"
+
 	"github.com/kennygrant/sanitize"
 	. "github.com/nabbar/opendmarc-reports/logger"
 	"github.com/nabbar/opendmarc-reports/tools"
+	"github.com/nabbar/opendmarc-reports/version"
 )
 
 /*
@@ -38,29 +43,69 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// version of the aggregate report format (RFC 7489 Appendix C)
+const feedback_version = "1.0"
+
 type feedback struct {
+	Version  string         `xml:"version"`
 	MetaData ReportMetadata `xml:"report_metadata"`
 	Policy   ReportPolicy   `xml:"policy_published"`
-	Record   []ReportRecord `xml:"record"`
+}
+
+// archive is a generated file of the report for one format and compression
+type archive struct {
+	file    string
+	size    int64
+	xmlSize int64
+	hash    string
+	total   xmlCount
+}
+
+// xmlCount is the number of records and messages written into a feedback document,
+// and the number of records read from the source but dropped as not matching the schema, with their keys
+type xmlCount struct {
+	records int
+	count   int
+	dropped int
+	keys    []interface{}
 }
 
 type reportFile struct {
-	repuri  []string
-	xmlFile feedback
-	xmlName string
-	zipName string
-	zipFile *bytes.Buffer
+	m sync.Mutex
+
+	repuri   []string
+	xmlFile  feedback
+	source   RecordSource
+	xmlName  string
+	baseName string
+	compress ReportCompression
+
+	files map[string]*archive
+	parts []*reportFile
+	total xmlCount
 }
 
 type Report interface {
-	Buffer(headerXml bool) (*bytes.Buffer, error)
-	String(headerXml bool) (string, error)
-	Byte(headerXml bool) ([]byte, error)
-	Zip() (*bytes.Buffer, error)
-	SendReport()
+	WriteXml(w io.Writer, format ReportFormat, headerXml bool) error
+	Buffer(format ReportFormat, headerXml bool) (*bytes.Buffer, error)
+	String(format ReportFormat, headerXml bool) (string, error)
+	Byte(format ReportFormat, headerXml bool) ([]byte, error)
+	Archive(dst Destination) error
+	Open(dst Destination) (io.ReadCloser, error)
+	Close() error
+	SendReport() []Delivery
+	SendTo(dst Destination) Delivery
 
 	GetFileName() string
-	GetZipName() string
+	GetCompression() ReportCompression
+	GetArchiveName(dst Destination) string
+	GetArchiveSize(dst Destination) int64
+	GetArchiveHash(dst Destination) string
+	GetXmlSize(dst Destination) int64
+	GetRecordCount() int
+	GetMessageCount() int
+	GetDroppedCount() int
+	GetDroppedKeys() []interface{}
 
 	GetFromEmail() *tools.MailAddress
 	GetFromOrg() string
@@ -68,13 +113,21 @@ type Report interface {
 	GetDomain() string
 	GetDateRange() (time.Time, time.Time)
 
+	GetDestinations() []Destination
 	GetUriEmail() tools.ListMailAddress
 	GetUriHttp() []string
 	GetUriFtp() []string
 	GetUriUnknown() []string
 }
 
-func GetReport(repuri string, meta ReportMetadata, policy ReportPolicy, record []ReportRecord) Report {
+func GetReport(repuri string, meta ReportMetadata, policy ReportPolicy, compression ReportCompression, record []ReportRecord) Report {
+	return GetReportSource(repuri, meta, policy, compression, NewRecordList(record))
+}
+
+// GetReportSource return a report that will encode records directly from the source
+// into the xml / compressed file without loading all records in memory.
+// The compression is used for each destination without its own compression in config.
+func GetReportSource(repuri string, meta ReportMetadata, policy ReportPolicy, compression ReportCompression, source RecordSource) Report {
 	email := strings.Split(meta.Email, "@")
 	domain := email[len(email)-1]
 
@@ -88,55 +141,185 @@ func GetReport(repuri string, meta ReportMetadata, policy ReportPolicy, record [
 	return &reportFile{
 		repuri: strings.Split(repuri, ","),
 		xmlFile: feedback{
+			Version:  feedback_version,
 			MetaData: meta,
 			Policy:   policy,
-			Record:   record,
 		},
-		xmlName: baseName + ".xml",
-		zipName: baseName + ".zip",
+		source:   source,
+		xmlName:  baseName + ".xml",
+		baseName: baseName,
+		compress: compression,
+		files:    make(map[string]*archive),
+	}
+}
+
+// GetReportPayload return a report over an already generated file, to send it again to its destination
+func GetReportPayload(meta ReportMetadata, policy ReportPolicy, dst Destination, fileName string, payload []byte) (Report, error) {
+	var (
+		rep = GetReportSource(dst.Uri, meta, policy, dst.Compression, nil).(*reportFile)
+		sum = sha256.Sum256(payload)
+	)
+
+	tmp, err := ioutil.TempFile("", "dmarc-report-")
+	if err != nil {
+		return nil, err
 	}
+
+	if _, err = tmp.Write(payload); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	} else if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	rep.baseName = strings.TrimSuffix(fileName, dst.Compression.Extension())
+	rep.xmlName = rep.baseName + ".xml"
+	rep.files[dst.key()] = &archive{
+		file: tmp.Name(),
+		size: int64(len(payload)),
+		hash: hex.EncodeToString(sum[:]),
+	}
+
+	return rep, nil
 }
 
-func (rep reportFile) GetFromEmail() *tools.MailAddress {
+func (rep *reportFile) GetFromEmail() *tools.MailAddress {
 	return tools.MailAddressParser(rep.xmlFile.MetaData.Email)
 }
 
-func (rep reportFile) GetFromOrg() string {
+func (rep *reportFile) GetFromOrg() string {
 	return rep.xmlFile.MetaData.OrgName
 }
 
-func (rep reportFile) GetReportId() string {
+func (rep *reportFile) GetReportId() string {
 	return rep.xmlFile.MetaData.ReportId
 }
 
-func (rep reportFile) GetDomain() string {
+func (rep *reportFile) GetDomain() string {
 	return rep.xmlFile.Policy.Domain
 }
 
-func (rep reportFile) GetDateRange() (time.Time, time.Time) {
+func (rep *reportFile) GetDateRange() (time.Time, time.Time) {
 	return time.Unix(int64(rep.xmlFile.MetaData.DateRange.Begin), 0), time.Unix(int64(rep.xmlFile.MetaData.DateRange.End), 0)
 }
 
-func (rep reportFile) Buffer(headerXml bool) (*bytes.Buffer, error) {
+// WriteXml encode the feedback document in the given format to the writer, record by record from the report source
+func (rep *reportFile) WriteXml(w io.Writer, format ReportFormat, headerXml bool) error {
+	tot, err := rep.writeXml(w, format, headerXml)
+
+	if err != nil {
+		return err
+	}
+
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	rep.total = tot
+
+	return nil
+}
+
+// writeXml encode the feedback document and return the number of records and messages written.
+// The stored values are mapped to the schema values, a record that cannot be mapped is dropped.
+func (rep *reportFile) writeXml(w io.Writer, format ReportFormat, headerXml bool) (xmlCount, error) {
 	var (
-		out = bytes.NewBuffer(make([]byte, 0))
+		enc = xml.NewEncoder(w)
+		tag = format.feedbackTag()
+		met = rep.xmlFile.MetaData
+		pol interface{}
+		tot = xmlCount{}
 	)
 
+	plc, flg := rep.xmlFile.Policy.normalize()
+
+	if len(flg) > 0 {
+		met.Error = append(append(make([]string, 0, len(met.Error)+len(flg)), met.Error...), flg...)
+		WarnLevel.Logf("Report '%s' : %s", rep.GetReportId(), strings.Join(flg, ", "))
+	}
+
+	switch format {
+	case DMARCbis:
+		met.Generator = version.GetHeader()
+		pol = plc.dmarcbis()
+	default:
+		pol = plc
+	}
+
+	if rep.source == nil {
+		return tot, errors.New("empty record source")
+	} else if err := rep.validateHeader(format, met, plc); err != nil {
+		return tot, err
+	}
+
+	cur, err := rep.source()
+	if err != nil {
+		return tot, err
+	}
+
+	defer cur.Close()
+
 	if headerXml {
-		out.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\" ?>\n")
+		if _, err = io.WriteString(w, "<?xml version=\"1.0\" encoding=\"UTF-8\" ?>\n"); err != nil {
+			return tot, err
+		}
 	}
 
-	if buf, err := xml.MarshalIndent(rep.xmlFile, "", "  "); err != nil {
-		return nil, err
-	} else if _, err = out.Write(buf); err != nil {
+	enc.Indent("", "  ")
+
+	if err = enc.EncodeToken(tag); err != nil {
+		return tot, err
+	} else if err = enc.EncodeElement(rep.xmlFile.Version, xml.StartElement{Name: xml.Name{Local: "version"}}); err != nil {
+		return tot, err
+	} else if err = enc.EncodeElement(met, xml.StartElement{Name: xml.Name{Local: "report_metadata"}}); err != nil {
+		return tot, err
+	} else if err = enc.EncodeElement(pol, xml.StartElement{Name: xml.Name{Local: "policy_published"}}); err != nil {
+		return tot, err
+	}
+
+	for cur.Next() {
+		src := cur.Record()
+		rec, e := rep.normalizeRecord(src)
+
+		if e != nil {
+			WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("dropping record of report '%s'", rep.GetReportId()), e)
+			tot.dropped++
+			tot.keys = append(tot.keys, src.keys...)
+			continue
+		} else if err = enc.EncodeElement(rec, xml.StartElement{Name: xml.Name{Local: "record"}}); err != nil {
+			return tot, err
+		}
+
+		tot.records++
+		tot.count += rec.Row.Count
+	}
+
+	if err = cur.Err(); err != nil {
+		return tot, err
+	} else if err = enc.EncodeToken(tag.End()); err != nil {
+		return tot, err
+	} else if err = enc.Flush(); err != nil {
+		return tot, err
+	}
+
+	return tot, nil
+}
+
+func (rep *reportFile) Buffer(format ReportFormat, headerXml bool) (*bytes.Buffer, error) {
+	var (
+		out = bytes.NewBuffer(make([]byte, 0))
+	)
+
+	if err := rep.WriteXml(out, format, headerXml); err != nil {
 		return nil, err
 	}
 
 	return out, nil
 }
 
-func (rep reportFile) String(headerXml bool) (string, error) {
-	buf, err := rep.Buffer(headerXml)
+func (rep *reportFile) String(format ReportFormat, headerXml bool) (string, error) {
+	buf, err := rep.Buffer(format, headerXml)
 
 	if err != nil {
 		return "", err
@@ -145,8 +328,8 @@ func (rep reportFile) String(headerXml bool) (string, error) {
 	return buf.String(), nil
 }
 
-func (rep reportFile) Byte(headerXml bool) ([]byte, error) {
-	buf, err := rep.Buffer(headerXml)
+func (rep *reportFile) Byte(format ReportFormat, headerXml bool) ([]byte, error) {
+	buf, err := rep.Buffer(format, headerXml)
 
 	if err != nil {
 		return nil, err
@@ -155,72 +338,278 @@ func (rep reportFile) Byte(headerXml bool) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (rep *reportFile) Zip() (*bytes.Buffer, error) {
-	if rep.zipFile == nil || rep.zipFile.Len() < 1 {
-		var (
-			buf = bytes.NewBuffer(make([]byte, 0))
-			wrt = zip.NewWriter(buf)
-		)
-
-		// Register a custom Deflate compressor.
-		wrt.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-			return flate.NewWriter(out, flate.BestCompression)
-		})
-
-		wrt.SetComment(
-			fmt.Sprintf("From: %s | Org: %s | Domain : %s | Date From : %s | Date To : %s",
-				rep.xmlFile.MetaData.Email,
-				rep.xmlFile.MetaData.OrgName,
-				rep.xmlFile.Policy.Domain,
-				time.Unix(int64(rep.xmlFile.MetaData.DateRange.Begin), 0).String(),
-				time.Unix(int64(rep.xmlFile.MetaData.DateRange.End), 0).String(),
-			),
-		)
-
-		if src, err := rep.Buffer(true); err != nil {
-			return nil, err
-		} else if f, err := wrt.Create(rep.xmlName); err != nil {
-			return nil, err
-		} else if _, err := f.Write(src.Bytes()); err != nil {
-			return nil, err
-		} else if err := wrt.Close(); err != nil {
-			return nil, err
+// Archive generate the file of the destination format and compression into a temporary file, only once by kind.
+func (rep *reportFile) Archive(dst Destination) error {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	if _, ok := rep.files[dst.key()]; ok {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile("", "dmarc-report-")
+	if err != nil {
+		return err
+	}
+
+	var (
+		arc = &archive{
+			file: tmp.Name(),
+		}
+		sum = sha256.New()
+		out = io.MultiWriter(tmp, sum)
+	)
+
+	switch dst.Compression {
+	case CompressGzip:
+		err = rep.writeGzip(out, dst.Format, arc)
+	case CompressNone:
+		err = rep.writeFile(out, dst.Format, arc)
+	default:
+		err = rep.writeZip(out, dst.Format, arc)
+	}
+
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(arc.file)
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(arc.file)
+		return err
+	}
+
+	if inf, err := os.Stat(arc.file); err != nil {
+		_ = os.Remove(arc.file)
+		return err
+	} else {
+		arc.size = inf.Size()
+		arc.hash = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	rep.files[dst.key()] = arc
+	rep.total = arc.total
+	DebugLevel.Logf("File '%s' generated for report '%s' in format %s into '%s' (%d records, %d dropped, %d bytes)", rep.GetArchiveName(dst), rep.GetReportId(), dst.Format.String(), arc.file, arc.total.records, arc.total.dropped, arc.size)
+
+	return nil
+}
+
+func (rep *reportFile) comment() string {
+	return fmt.Sprintf("From: %s | Org: %s | Domain : %s | Date From : %s | Date To : %s",
+		rep.xmlFile.MetaData.Email,
+		rep.xmlFile.MetaData.OrgName,
+		rep.xmlFile.Policy.Domain,
+		time.Unix(int64(rep.xmlFile.MetaData.DateRange.Begin), 0).String(),
+		time.Unix(int64(rep.xmlFile.MetaData.DateRange.End), 0).String(),
+	)
+}
+
+func (rep *reportFile) writeZip(out io.Writer, format ReportFormat, arc *archive) error {
+	var (
+		wrt = zip.NewWriter(out)
+	)
+
+	// Register a custom Deflate compressor.
+	wrt.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.BestCompression)
+	})
+
+	wrt.SetComment(rep.comment())
+
+	f, err := wrt.Create(rep.xmlName)
+	if err != nil {
+		return err
+	} else if err = rep.writeFile(f, format, arc); err != nil {
+		return err
+	}
+
+	return wrt.Close()
+}
+
+func (rep *reportFile) writeGzip(out io.Writer, format ReportFormat, arc *archive) error {
+	wrt, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	wrt.Name = rep.xmlName
+	wrt.Comment = rep.comment()
+	wrt.ModTime = time.Now()
+
+	if err = rep.writeFile(wrt, format, arc); err != nil {
+		return err
+	}
+
+	return wrt.Close()
+}
+
+// writeFile write the xml file and keep its size and its number of records and messages
+func (rep *reportFile) writeFile(out io.Writer, format ReportFormat, arc *archive) error {
+	var (
+		cnt = &countWriter{w: out}
+		err error
+	)
+
+	if arc.total, err = rep.writeXml(cnt, format, true); err != nil {
+		return err
+	}
+
+	arc.xmlSize = cnt.n
+
+	return nil
+}
+
+// Open return a new reader on the generated file of the destination, each sender must use its own reader
+func (rep *reportFile) Open(dst Destination) (io.ReadCloser, error) {
+	if err := rep.Archive(dst); err != nil {
+		return nil, err
+	}
+
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	return os.Open(rep.files[dst.key()].file)
+}
+
+// Close remove the temporary generated files, including the ones of the split reports
+func (rep *reportFile) Close() error {
+	var res error
+
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	for _, p := range rep.parts {
+		if err := p.Close(); err != nil {
+			res = err
 		}
+	}
 
-		rep.zipFile = buf
+	rep.parts = nil
+
+	for k, a := range rep.files {
+		if err := os.Remove(a.file); err != nil {
+			res = err
+		}
+
+		delete(rep.files, k)
 	}
 
-	return rep.zipFile, nil
+	return res
 }
 
-func (rep reportFile) GetFileName() string {
+func (rep *reportFile) GetFileName() string {
 	return rep.xmlName
 }
 
-func (rep reportFile) GetZipName() string {
-	return rep.zipName
+func (rep *reportFile) GetCompression() ReportCompression {
+	return rep.compress
 }
 
-func (rep reportFile) parseUri(filter string) []string {
-	var res = make([]string, 0)
+func (rep *reportFile) GetArchiveName(dst Destination) string {
+	return rep.baseName + dst.Compression.Extension()
+}
+
+func (rep *reportFile) GetArchiveSize(dst Destination) int64 {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	if a, ok := rep.files[dst.key()]; ok {
+		return a.size
+	}
+
+	return 0
+}
+
+// GetArchiveHash return the sha256 of the generated file of the destination
+func (rep *reportFile) GetArchiveHash(dst Destination) string {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	if a, ok := rep.files[dst.key()]; ok {
+		return a.hash
+	}
+
+	return ""
+}
+
+func (rep *reportFile) GetXmlSize(dst Destination) int64 {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	if a, ok := rep.files[dst.key()]; ok {
+		return a.xmlSize
+	}
+
+	return 0
+}
+
+func (rep *reportFile) GetRecordCount() int {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	return rep.total.records
+}
+
+func (rep *reportFile) GetMessageCount() int {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	return rep.total.count
+}
+
+// GetDroppedCount return the number of records dropped from the report as not matching the schema
+func (rep *reportFile) GetDroppedCount() int {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	return rep.total.dropped
+}
+
+// GetDroppedKeys return the keys of the stored rows of the dropped records, set by the records source
+func (rep *reportFile) GetDroppedKeys() []interface{} {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	return append(make([]interface{}, 0, len(rep.total.keys)), rep.total.keys...)
+}
+
+// sourceCount return the number of records read from the source, including the dropped ones
+func (rep *reportFile) sourceCount() int {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+
+	return rep.total.records + rep.total.dropped
+}
+
+// GetDestinations return the parsed rua items of the report, without the "-" marker
+func (rep *reportFile) GetDestinations() []Destination {
+	var res = make([]Destination, 0)
 
 	for _, s := range rep.repuri {
-		if s == "" {
+		if s = strings.TrimSpace(s); s == "" || s == "-" {
 			continue
 		}
 
-		if u, e := url.Parse(s); e != nil {
-			WarnLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing rua list with value '%s'", s), e)
-			continue
-		} else if strings.HasPrefix(u.Scheme, filter) {
-			res = append(res, strings.TrimSpace(s))
+		res = append(res, ParseDestination(s, rep.compress))
+	}
+
+	return res
+}
+
+func (rep *reportFile) parseUri(scheme string) []string {
+	var res = make([]string, 0)
+
+	for _, d := range rep.GetDestinations() {
+		if d.Scheme == scheme {
+			res = append(res, d.Uri)
 		}
 	}
 
 	return res
 }
 
-func (rep reportFile) isUriEmpty() bool {
+func (rep *reportFile) isUriEmpty() bool {
 	for _, s := range rep.repuri {
 		if s != "-" {
 			return false
@@ -230,92 +619,134 @@ func (rep reportFile) isUriEmpty() bool {
 	return true
 }
 
-func (rep reportFile) GetUriEmail() tools.ListMailAddress {
+func (rep *reportFile) GetUriEmail() tools.ListMailAddress {
 	var res = tools.NewListMailAddress()
 
-	for _, adr := range rep.parseUri("mail") {
-		if adr == "" {
-			continue
+	for _, d := range rep.GetDestinations() {
+		if d.Scheme == SchemeMail && d.Target != "" {
+			res.AddParseEmail(d.Target)
 		}
-
-		t := strings.Split(adr, ":")
-		m := strings.Join(t[1:], ":")
-		res.AddParseEmail(m)
 	}
 
 	return res
 }
 
-func (rep reportFile) GetUriHttp() []string {
-	return rep.parseUri("http")
+func (rep *reportFile) GetUriHttp() []string {
+	return rep.parseUri(SchemeHttp)
 }
 
-func (rep reportFile) GetUriFtp() []string {
-	return rep.parseUri("ftp")
+func (rep *reportFile) GetUriFtp() []string {
+	return rep.parseUri(SchemeFtp)
 }
 
-func (rep reportFile) GetUriUnknown() []string {
-	var res = make([]string, 0)
+func (rep *reportFile) GetUriUnknown() []string {
+	return rep.parseUri(SchemeUnknown)
+}
 
-	for _, s := range rep.repuri {
-		if s == "" {
-			continue
+// SendReport send the report to all destinations and return the result for each of them
+func (rep *reportFile) SendReport() []Delivery {
+	var (
+		wg   sync.WaitGroup
+		mut  sync.Mutex
+		res  = make([]Delivery, 0)
+		mail = make(map[string][]Destination)
+		keys = make([]string, 0)
+		add  = func(lst ...Delivery) {
+			mut.Lock()
+			defer mut.Unlock()
+			res = append(res, lst...)
 		}
+	)
 
-		if u, e := url.Parse(s); e != nil {
-			res = append(res, s)
-		} else if strings.HasPrefix(u.Scheme, "mail") {
-			continue
-		} else if !strings.HasPrefix(u.Scheme, "http") {
-			continue
-		} else if !strings.HasPrefix(u.Scheme, "ftp") {
+	if rep == nil || rep.isUriEmpty() {
+		PanicLevel.LogErrorCtx(DebugLevel, "checking report", errors.New("empty or nil report"))
+		return res
+	}
+
+	for _, d := range rep.GetDestinations() {
+		if d.Scheme == SchemeUnknown {
+			err := errors.New("unknown send method")
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing rua field with item '%s'", d.Uri), err)
+			add(rep.delivery(d, DeliveryFailed, err))
 			continue
-		} else if s == "-" {
+		}
+
+		if err := rep.Archive(d); err != nil || rep.GetArchiveSize(d) < 1 {
+			if err == nil {
+				err = errors.New("empty file")
+			}
+
+			ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("creating %s file in format %s", d.Compression.String(), d.Format.String()), err)
+			add(rep.delivery(d, DeliveryFailed, err))
 			continue
-		} else {
-			res = append(res, s)
 		}
-	}
 
-	return res
-}
+		if !d.Fits(rep.GetArchiveSize(d)) {
+			wg.Add(1)
+			go func(d Destination) {
+				defer wg.Done()
+				add(rep.sendSplit(d)...)
+			}(d)
 
-func (rep *reportFile) SendReport() {
-	if rep == nil || rep.isUriEmpty() {
-		PanicLevel.LogErrorCtx(DebugLevel, "checking report", errors.New("empty or nil report"))
-		return
+			continue
+		}
+
+		switch d.Scheme {
+		case SchemeMail:
+			// one mail by format and compression for all mail recipients
+			if _, ok := mail[d.key()]; !ok {
+				keys = append(keys, d.key())
+			}
+			mail[d.key()] = append(mail[d.key()], d)
+
+		case SchemeHttp, SchemeFtp:
+			wg.Add(1)
+			go func(d Destination) {
+				defer wg.Done()
+				add(rep.SendTo(d))
+			}(d)
+		}
 	}
 
-	_, err := rep.Zip()
+	for _, k := range keys {
+		err := rep.SendMail(mail[k])
 
-	if err != nil || rep.zipFile.Len() < 1 {
-		ErrorLevel.LogErrorCtx(NilLevel, "creating Zip file", err)
-		return
+		for _, d := range mail[k] {
+			add(rep.delivery(d, DeliverySent, err))
+		}
 	}
 
-	var wg sync.WaitGroup
+	InfoLevel.Logf("Waiting sending reports threads has finished...")
+	wg.Wait()
 
-	for _, h := range rep.GetUriHttp() {
-		wg.Add(1)
-		go func() {
-			rep.SendHttp(h)
-			wg.Done()
-		}()
-	}
+	return res
+}
 
-	for _, f := range rep.GetUriFtp() {
-		wg.Add(1)
-		go func() {
-			rep.SendFtp(f)
-			wg.Done()
-		}()
+// SendTo send the report to only one destination
+func (rep *reportFile) SendTo(dst Destination) Delivery {
+	var err error
+
+	switch dst.Scheme {
+	case SchemeMail:
+		err = rep.SendMail([]Destination{dst})
+	case SchemeHttp:
+		err = rep.SendHttp(dst)
+	case SchemeFtp:
+		err = rep.SendFtp(dst)
+	default:
+		err = errors.New("unknown send method")
 	}
 
-	for _, u := range rep.GetUriUnknown() {
-		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("parsing rua field with item '%s'", u), errors.New("unknown send method"))
-	}
+	return rep.delivery(dst, DeliverySent, err)
+}
 
-	rep.SendMail()
-	InfoLevel.Logf("Waiting sending reports threads has finished...")
-	wg.Wait()
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
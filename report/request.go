@@ -16,20 +16,24 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 type ReportMetadata struct {
-	OrgName   string `xml:"org_name"`
-	Email     string `xml:"email"`
-	ReportId  string `xml:"report_id"`
-	DateRange struct {
+	OrgName      string `xml:"org_name"`
+	Email        string `xml:"email"`
+	ExtraContact string `xml:"extra_contact_info,omitempty"`
+	ReportId     string `xml:"report_id"`
+	DateRange    struct {
 		Begin int `xml:"begin"`
 		End   int `xml:"end"`
 	} `xml:"date_range"`
+	Error     []string `xml:"error,omitempty"`
+	Generator string   `xml:"generator,omitempty"`
 }
 
-func GetReportMetadata(org, email string, id string, begin, end int) ReportMetadata {
+func GetReportMetadata(org, email, contact string, id string, begin, end int, errs ...string) ReportMetadata {
 	return ReportMetadata{
-		OrgName:  org,
-		Email:    email,
-		ReportId: id,
+		OrgName:      org,
+		Email:        email,
+		ExtraContact: contact,
+		ReportId:     id,
 		DateRange: struct {
 			Begin int `xml:"begin"`
 			End   int `xml:"end"`
@@ -37,6 +41,7 @@ func GetReportMetadata(org, email string, id string, begin, end int) ReportMetad
 			Begin: begin,
 			End:   end,
 		},
+		Error: errs,
 	}
 }
 
@@ -47,15 +52,31 @@ type ReportPolicy struct {
 	P      string `xml:"p"`
 	SP     string `xml:"sp,omitempty"`
 	PCT    int    `xml:"pct"`
+	FO     string `xml:"fo"`
+
+	// only used by the DMARCbis format
+	NP      string `xml:"-"`
+	Testing bool   `xml:"-"`
 }
 
-func GetReportPolicy(domain, adkim, aspf, p, sp string, pct int) ReportPolicy {
+func GetReportPolicy(domain, adkim, aspf, p, sp string, pct int, fo string) ReportPolicy {
+	if fo == "" {
+		fo = "0"
+	}
+
 	return ReportPolicy{
 		Domain: domain,
 		ADKIM:  adkim,
-		ASPF:   adkim,
+		ASPF:   aspf,
 		P:      p,
 		SP:     sp,
 		PCT:    pct,
+		FO:     fo,
 	}
 }
+
+// SetDMARCbis set the policy values only published into the DMARCbis format
+func (pol *ReportPolicy) SetDMARCbis(np string, testing bool) {
+	pol.NP = np
+	pol.Testing = testing
+}
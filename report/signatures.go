@@ -17,13 +17,17 @@ limitations under the License.
 */
 
 type ReportDKIM struct {
-	Domain string `xml:"domain"`
-	Result string `xml:"result"`
+	Domain      string `xml:"domain"`
+	Selector    string `xml:"selector,omitempty"`
+	Result      string `xml:"result"`
+	HumanResult string `xml:"human_result,omitempty"`
 }
 
-func GetReportDKIM(domain, result string) ReportDKIM {
+func GetReportDKIM(domain, selector, result, human string) ReportDKIM {
 	return ReportDKIM{
-		Domain: domain,
-		Result: result,
+		Domain:      domain,
+		Selector:    selector,
+		Result:      result,
+		HumanResult: human,
 	}
 }
@@ -32,15 +32,94 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-func (rep reportFile) SendMail() {
+// SendMail send one mail with the report file to all given destinations, sharing the same format and compression
+func (rep *reportFile) SendMail(lst []Destination) error {
+	if len(lst) < 1 {
+		return nil
+	}
+
 	var (
-		to  = rep.GetUriEmail()
-		rcp = config.GetConfig().GetMakeRecipient(to)
-		frm = config.GetConfig().GetEmail()
-		tmp = make([]byte, 0)
+		dst = lst[0]
+		fil = rep.GetArchiveName(dst)
+	)
+
+	return rep.sendMail(lst, fil, func(wrt io.WriteCloser) {
+		var (
+			bnd string
+			err error
+		)
+
+		if rep.GetArchiveSize(dst) < 1 {
+			PanicLevel.LogErrorCtx(NilLevel, "generating xml report file", errors.New("report file is empty"))
+		}
+
+		src, err := rep.Open(dst)
+		PanicLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("opening report file '%s'", fil), err)
+
+		defer src.Close()
+
+		bnd, err = tools.GenerateBoundary()
+		PanicLevel.LogErrorCtxf(DebugLevel, "generating boundary '%s'", err, bnd)
+		bnd = bnd[:28]
+
+		writeHeader(wrt, "Content-Type", fmt.Sprintf("multipart/mixed; boundary=\"%s\"", bnd))
+
+		writeCRLF(wrt)
+		err = writeString(wrt, fmt.Sprintf("--%s", bnd))
+		PanicLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("writing multipart boundary '%s' part mail contents to smtp server", bnd), err)
+		writeCRLF(wrt)
+
+		writeHeader(wrt, "Content-Type", dst.Compression.ContentType())
+		writeHeader(wrt, "Content-Transfer-Encoding", "base64")
+		writeHeader(wrt, "Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fil))
+		writeCRLF(wrt)
+
+		// write base64 content in lines of up to 76 chars
+		lin := &lineWriter{w: wrt, max: 76}
+		enc := base64.NewEncoder(base64.StdEncoding, lin)
+
+		_, err = io.Copy(enc, src)
+		PanicLevel.LogErrorCtx(NilLevel, "writing attachment to smtp server", err)
 
-		bnd string
-		err error
+		err = enc.Close()
+		PanicLevel.LogErrorCtx(NilLevel, "writing end of attachment to smtp server", err)
+
+		if lin.n != 0 {
+			writeCRLF(wrt)
+		}
+
+		writeCRLF(wrt)
+		writeCRLF(wrt)
+		err = writeString(wrt, fmt.Sprintf("--%s--", bnd))
+		PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("writing end multipart boundary '%s' part mail contents to smtp server", bnd), err)
+		writeCRLF(wrt)
+		writeCRLF(wrt)
+	})
+}
+
+// SendNotice send a short text mail instead of the report to the destination (RFC 7489 §7.2.2)
+func (rep *reportFile) SendNotice(dst Destination, reason string) error {
+	return rep.sendMail([]Destination{dst}, rep.GetArchiveName(dst), func(wrt io.WriteCloser) {
+		writeHeader(wrt, "Content-Type", "text/plain; charset=\"utf-8\"")
+		writeCRLF(wrt)
+
+		err := writeString(wrt, strings.Join([]string{
+			fmt.Sprintf("A DMARC aggregate report is available for domain %s", rep.GetDomain()),
+			fmt.Sprintf("Report-ID: %s", rep.GetReportId()),
+			fmt.Sprintf("Date-Range: %s - %s", time.Unix(int64(rep.xmlFile.MetaData.DateRange.Begin), 0).UTC().Format(time.RFC1123Z), time.Unix(int64(rep.xmlFile.MetaData.DateRange.End), 0).UTC().Format(time.RFC1123Z)),
+			fmt.Sprintf("But it was not sent to '%s' : %s", dst.Uri, reason),
+			"",
+		}, "\r\n"))
+		PanicLevel.LogErrorCtx(NilLevel, "writing notice to smtp server", err)
+	})
+}
+
+// sendMail open the smtp transaction to the destinations, write the common headers and call the body function
+func (rep *reportFile) sendMail(lst []Destination, fil string, body func(wrt io.WriteCloser)) (err error) {
+	var (
+		to  = tools.NewListMailAddress()
+		rcp tools.ListMailAddress
+		frm = config.GetConfig().GetEmail()
 		wrt io.WriteCloser
 		cli *smtp.Client
 	)
@@ -48,31 +127,34 @@ func (rep reportFile) SendMail() {
 	defer func() {
 		if r := recover(); r != nil {
 			InfoLevel.Logf("Recover Panic Value : %v", r)
+			err = recoverError(r)
 		}
 		if cli != nil {
-			err = cli.Close()
-			PanicLevel.LogErrorCtx(InfoLevel, "closing SMTP connection", err)
+			e := cli.Close()
+			ErrorLevel.LogErrorCtx(InfoLevel, "closing SMTP connection", e)
 		}
 	}()
 
-	cli = config.GetConfig().GetSMTP().Client()
+	for _, d := range lst {
+		to.AddParseEmail(d.Target)
+	}
+
+	rcp = config.GetConfig().GetMakeRecipient(to)
 
 	if to.IsEmpty() {
-		InfoLevel.Logf("Skip Mail => Domain '%s' / Request '%s' / ZipFileName : '%s'", rep.GetDomain(), rep.repuri, rep.zipFile)
-		return
+		InfoLevel.Logf("Skip Mail => Domain '%s' / Request '%s' / FileName : '%s'", rep.GetDomain(), rep.repuri, fil)
+		return errors.New("empty mail recipient")
 	}
 
+	cli = config.GetConfig().GetSMTP().Client()
+
 	if config.GetConfig().IsTesting() {
-		InfoLevel.Logf("Testing mode : send zip file '%s' to mail '%s' instead of mail '[%v]'", rep.GetZipName(), frm.String(), to)
+		InfoLevel.Logf("Testing mode : send file '%s' to mail '%s' instead of mail '[%v]'", fil, frm.String(), to)
 		to = tools.NewListMailAddress()
 		to.Add(frm)
 		rcp = config.GetConfig().GetMakeRecipient(to)
 	}
 
-	if rep.zipFile.Len() < 1 {
-		PanicLevel.LogErrorCtx(NilLevel, "generating xml report file", errors.New("buffer is empty"))
-	}
-
 	err = cli.Noop()
 	PanicLevel.LogErrorCtx(InfoLevel, "checking SMTP connection is up", err)
 
@@ -108,60 +190,15 @@ func (rep reportFile) SendMail() {
 	writeHeader(wrt, "Auto-Submitted", "auto-generated")
 	writeHeader(wrt, "MIME-Version", "1.0")
 
-	bnd, err = tools.GenerateBoundary()
-	PanicLevel.LogErrorCtxf(DebugLevel, "generating boundary '%s'", err, bnd)
-	bnd = bnd[:28]
+	body(wrt)
 
-	writeHeader(wrt, "Content-Type", fmt.Sprintf("multipart/mixed; boundary=\"%s\"", bnd))
-
-	writeCRLF(wrt)
-	err = writeString(wrt, fmt.Sprintf("--%s", bnd))
-	PanicLevel.LogErrorCtx(DebugLevel, fmt.Sprintf("writing multipart boundary '%s' part mail contents to smtp server", bnd), err)
-	writeCRLF(wrt)
-
-	writeHeader(wrt, "Content-Type", "application/zip")
-	writeHeader(wrt, "Content-Transfer-Encoding", "base64")
-	writeHeader(wrt, "Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", rep.GetZipName()))
-	writeCRLF(wrt)
-
-	enc := make([]byte, base64.StdEncoding.EncodedLen(rep.zipFile.Len()))
-	base64.StdEncoding.Encode(enc, rep.zipFile.Bytes())
-
-	if len(enc) < 1 {
-		PanicLevel.LogErrorCtx(NilLevel, "encoding xml report file", errors.New("encoded buffer is empty"))
-	}
-
-	// write base64 content in lines of up to 76 chars
-	tmp = make([]byte, 0)
-	for i, l := 0, len(enc); i < l; i++ {
-		tmp = append(tmp, enc[i])
-
-		if (i+1)%76 == 0 {
-			_, err = wrt.Write(tmp)
-			PanicLevel.LogErrorCtx(NilLevel, "writing 76 bytes of attachment to smtp server", err)
-
-			tmp = make([]byte, 0)
-			writeCRLF(wrt)
-		}
-	}
-
-	if len(tmp) != 0 {
-		_, err = wrt.Write(tmp)
-		PanicLevel.LogErrorCtx(NilLevel, "writing 76 bytes of attachment to smtp server", err)
-
-		tmp = make([]byte, 0)
-		writeCRLF(wrt)
-	}
-
-	writeCRLF(wrt)
-	writeCRLF(wrt)
-	err = writeString(wrt, fmt.Sprintf("--%s--", bnd))
-	PanicLevel.LogErrorCtx(NilLevel, fmt.Sprintf("writing end multipart boundary '%s' part mail contents to smtp server", bnd), err)
-	writeCRLF(wrt)
-	writeCRLF(wrt)
+	err = wrt.Close()
+	PanicLevel.LogErrorCtx(InfoLevel, "sending mail contents to smtp server", err)
 
 	err = cli.Noop()
 	PanicLevel.LogErrorCtx(InfoLevel, "checking SMTP connection is up", err)
+
+	return nil
 }
 
 func writeString(w io.WriteCloser, str string) error {
@@ -191,3 +228,41 @@ func writeCRLF(w io.WriteCloser) {
 	_, err := w.Write([]byte("\r\n"))
 	PanicLevel.LogErrorCtxf(DebugLevel, "writing CRLF '\\r\\n' to writer", err)
 }
+
+// lineWriter insert a CRLF each max bytes written
+type lineWriter struct {
+	w   io.Writer
+	n   int
+	max int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	var nbr int
+
+	for len(p) > 0 {
+		c := l.max - l.n
+		if c > len(p) {
+			c = len(p)
+		}
+
+		n, err := l.w.Write(p[:c])
+		nbr += n
+		l.n += n
+
+		if err != nil {
+			return nbr, err
+		}
+
+		p = p[c:]
+
+		if l.n >= l.max {
+			if _, err = l.w.Write([]byte("\r\n")); err != nil {
+				return nbr, err
+			}
+
+			l.n = 0
+		}
+	}
+
+	return nbr, nil
+}
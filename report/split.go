@@ -0,0 +1,153 @@
+package report
+
+import (
+	"fmt"
+
+	. "github.com/nabbar/opendmarc-reports/logger"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// maximum number of reports a report could be split into for a size limited destination
+const max_split_parts = 64
+
+// sendSplit send the report to a destination not accepting its size, split into several reports
+// or replaced by a notice if the records cannot be split under the limit
+func (rep *reportFile) sendSplit(dst Destination) []Delivery {
+	lst, err := rep.split(dst)
+
+	if err != nil {
+		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("splitting report '%s' for destination '%s'", rep.GetReportId(), dst.Uri), err)
+
+		if dst.Scheme != SchemeMail {
+			return []Delivery{rep.delivery(dst, DeliveryFailed, err)}
+		}
+
+		err = rep.SendNotice(dst, fmt.Sprintf("the report size (%d bytes) exceed the size limit (%d bytes)", rep.GetArchiveSize(dst), dst.Limit))
+		return []Delivery{rep.delivery(dst, DeliveryNotice, err)}
+	}
+
+	// the parts are kept until the report is closed, to read the payload of the deliveries
+	rep.m.Lock()
+	rep.parts = append(rep.parts, lst...)
+	rep.m.Unlock()
+
+	InfoLevel.Logf("Report '%s' split into %d reports for destination '%s'", rep.GetReportId(), len(lst), dst.Uri)
+
+	var res = make([]Delivery, 0, len(lst))
+
+	for _, p := range lst {
+		res = append(res, p.SendTo(dst))
+	}
+
+	return res
+}
+
+// split return the parts of the report, each one with a distinct report id and under the destination limit
+func (rep *reportFile) split(dst Destination) ([]*reportFile, error) {
+	var (
+		nbr = rep.sourceCount()
+		prt = int(rep.GetArchiveSize(dst)/dst.Limit) + 1
+	)
+
+	if nbr < 2 {
+		return nil, fmt.Errorf("cannot split a report of %d record", nbr)
+	}
+
+	for {
+		if prt > nbr {
+			prt = nbr
+		}
+
+		if prt > max_split_parts {
+			prt = max_split_parts
+		}
+
+		lst, err := rep.makeParts(dst, prt)
+
+		if err != nil {
+			closeParts(lst)
+			return nil, err
+		} else if lst != nil {
+			return lst, nil
+		} else if prt >= nbr || prt >= max_split_parts {
+			return nil, fmt.Errorf("records cannot be split under %d bytes into %d reports", dst.Limit, prt)
+		}
+
+		prt *= 2
+	}
+}
+
+// makeParts generate the file of each part from one cursor over the records, return nil if one of them is over the limit
+func (rep *reportFile) makeParts(dst Destination, prt int) ([]*reportFile, error) {
+	var (
+		nbr = rep.sourceCount()
+		siz = (nbr + prt - 1) / prt
+		lst = make([]*reportFile, 0, prt)
+	)
+
+	cur, err := rep.source()
+	if err != nil {
+		return nil, err
+	}
+
+	defer cur.Close()
+
+	for i := 0; i*siz < nbr; i++ {
+		last := (i + 1) * siz
+
+		if last > nbr {
+			last = nbr
+		}
+
+		p := rep.part(i+1, NewRecordLimit(cur, last-i*siz))
+		lst = append(lst, p)
+
+		if err := p.Archive(dst); err != nil {
+			return lst, err
+		} else if !dst.Fits(p.GetArchiveSize(dst)) {
+			closeParts(lst)
+			return nil, nil
+		}
+	}
+
+	return lst, nil
+}
+
+// part return a new report of the records of the given source
+func (rep *reportFile) part(idx int, src RecordSource) *reportFile {
+	var fbk = rep.xmlFile
+
+	fbk.MetaData.ReportId = fmt.Sprintf("%s-%d", rep.xmlFile.MetaData.ReportId, idx)
+
+	return &reportFile{
+		repuri:   rep.repuri,
+		xmlFile:  fbk,
+		source:   src,
+		xmlName:  fmt.Sprintf("%s!%d.xml", rep.baseName, idx),
+		baseName: fmt.Sprintf("%s!%d", rep.baseName, idx),
+		compress: rep.compress,
+		files:    make(map[string]*archive),
+	}
+}
+
+func closeParts(lst []*reportFile) {
+	for _, p := range lst {
+		err := p.Close()
+		ErrorLevel.LogErrorCtx(NilLevel, fmt.Sprintf("removing temporary file of report '%s'", p.GetReportId()), err)
+	}
+}
@@ -0,0 +1,157 @@
+package report
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestSplitLimit(t *testing.T) {
+	tst := []struct {
+		uri string
+		adr string
+		lim int64
+	}{
+		{"mailto:dmarc@example.com!10m", "mailto:dmarc@example.com", 10 << 20},
+		{"mailto:dmarc@example.com!1g", "mailto:dmarc@example.com", 1 << 30},
+		{"mailto:dmarc@example.com!50K", "mailto:dmarc@example.com", 50 << 10},
+		{"mailto:dmarc@example.com!2048", "mailto:dmarc@example.com", 2048},
+		{"mailto:dmarc@example.com", "mailto:dmarc@example.com", 0},
+		{"mailto:dmarc@example.com!10x", "mailto:dmarc@example.com!10x", 0},
+		{"https://example.com/dmarc!5m", "https://example.com/dmarc", 5 << 20},
+	}
+
+	for _, tc := range tst {
+		adr, lim := splitLimit(tc.uri)
+
+		if adr != tc.adr || lim != tc.lim {
+			t.Errorf("%q: got (%q, %d), want (%q, %d)", tc.uri, adr, lim, tc.adr, tc.lim)
+		}
+	}
+}
+
+func TestParseDestinationLimit(t *testing.T) {
+	tst := []struct {
+		uri string
+		adr string
+		tgt string
+		lim int64
+	}{
+		{"mailto:dmarc@example.com!10m", "mailto:dmarc@example.com", "dmarc@example.com", 10 << 20},
+		{" mailto:dmarc@example.com ", "mailto:dmarc@example.com", "dmarc@example.com", 0},
+		{"https://example.com/dmarc!5m", "https://example.com/dmarc", "https://example.com/dmarc", 5 << 20},
+	}
+
+	// the config is loaded on the first call and need a valid report interval
+	viper.Set("interval", "24h")
+
+	for _, tc := range tst {
+		dst := ParseDestination(tc.uri, CompressZip)
+
+		if dst.Uri != tc.adr || dst.Target != tc.tgt || dst.Limit != tc.lim {
+			t.Errorf("%q: got (%q, %q, %d), want (%q, %q, %d)", tc.uri, dst.Uri, dst.Target, dst.Limit, tc.adr, tc.tgt, tc.lim)
+		}
+	}
+}
+
+func TestFits(t *testing.T) {
+	tst := []struct {
+		dst  Destination
+		size int64
+		fits bool
+	}{
+		{Destination{Scheme: SchemeMail}, 1 << 40, true},
+		{Destination{Scheme: SchemeHttp, Limit: 10 << 20}, 10 << 20, true},
+		{Destination{Scheme: SchemeHttp, Limit: 10 << 20}, 10<<20 + 1, false},
+		{Destination{Scheme: SchemeFtp, Limit: 1 << 30}, 1 << 30, true},
+		// base64 encoding of the attachment grow the file by a third
+		{Destination{Scheme: SchemeMail, Limit: 10 << 20}, 10 << 20, false},
+		{Destination{Scheme: SchemeMail, Limit: 10 << 20}, 7 << 20, true},
+		{Destination{Scheme: SchemeMail, Limit: 2048}, 2048, false},
+		{Destination{Scheme: SchemeMail, Limit: 2048}, 1024, true},
+	}
+
+	for _, tc := range tst {
+		if got := tc.dst.Fits(tc.size); got != tc.fits {
+			t.Errorf("%s limit %d, size %d: got %v, want %v", tc.dst.Scheme, tc.dst.Limit, tc.size, got, tc.fits)
+		}
+	}
+}
+
+// countSource count the cursors opened on the records source
+type countSource struct {
+	src  RecordSource
+	open int
+}
+
+func (c *countSource) source() (RecordCursor, error) {
+	c.open++
+	return c.src()
+}
+
+func TestSplit(t *testing.T) {
+	var (
+		lst = make([]ReportRecord, 0)
+		src = &countSource{}
+		dst = Destination{Scheme: SchemeHttp, Compression: CompressNone, Limit: 4096}
+	)
+
+	for i := 0; i < 40; i++ {
+		lst = append(lst, GetReportRecord(fmt.Sprintf("192.0.2.%d", i+1), "none", "pass", "pass", "example.com", "example.com", "pass", i+1, nil))
+	}
+
+	src.src = NewRecordList(lst)
+
+	rep := GetReportSource("", GetReportMetadata("Example", "dmarc@example.org", "", "example.com-1", 0, 1), GetReportPolicy("example.com", "r", "r", "none", "none", 100, ""), CompressNone, src.source).(*reportFile)
+	defer rep.Close()
+
+	if err := rep.Archive(dst); err != nil {
+		t.Fatal(err)
+	} else if dst.Fits(rep.GetArchiveSize(dst)) {
+		t.Fatalf("report of %d bytes must not fit the limit", rep.GetArchiveSize(dst))
+	}
+
+	prt, err := rep.split(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeParts(prt)
+
+	var nbr, sum int
+
+	for _, p := range prt {
+		if !dst.Fits(p.GetArchiveSize(dst)) {
+			t.Errorf("part '%s' of %d bytes over the limit", p.GetReportId(), p.GetArchiveSize(dst))
+		}
+
+		nbr += p.GetRecordCount()
+		sum += p.GetMessageCount()
+	}
+
+	if nbr != rep.GetRecordCount() || sum != rep.GetMessageCount() {
+		t.Errorf("parts have %d records / %d messages, want %d / %d", nbr, sum, rep.GetRecordCount(), rep.GetMessageCount())
+	}
+
+	// one cursor for the report and one for each try of splitting, not one by part
+	if src.open >= len(prt) {
+		t.Errorf("got %d cursors opened for %d parts", src.open, len(prt))
+	}
+}
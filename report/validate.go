@@ -0,0 +1,257 @@
+package report
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// enumerations of the aggregate report schema (RFC 7489 Appendix C)
+var (
+	xsd_alignment   = []string{"r", "s"}
+	xsd_disposition = []string{"none", "quarantine", "reject"}
+	xsd_dmarcresult = []string{"pass", "fail"}
+	xsd_override    = []string{"forwarded", "sampled_out", "trusted_forwarder", "mailing_list", "local_policy", "other"}
+	xsd_dkimresult  = []string{"none", "pass", "fail", "policy", "neutral", "temperror", "permerror"}
+	xsd_spfscope    = []string{"helo", "mfrom"}
+	xsd_spfresult   = []string{"none", "neutral", "pass", "fail", "softfail", "temperror", "permerror"}
+)
+
+// schema value of the names of stored result codes out of the enumerations (RFC 6376 §6.1.2, RFC 7208 §2.6)
+var (
+	xsd_dkimalias = map[string]string{"softfail": "fail", "nxdomain": "permerror"}
+	xsd_spfalias  = map[string]string{"policy": "fail", "nxdomain": "none"}
+)
+
+// InvalidReportError is returned when a feedback document does not match the aggregate report schema
+type InvalidReportError struct {
+	ReportId string
+	Element  string
+	Value    string
+	Reason   string
+}
+
+func (e InvalidReportError) Error() string {
+	return fmt.Sprintf("invalid report '%s' : element '%s' with value '%s' %s", e.ReportId, e.Element, e.Value, e.Reason)
+}
+
+// IsInvalidReport return true if the error is a schema validation error of the report
+func IsInvalidReport(err error) bool {
+	_, ok := err.(InvalidReportError)
+	return ok
+}
+
+// validator keep the first schema error found into a feedback document
+type validator struct {
+	id  string
+	err error
+}
+
+func (v *validator) fail(elem, value, reason string) {
+	if v.err == nil {
+		v.err = InvalidReportError{
+			ReportId: v.id,
+			Element:  elem,
+			Value:    value,
+			Reason:   reason,
+		}
+	}
+}
+
+func (v *validator) required(elem, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.fail(elem, value, "is required")
+	}
+}
+
+func (v *validator) enum(elem, value string, lst []string) {
+	if _, ok := schemaValue(value, lst, nil); !ok {
+		v.fail(elem, value, fmt.Sprintf("is not one of [%s]", strings.Join(lst, ", ")))
+	}
+}
+
+// value return the schema value of a stored name, or fail and return the name if it cannot be mapped
+func (v *validator) value(elem, value string, lst []string, alias map[string]string) string {
+	if s, ok := schemaValue(value, lst, alias); ok {
+		return s
+	}
+
+	v.enum(elem, value, lst)
+
+	return value
+}
+
+// schemaValue return the value of the enumeration matching a stored name, itself or its alias
+func schemaValue(value string, lst []string, alias map[string]string) (string, bool) {
+	if a, ok := alias[value]; ok {
+		value = a
+	}
+
+	for _, s := range lst {
+		if value == s {
+			return s, true
+		}
+	}
+
+	return value, false
+}
+
+// normalize return the published policy with only schema values and a message for each stored value
+// that cannot be reported as is, replaced by its default (RFC 7489 §6.3 and §6.6.3 for an invalid p)
+func (pol ReportPolicy) normalize() (ReportPolicy, []string) {
+	var (
+		res = make([]string, 0)
+		def = func(elem, value, dflt string, lst []string) string {
+			if _, ok := schemaValue(value, lst, nil); ok {
+				return value
+			}
+
+			res = append(res, fmt.Sprintf("%s: stored value '%s' is reported as '%s'", elem, value, dflt))
+			return dflt
+		}
+	)
+
+	pol.ADKIM = def("policy_published/adkim", pol.ADKIM, "r", xsd_alignment)
+	pol.ASPF = def("policy_published/aspf", pol.ASPF, "r", xsd_alignment)
+	pol.P = def("policy_published/p", pol.P, "none", xsd_disposition)
+
+	if pol.SP != "" {
+		pol.SP = def("policy_published/sp", pol.SP, pol.P, xsd_disposition)
+	}
+
+	if pol.NP != "" {
+		pol.NP = def("policy_published/np", pol.NP, "", xsd_disposition)
+	}
+
+	return pol, res
+}
+
+// normalizeRecord return the record with the schema value of each stored name,
+// or an error if one of them cannot be mapped and so the record cannot be reported
+func (rep *reportFile) normalizeRecord(rec ReportRecord) (ReportRecord, error) {
+	var (
+		v   = &validator{id: rep.GetReportId()}
+		evl = &rec.Row.PolicyEvaluated
+		dkm = make([]ReportDKIM, 0, len(rec.AuthResults.DKIM))
+		rsn = make([]ReportReason, 0, len(evl.Reason))
+	)
+
+	evl.Disposition = v.value("record/row/policy_evaluated/disposition", evl.Disposition, xsd_disposition, nil)
+	evl.DKIM = v.value("record/row/policy_evaluated/dkim", evl.DKIM, xsd_dmarcresult, nil)
+	evl.SPF = v.value("record/row/policy_evaluated/spf", evl.SPF, xsd_dmarcresult, nil)
+
+	for _, r := range evl.Reason {
+		if _, ok := schemaValue(r.Type, xsd_override, nil); !ok {
+			// an override reason not known by the schema is still reported, with its name as comment
+			r.Comment = strings.TrimSpace(r.Type + " " + r.Comment)
+			r.Type = "other"
+		}
+
+		rsn = append(rsn, r)
+	}
+
+	for _, d := range rec.AuthResults.DKIM {
+		d.Result = v.value("record/auth_results/dkim/result", d.Result, xsd_dkimresult, xsd_dkimalias)
+		dkm = append(dkm, d)
+	}
+
+	if rec.AuthResults.SPF.Scope == "" {
+		rec.AuthResults.SPF.Scope = "mfrom"
+	}
+
+	rec.AuthResults.SPF.Scope = v.value("record/auth_results/spf/scope", rec.AuthResults.SPF.Scope, xsd_spfscope, nil)
+	rec.AuthResults.SPF.Result = v.value("record/auth_results/spf/result", rec.AuthResults.SPF.Result, xsd_spfresult, xsd_spfalias)
+
+	evl.Reason = rsn
+	rec.AuthResults.DKIM = dkm
+
+	if v.err != nil {
+		return rec, v.err
+	}
+
+	return rec, rep.validateRecord(rec)
+}
+
+// validateHeader check the metadata and the published policy of the feedback document
+func (rep *reportFile) validateHeader(format ReportFormat, met ReportMetadata, pol ReportPolicy) error {
+	var (
+		v = &validator{id: rep.GetReportId()}
+	)
+
+	v.required("report_metadata/org_name", met.OrgName)
+	v.required("report_metadata/email", met.Email)
+	v.required("report_metadata/report_id", met.ReportId)
+
+	if met.DateRange.Begin > met.DateRange.End {
+		v.fail("report_metadata/date_range/begin", fmt.Sprintf("%d", met.DateRange.Begin), fmt.Sprintf("is after end %d", met.DateRange.End))
+	}
+
+	v.required("policy_published/domain", pol.Domain)
+	v.enum("policy_published/adkim", pol.ADKIM, xsd_alignment)
+	v.enum("policy_published/aspf", pol.ASPF, xsd_alignment)
+	v.enum("policy_published/p", pol.P, xsd_disposition)
+
+	if pol.SP != "" {
+		v.enum("policy_published/sp", pol.SP, xsd_disposition)
+	}
+
+	if pol.PCT < 0 || pol.PCT > 100 {
+		v.fail("policy_published/pct", fmt.Sprintf("%d", pol.PCT), "is not between 0 and 100")
+	}
+
+	v.required("policy_published/fo", pol.FO)
+
+	if format == DMARCbis && pol.NP != "" {
+		v.enum("policy_published/np", pol.NP, xsd_disposition)
+	}
+
+	return v.err
+}
+
+// validateRecord check one record of the feedback document
+func (rep *reportFile) validateRecord(rec ReportRecord) error {
+	var v = &validator{id: rep.GetReportId()}
+
+	if net.ParseIP(rec.Row.SourceIp) == nil {
+		v.fail("record/row/source_ip", rec.Row.SourceIp, "is not an ip address")
+	}
+
+	if rec.Row.Count < 1 {
+		v.fail("record/row/count", fmt.Sprintf("%d", rec.Row.Count), "is not a positive count")
+	}
+
+	v.enum("record/row/policy_evaluated/disposition", rec.Row.PolicyEvaluated.Disposition, xsd_disposition)
+	v.enum("record/row/policy_evaluated/dkim", rec.Row.PolicyEvaluated.DKIM, xsd_dmarcresult)
+	v.enum("record/row/policy_evaluated/spf", rec.Row.PolicyEvaluated.SPF, xsd_dmarcresult)
+
+	for _, r := range rec.Row.PolicyEvaluated.Reason {
+		v.enum("record/row/policy_evaluated/reason/type", r.Type, xsd_override)
+	}
+
+	v.required("record/identifiers/header_from", rec.Identifiers.HeaderFrom)
+
+	for _, d := range rec.AuthResults.DKIM {
+		v.enum("record/auth_results/dkim/result", d.Result, xsd_dkimresult)
+	}
+
+	v.enum("record/auth_results/spf/scope", rec.AuthResults.SPF.Scope, xsd_spfscope)
+	v.enum("record/auth_results/spf/result", rec.AuthResults.SPF.Result, xsd_spfresult)
+
+	return v.err
+}
@@ -0,0 +1,208 @@
+package report
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func testReport(lst []ReportRecord, pol ReportPolicy) *reportFile {
+	return GetReport("mailto:dmarc@example.com", GetReportMetadata("Example", "dmarc@example.org", "", "example.com-1", 0, 1), pol, CompressNone, lst).(*reportFile)
+}
+
+func testPolicy() ReportPolicy {
+	return GetReportPolicy("example.com", "r", "s", "reject", "", 100, "")
+}
+
+func TestNormalizeRecord(t *testing.T) {
+	var rep = testReport(nil, testPolicy())
+
+	tst := []struct {
+		name string
+		set  func(r *ReportRecord)
+		chk  func(r ReportRecord) bool
+		err  string
+	}{
+		{"valid", func(r *ReportRecord) {}, func(r ReportRecord) bool {
+			return r.AuthResults.SPF.Result == "pass" && r.AuthResults.DKIM[0].Result == "pass"
+		}, ""},
+		{"dkim softfail", func(r *ReportRecord) { r.AuthResults.DKIM[0].Result = "softfail" }, func(r ReportRecord) bool {
+			return r.AuthResults.DKIM[0].Result == "fail"
+		}, ""},
+		{"dkim nxdomain", func(r *ReportRecord) { r.AuthResults.DKIM[0].Result = "nxdomain" }, func(r ReportRecord) bool {
+			return r.AuthResults.DKIM[0].Result == "permerror"
+		}, ""},
+		{"spf nxdomain", func(r *ReportRecord) { r.AuthResults.SPF.Result = "nxdomain" }, func(r ReportRecord) bool {
+			return r.AuthResults.SPF.Result == "none"
+		}, ""},
+		{"spf softfail", func(r *ReportRecord) { r.AuthResults.SPF.Result = "softfail" }, func(r ReportRecord) bool {
+			return r.AuthResults.SPF.Result == "softfail"
+		}, ""},
+		{"empty spf scope", func(r *ReportRecord) { r.AuthResults.SPF.Scope = "" }, func(r ReportRecord) bool {
+			return r.AuthResults.SPF.Scope == "mfrom"
+		}, ""},
+		{"unknown reason", func(r *ReportRecord) { r.AddReason("arc", "pass") }, func(r ReportRecord) bool {
+			return r.Row.PolicyEvaluated.Reason[0].Type == "other" && r.Row.PolicyEvaluated.Reason[0].Comment == "arc pass"
+		}, ""},
+		{"unknown disposition", func(r *ReportRecord) { r.Row.PolicyEvaluated.Disposition = "unknown" }, nil, "record/row/policy_evaluated/disposition"},
+		{"unknown alignment", func(r *ReportRecord) { r.Row.PolicyEvaluated.DKIM = "unknown" }, nil, "record/row/policy_evaluated/dkim"},
+		{"dkim signed", func(r *ReportRecord) { r.AuthResults.DKIM[0].Result = "signed" }, nil, "record/auth_results/dkim/result"},
+		{"spf discard", func(r *ReportRecord) { r.AuthResults.SPF.Result = "discard" }, nil, "record/auth_results/spf/result"},
+		{"spf scope", func(r *ReportRecord) { r.AuthResults.SPF.Scope = "pra" }, nil, "record/auth_results/spf/scope"},
+		{"source ip", func(r *ReportRecord) { r.Row.SourceIp = "" }, nil, "record/row/source_ip"},
+		{"count", func(r *ReportRecord) { r.Row.Count = 0 }, nil, "record/row/count"},
+		{"header from", func(r *ReportRecord) { r.Identifiers.HeaderFrom = "" }, nil, "record/identifiers/header_from"},
+	}
+
+	for _, tc := range tst {
+		rec := GetReportRecord("192.0.2.1", "none", "pass", "fail", "example.com", "example.org", "pass", 1, []ReportDKIM{GetReportDKIM("example.com", "s1", "pass", "")})
+		tc.set(&rec)
+
+		res, err := rep.normalizeRecord(rec)
+
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			} else if !tc.chk(res) {
+				t.Errorf("%s: unexpected record %+v", tc.name, res)
+			}
+
+			continue
+		}
+
+		if e, ok := err.(InvalidReportError); !ok {
+			t.Errorf("%s: got error %v, want invalid element %s", tc.name, err, tc.err)
+		} else if e.Element != tc.err {
+			t.Errorf("%s: got invalid element %s, want %s", tc.name, e.Element, tc.err)
+		}
+	}
+}
+
+func TestNormalizeRecordKeepSource(t *testing.T) {
+	var (
+		rep = testReport(nil, testPolicy())
+		dkm = []ReportDKIM{GetReportDKIM("example.com", "s1", "softfail", "")}
+		rec = GetReportRecord("192.0.2.1", "none", "pass", "fail", "example.com", "example.org", "pass", 1, dkm)
+	)
+
+	if _, err := rep.normalizeRecord(rec); err != nil {
+		t.Fatal(err)
+	} else if dkm[0].Result != "softfail" {
+		t.Errorf("the record of the source must not be modified, got dkim result %s", dkm[0].Result)
+	}
+}
+
+func TestNormalizePolicy(t *testing.T) {
+	tst := []struct {
+		name string
+		pol  ReportPolicy
+		exp  ReportPolicy
+		nbr  int
+	}{
+		{"valid", GetReportPolicy("example.com", "r", "s", "reject", "quarantine", 100, ""), GetReportPolicy("example.com", "r", "s", "reject", "quarantine", 100, ""), 0},
+		{"unknown p", GetReportPolicy("example.com", "r", "r", "unknown", "", 100, ""), GetReportPolicy("example.com", "r", "r", "none", "", 100, ""), 1},
+		{"unknown sp", GetReportPolicy("example.com", "r", "r", "reject", "unknown", 100, ""), GetReportPolicy("example.com", "r", "r", "reject", "reject", 100, ""), 1},
+		{"unknown alignment", GetReportPolicy("example.com", "unknown", "x", "none", "", 100, ""), GetReportPolicy("example.com", "r", "r", "none", "", 100, ""), 2},
+	}
+
+	for _, tc := range tst {
+		res, msg := tc.pol.normalize()
+
+		if res != tc.exp {
+			t.Errorf("%s: got %+v, want %+v", tc.name, res, tc.exp)
+		}
+
+		if len(msg) != tc.nbr {
+			t.Errorf("%s: got messages %v, want %d", tc.name, msg, tc.nbr)
+		}
+	}
+}
+
+func TestWriteXmlDropRecord(t *testing.T) {
+	var (
+		buf = bytes.NewBuffer(nil)
+		lst = []ReportRecord{
+			GetReportRecord("192.0.2.1", "none", "pass", "pass", "example.com", "example.com", "pass", 2, nil),
+			GetReportRecord("192.0.2.2", "unknown", "pass", "pass", "example.com", "example.com", "pass", 3, nil),
+			GetReportRecord("192.0.2.3", "reject", "fail", "fail", "example.com", "example.com", "nxdomain", 4, nil),
+		}
+		rep = testReport(lst, GetReportPolicy("example.com", "r", "r", "unknown", "", 100, ""))
+	)
+
+	if err := rep.WriteXml(buf, RFC7489, true); err != nil {
+		t.Fatalf("a record out of the schema must not refuse the whole report : %v", err)
+	}
+
+	if rep.GetRecordCount() != 2 || rep.GetMessageCount() != 6 || rep.sourceCount() != 3 {
+		t.Errorf("got %d records / %d messages / %d read, want 2 / 6 / 3", rep.GetRecordCount(), rep.GetMessageCount(), rep.sourceCount())
+	}
+
+	xml := buf.String()
+
+	for _, s := range []string{"<p>none</p>", "<error>policy_published/p: stored value &#39;unknown&#39; is reported as &#39;none&#39;</error>", "<source_ip>192.0.2.3</source_ip>", "<result>none</result>"} {
+		if !strings.Contains(xml, s) {
+			t.Errorf("missing %s into report :\n%s", s, xml)
+		}
+	}
+
+	if strings.Contains(xml, "192.0.2.2") {
+		t.Errorf("the record out of the schema must be dropped :\n%s", xml)
+	}
+}
+
+func TestWriteXmlDroppedKeys(t *testing.T) {
+	var lst = make([]ReportRecord, 0)
+
+	for i, s := range []string{"none", "unknown", "unknown", "reject"} {
+		rec := GetReportRecord("192.0.2."+strconv.Itoa(i/2+1), s, "pass", "pass", "example.com", "example.com", "pass", 1, nil)
+		rec.SetKey(i)
+		lst = append(lst, rec)
+	}
+
+	// the two unknown rows are one group, merged into one dropped record
+	lst[2].Row.SourceIp = lst[1].Row.SourceIp
+
+	rep := GetReportSource("", GetReportMetadata("Example", "dmarc@example.org", "", "example.com-1", 0, 1), testPolicy(), CompressNone, func() (RecordCursor, error) {
+		cur, err := NewRecordList(lst)()
+		return NewAggregateCursor(cur), err
+	}).(*reportFile)
+
+	if err := rep.WriteXml(bytes.NewBuffer(nil), RFC7489, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if key := rep.GetDroppedKeys(); rep.GetDroppedCount() != 1 || len(key) != 2 || key[0] != 1 || key[1] != 2 {
+		t.Errorf("got %d dropped records with keys %v, want 1 with keys [1 2]", rep.GetDroppedCount(), key)
+	}
+
+	if len(lst[1].keys) != 1 {
+		t.Errorf("merging the records must not change the keys of the source record : %v", lst[1].keys)
+	}
+}
+
+func TestWriteXmlInvalidHeader(t *testing.T) {
+	var rep = testReport(nil, testPolicy())
+
+	rep.xmlFile.MetaData.OrgName = ""
+
+	if err := rep.WriteXml(bytes.NewBuffer(nil), RFC7489, true); !IsInvalidReport(err) {
+		t.Errorf("got error %v, want an invalid report error", err)
+	}
+}
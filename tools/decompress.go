@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const (
+	CompressionNone  = ""
+	CompressionGzip  = "gzip"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+)
+
+var magicNumbers = []struct {
+	format string
+	magic  []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// compressionOf return the compression format detected from the magic bytes of a file start
+func compressionOf(head []byte) string {
+	for _, m := range magicNumbers {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+
+	return CompressionNone
+}
+
+// FileCompression return the compression format of a file, read from its magic bytes without moving the file offset
+func FileCompression(f *os.File) (string, error) {
+	var buf = make([]byte, 6)
+
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return CompressionNone, err
+	}
+
+	return compressionOf(buf[:n]), nil
+}
+
+// PeekCompression return the compression format of a stream, read from its magic bytes,
+// and the reader to use instead of the stream
+func PeekCompression(r io.Reader) (io.Reader, string, error) {
+	var b = bufio.NewReader(r)
+
+	head, err := b.Peek(6)
+	if err != nil && err != io.EOF {
+		return b, CompressionNone, err
+	}
+
+	return b, compressionOf(head), nil
+}
+
+// Decompress return a reader of the uncompressed content of r, for a format given by FileCompression or PeekCompression
+func Decompress(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case CompressionXz:
+		if x, err := xz.NewReader(r); err != nil {
+			return nil, err
+		} else {
+			return ioutil.NopCloser(x), nil
+		}
+	case CompressionZstd:
+		if z, err := zstd.NewReader(r); err != nil {
+			return nil, err
+		} else {
+			return z.IOReadCloser(), nil
+		}
+	}
+
+	return ioutil.NopCloser(r), nil
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package tools
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Copyright 2018 Nicolas JUHEL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// FileInode return the inode number of the file, or 0 if not available
+func FileInode(inf os.FileInfo) uint64 {
+	if st, ok := inf.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+
+	return 0
+}